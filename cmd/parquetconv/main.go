@@ -0,0 +1,66 @@
+// Command parquetconv converts a Parquet file (local or on GCS) to CSV or NDJSON.
+//
+//	parquetconv -in gs://bucket/path/file.parquet -out - -columns id,event_date,payload.type
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/context"
+
+	gt "github.com/belboo/boo-go-tools/gcs"
+	bu "github.com/belboo/boo-go-tools/misc"
+)
+
+func main() {
+	in := flag.String("in", "", "source Parquet file, local path or gs://bucket/object")
+	out := flag.String("out", "-", "destination, local path, gs://bucket/object or - for stdout")
+	format := flag.String("format", "csv", "output format: csv or ndjson")
+	project := flag.String("project", os.Getenv("GOOGLE_CLOUD_PROJECT"), "GCP project used for GCS access")
+	columns := flag.String("columns", "", "comma separated list of (flattened) columns to output")
+	flatten := flag.Bool("flatten", false, "flatten nested records in NDJSON output")
+	separator := flag.String("separator", ".", "separator of flattened column names")
+	delimiter := flag.String("delimiter", ",", "CSV delimiter")
+	noHeader := flag.Bool("no-header", false, "do not write a CSV header")
+	null := flag.String("null", "", "CSV representation of null values")
+	timeFormat := flag.String("time-format", "", "Go layout for dates and timestamps, RFC3339 with fractional seconds by default")
+	flag.Parse()
+
+	tl := &bu.TLogger{LogType: bu.LogLocal, LogLevel: bu.LogNormal}
+
+	if *in == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	delim, _ := utf8.DecodeRuneInString(*delimiter)
+	if *delimiter == `\t` {
+		delim = '\t'
+	}
+
+	opts := gt.ConvertOptions{
+		Format:     gt.ConvertFormat(strings.ToLower(*format)),
+		Project:    *project,
+		Columns:    bu.SplitArray(*columns, ","),
+		Flatten:    *flatten,
+		Separator:  *separator,
+		Delimiter:  delim,
+		NoHeader:   *noHeader,
+		NullValue:  *null,
+		TimeFormat: *timeFormat,
+	}
+
+	stats, err := gt.ConvertParquet(context.Background(), *in, *out, opts)
+	if err != nil {
+		tl.Err(err)
+		os.Exit(1)
+	}
+
+	if *out != "-" {
+		tl.Log(fmt.Sprintf("wrote %v rows (%v columns) to %v", stats.Rows, len(stats.Columns), *out))
+	}
+}
@@ -6,19 +6,23 @@ import (
 	"time"
 	"reflect"
 	
-	"github.com/gammazero/workerpool"
-
 	"cloud.google.com/go/bigquery"
 	"google.golang.org/api/googleapi"
 	"golang.org/x/net/context"
-	"google.golang.org/api/iterator"
 	"net/http"
 
 	bu "github.com/belboo/boo-go-tools/misc"
 )
 
-// SchemasMatch checks schemas field by field (by name and type) to see if they match
+// SchemasMatch checks schemas field by field (by name and type) to see if they match. Only top level
+// fields are compared, by position, and s2 may have extra trailing fields. s2 missing fields of s1 is
+// a mismatch (it used to panic).
+//
+// Deprecated: use SchemaDiff, which also covers modes, nested records and tells compatible changes from breaking ones
 func SchemasMatch(s1 bigquery.Schema, s2 bigquery.Schema) bool {
+	if len(s2) < len(s1) {
+		return false
+	}
 	for i := range s1 {
 		if s1[i].Name != s2[i].Name || s1[i].Type != s2[i].Type {
 			return false
@@ -58,13 +62,16 @@ func GetDatasetMetaCopy(from *bigquery.DatasetMetadata) *bigquery.DatasetMetadat
 // GetTableMetaCopy is a semi-deep-copy of bigquery.TableMetadata object
 func GetTableMetaCopy(from *bigquery.TableMetadata) *bigquery.TableMetadata {
 	newTableMeta := &bigquery.TableMetadata{
-		Name:             from.Name,
-		Schema:           from.Schema,
-		Description:      from.Description,
-		EncryptionConfig: from.EncryptionConfig,
-		ExpirationTime:   from.ExpirationTime,
-		Labels:           from.Labels,
-		TimePartitioning: from.TimePartitioning,
+		Name:                   from.Name,
+		Schema:                 from.Schema,
+		Description:            from.Description,
+		EncryptionConfig:       from.EncryptionConfig,
+		ExpirationTime:         from.ExpirationTime,
+		Labels:                 from.Labels,
+		TimePartitioning:       from.TimePartitioning,
+		RangePartitioning:      from.RangePartitioning,
+		RequirePartitionFilter: from.RequirePartitionFilter,
+		Clustering:             from.Clustering,
 	}
 
 	return newTableMeta
@@ -88,7 +95,9 @@ func GetBQClient(ctx context.Context, project string) (*bigquery.Client, error)
 	return client, nil
 }
 
-// CreateBQTable is a thin envelope for BQ table creation
+// CreateBQTable is a thin envelope for BQ table creation (daily partitioned, bqTableExpiration in days, 0 never expires)
+//
+// Deprecated: use CreateTable or CreateOrUpdateTable with a TableSpec
 func CreateBQTable(ctx context.Context, bqClient *bigquery.Client, 
 	bqDataset string, bqTable string, bqSchema bigquery.Schema, 
 	bqTableDescription string, bqTableLabels map[string]string, 
@@ -126,18 +135,20 @@ func CreateBQTable(ctx context.Context, bqClient *bigquery.Client,
 		}
 	}
 
-	timePartitioning := &bigquery.TimePartitioning{Expiration: 0}
-
-	if len(bqTimePartitionField) > 0 {
-		timePartitioning.Field = bqTimePartitionField
+	spec := TableSpec{
+		Schema:         bqSchema,
+		Description:    bqTableDescription,
+		Labels:         bqTableLabels,
+		PartitionType:  PartitionDay,
+		PartitionField: bqTimePartitionField,
+	}
+	if bqTableExpiration > 0 {
+		spec.TableExpiration = time.Duration(bqTableExpiration) * 24 * time.Hour
 	}
 
-	dstTMeta := &bigquery.TableMetadata{
-		Name:             bqTable,
-		Schema:           bqSchema,
-		Description:      bqTableDescription,
-		Labels:           bqTableLabels,
-		TimePartitioning: timePartitioning,
+	dstTMeta, err := spec.TableMetadata(bqTable)
+	if err != nil {
+		return err
 	}
 
 	err = dstT.Create(ctx, dstTMeta)
@@ -157,90 +168,50 @@ func InsertFromGCSIntoBQ(ctx context.Context, bqClient *bigquery.Client,
 						gcsBucket string, gcsObject string, bqDataset string, 
 						bqTable string, bqTimePartitionField string) error {
 
-	var err error
-
-	dstDS := bqClient.Dataset(bqDataset)
-	dstT := dstDS.Table(bqTable)
-	
-	gcsO := bigquery.NewGCSReference("gs://" + gcsBucket + "/" + gcsObject)
-	gcsO.SourceFormat = bigquery.Parquet
-	loader := dstT.LoaderFrom(gcsO)
-	loader.CreateDisposition = bigquery.CreateNever
-	if bqTimePartitionField != "" {
-		loader.TimePartitioning = &bigquery.TimePartitioning{Expiration: 0, Field: bqTimePartitionField}
-	}
-
-	job, err := loader.Run(ctx)
-	if err != nil {
-		return bu.TError{
-			Msg:    fmt.Sprintf("could not load data into %v.%v from %v/%v", bqDataset, bqTable, gcsBucket, gcsObject),
-			Origin: "InsertFromGCSIntoBQ",
-			Code:   bu.ErrGCS,
-			Err:    err,
-		}
+	spec := LoadSpec{
+		URIs:   []string{"gs://" + gcsBucket + "/" + gcsObject},
+		Format: bigquery.Parquet,
 	}
-	status, err := job.Wait(ctx)
-	if err != nil {
-		return bu.TError{
-			Msg:    fmt.Sprintf("loading into %v.%v from %v/%v failed", bqDataset, bqTable, gcsBucket, gcsObject),
-			Origin: "InsertFromGCSIntoBQ",
-			Code:   bu.ErrLoadGCS,
-			Err:    err,
-		}
-	}
-	if status.Err() != nil {
-		return bu.TError{
-			Msg:    fmt.Sprintf("loading into %v.%v from %v/%v returned:\n%v", bqDataset, bqTable, gcsBucket, gcsObject, status),
-			Origin: "InsertFromGCSIntoBQ",
-			Code:   bu.ErrLoadGCS,
-			Err:    err,
-		}
+	if bqTimePartitionField != "" {
+		spec.TimePartitioning = &bigquery.TimePartitioning{Expiration: 0, Field: bqTimePartitionField}
 	}
 
-	return nil
+	_, err := InsertFromGCSIntoBQWithSpec(ctx, bqClient, bqDataset, bqTable, spec)
+	return err
 }
 
-// PushToBQ is an attemp at concurrent data upload
-func PushToBQ() error {
-	wp := workerpool.New(2)
-	defer wp.StopWait()
-	requests := []string{"alpha", "beta", "gamma", "delta", "epsilon"}
-
-	for _, r := range requests {
-		r := r
-		wp.Submit(func() {
-			fmt.Println("Handling request:", r)
-			time.Sleep(2 * time.Second)
-		})
+// DropBQTablePartition deletes a specified partition from a table in BQ, partition is anything PartitionFor accepts
+func DropBQTablePartition(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string, partition interface{}) error {
+	tMeta, err := getTableMeta(ctx, bqClient, bqDataset, bqTable, "DropBQTablePartition")
+	if err != nil {
+		return err
+	}
+	if err := autoSnapshot(ctx, bqClient, bqDataset, bqTable, "DropBQTablePartition"); err != nil {
+		return err
 	}
 
-	return nil
+	return dropPartition(ctx, bqClient, bqDataset, bqTable, tMeta, partition)
 }
 
-// DropBQTablePartition deletes a specified partition from a table in BQ
-func DropBQTablePartition(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string, partition interface{}) error {
-	partitionString, ok := partition.(string)
-	if !ok {
-		partitionTime, ok := partition.(time.Time)
-		if ok {
-			partitionString = partitionTime.Format("20060102")
-		} else {
-			return bu.TError{
-				Msg:    fmt.Sprintf("invalid partition specification [%v]", partition),
-				Origin: "RmBQbqTablePartition",
-				Code:   bu.ErrGeneric,
-				Err:    nil,
-			}
+// dropPartition deletes a partition of a table with known metadata
+func dropPartition(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string, tMeta *bigquery.TableMetadata, partition interface{}) error {
+	p, err := PartitionFor(tMeta, partition)
+	if err != nil {
+		return bu.TError{
+			Msg:    fmt.Sprintf("invalid partition specification [%v]", partition),
+			Origin: "DropBQTablePartition",
+			Code:   bu.ErrGeneric,
+			Err:    err,
 		}
 	}
 
 	dstDS := bqClient.Dataset(bqDataset)
-	dstT := dstDS.Table(bqTable + "$" + partitionString)
-	err := dstT.Delete(ctx)
+	dstT := dstDS.Table(p.Decorator(bqTable))
+	err = dstT.Delete(ctx)
 	if err != nil {
 		return bu.TError{
-			Msg:    fmt.Sprintf("failed to delete bqTable partition"),
-			Origin: "RmBQbqTablePartition",
+			Msg:    fmt.Sprintf("failed to delete bqTable partition %v.%v", bqDataset, p.Decorator(bqTable)),
+			Origin: "DropBQTablePartition",
 			Code:   bu.ErrDeleteTable,
 			Err:    err,
 		}
@@ -249,7 +220,7 @@ func DropBQTablePartition(ctx context.Context, bqClient *bigquery.Client, bqData
 	return nil
 }
 
-// DropBQTablePartitions removes partitions from bqDataset.bqTable for dates in bqPartitionsToDrop time.Time slice
+// DropBQTablePartitions removes partitions from bqDataset.bqTable listed in the bqPartitionsToDrop slice
 func DropBQTablePartitions(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string, bqPartitionsToDrop interface{}) error {
 	partitions := reflect.ValueOf(bqPartitionsToDrop)
 	
@@ -262,8 +233,16 @@ func DropBQTablePartitions(ctx context.Context, bqClient *bigquery.Client, bqDat
 		}
 	}
 
+	tMeta, err := getTableMeta(ctx, bqClient, bqDataset, bqTable, "DropBQTablePartitions")
+	if err != nil {
+		return err
+	}
+	if err := autoSnapshot(ctx, bqClient, bqDataset, bqTable, "DropBQTablePartitions"); err != nil {
+		return err
+	}
+
 	for i := 0; i < partitions.Len(); i++ {
-		err := DropBQTablePartition(ctx, bqClient, bqDataset, bqTable, partitions.Index(i).Interface())
+		err := dropPartition(ctx, bqClient, bqDataset, bqTable, tMeta, partitions.Index(i).Interface())
 		if err != nil {
 			return err
 		}
@@ -272,158 +251,45 @@ func DropBQTablePartitions(ctx context.Context, bqClient *bigquery.Client, bqDat
 	return nil
 }
 
-// GetBQTablePartitions returns a list of partition date-strings in a BQ table
-func GetBQTablePartitions(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string) ([]time.Time, error) {
-	ds := bqClient.Dataset(bqDataset)
-	t := ds.Table(bqTable)
-	tMeta, err := t.Metadata(ctx)
+// GetBQTablePartitions returns a list of partitions in a BQ table with their row counts, sizes and
+// last-modified times as reported by INFORMATION_SCHEMA.PARTITIONS (no table scan)
+func GetBQTablePartitions(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string) ([]Partition, error) {
+	return GetBQTablePartitionsWithOptions(ctx, bqClient, bqDataset, bqTable, PartitionListOptions{})
+}
+
+// getTableMeta fetches table metadata telling a missing table from other failures
+func getTableMeta(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string, origin string) (*bigquery.TableMetadata, error) {
+	tMeta, err := bqClient.Dataset(bqDataset).Table(bqTable).Metadata(ctx)
 	if err != nil {
-		if erg, ok := err.(*googleapi.Error); ok {
-			if erg.Code == http.StatusNotFound && len(erg.Errors) > 0 && erg.Errors[0].Reason == "notFound" {
-				return nil, bu.TError{
-					Msg:    fmt.Sprintf("table %v.%v not found", bqDataset, bqTable),
-					Origin: "GetBQTablePartitions",
-					Code:   bu.ErrTableNotFound,
-					Err:    err,
-				}
+		if isNotFound(err) {
+			return nil, bu.TError{
+				Msg:    fmt.Sprintf("table %v.%v not found", bqDataset, bqTable),
+				Origin: origin,
+				Code:   bu.ErrTableNotFound,
+				Err:    err,
 			}
 		}
 		return nil, bu.TError{
 			Msg:    fmt.Sprintf("failed to fetch metadata for %v.%v", bqDataset, bqTable),
-			Origin: "GetBQTablePartitions",
+			Origin: origin,
 			Code:   bu.ErrGetTableMeta,
 			Err:    err,
 		}
 	}
-	
-	if tMeta.TimePartitioning == nil {
-		return nil, bu.TError{
-			Msg:    fmt.Sprintf("table %v.%v is not partitioned", bqDataset, bqTable),
-			Origin: "GetBQTablePartitions",
-			Code:   bu.ErrTableNotPartitioned,
-			Err:    err,
-		}
-	} 
-
-	partitionField := "_PARTITIONTIME"
-	if tMeta.TimePartitioning.Field != "" {
-		partitionField = tMeta.TimePartitioning.Field
-	}
-
-	qry := bqClient.Query(fmt.Sprintf(
-		"SELECT FORMAT_DATE('%%Y%%m%%d', p) AS p, n " +
-		"FROM (SELECT DATE(`%v`) AS p, COUNT(*) AS n " +
-		"FROM `%v`.`%v` GROUP BY DATE(`%v`)) ORDER BY p",
-		partitionField, bqDataset, bqTable, partitionField))
-	
-	it, err := qry.Read(ctx)
-	if err != nil {
-		return nil, bu.TError{
-			Msg:    fmt.Sprintf("query to %v.%v failed", bqDataset, bqTable),
-			Origin: "GetBQTablePartitions",
-			Code:   bu.ErrDataQuery,
-			Err:    err,
-		}
-	}
-
-	partitions := make([]time.Time, 0, it.TotalRows)
-
-	for {
-		var values []bigquery.Value
-		err := it.Next(&values)
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			return nil, bu.TError{
-				Msg:    fmt.Sprintf("query result from %v.%v is weird", bqDataset, bqTable),
-				Origin: "GetBQTablePartitions",
-				Code:   bu.ErrDataQuery,
-				Err:    err,
-			}
-		}
-		partitionTime, err := time.Parse("20060102", values[0].(string))
-		if err != nil {
-			return nil, bu.TError{
-				Msg:    fmt.Sprintf("couldn't parse time returned from %v.%v", bqDataset, bqTable),
-				Origin: "GetBQTablePartitions",
-				Code:   bu.ErrGeneric,
-				Err:    err,
-			}
-		}
-		partitions = append(partitions, partitionTime)
-	}
-
-	return partitions, nil
+	return tMeta, nil
 }
 
-// GetBQColumnStats returns a statistic or a set thereof on a column
+// GetBQColumnStats returns a statistic or a set thereof (ColumnStat names) on a column
 func GetBQColumnStats(ctx context.Context, bqClient *bigquery.Client, stats []string, bqDataset string, bqTable string, bqColumn string) (map[string]interface{}, error) {
-	ds := bqClient.Dataset(bqDataset)
-	t := ds.Table(bqTable)
-	tMeta, err := t.Metadata(ctx)
-	if err != nil {
-		return nil, bu.TError{
-			Msg:    fmt.Sprintf("failed to fetch metadata of %v.%v", bqDataset, bqTable),
-			Origin: "GetBQColumnStats",
-			Code:   bu.ErrGetTableMeta,
-			Err:    err,
-		}
+	opts := ColumnStatsOptions{Stats: make([]ColumnStat, len(stats))}
+	for i, s := range stats {
+		opts.Stats[i] = ColumnStat(s)
 	}
 
-	if !HasField(&tMeta.Schema, bqColumn) {
-		return nil, bu.TError{
-			Msg:    fmt.Sprintf("column %v not in %v.%v", bqColumn, bqDataset, bqTable),
-			Origin: "GetBQColumnStats",
-			Code:   bu.ErrGeneric,
-			Err:    nil,
-		}
+	columnStats, err := GetColumnStats(ctx, bqClient, bqDataset, bqTable, bqColumn, opts)
+	if err != nil {
+		return nil, err
 	}
 
-	fmt.Println("here")
-	
-	// qry := bqClient.Query(fmt.Sprintf(
-	// 	"SELECT FORMAT_DATE('%%Y%%m%%d', p) AS p, n " +
-	// 	"FROM (SELECT DATE(`%v`) AS p, COUNT(*) AS n " +
-	// 	"FROM `%v`.`%v` GROUP BY DATE(`%v`)) ORDER BY p",
-	// 	partitionField, bqDataset, bqTable, partitionField))
-	
-	// it, err := qry.Read(ctx)
-	// if err != nil {
-	// 	return nil, bu.TError{
-	// 		Msg:    fmt.Sprintf("query to %v.%v failed", bqDataset, bqTable),
-	// 		Origin: "GetBQTablePartitions",
-	// 		Code:   bu.ErrDataQuery,
-	// 		Err:    err,
-	// 	}
-	// }
-
-	statsValues := make(map[string]interface{})
-	// for {
-	// 	var values []bigquery.Value
-	// 	err := it.Next(&values)
-	// 	if err == iterator.Done {
-	// 		break
-	// 	}
-	// 	if err != nil {
-	// 		return nil, bu.TError{
-	// 			Msg:    fmt.Sprintf("query result from %v.%v is weird", bqDataset, bqTable),
-	// 			Origin: "GetBQTablePartitions",
-	// 			Code:   bu.ErrDataQuery,
-	// 			Err:    err,
-	// 		}
-	// 	}
-	// 	partitionTime, err := time.Parse("20060102", values[0].(string))
-	// 	if err != nil {
-	// 		return nil, bu.TError{
-	// 			Msg:    fmt.Sprintf("couldn't parse time returned from %v.%v", bqDataset, bqTable),
-	// 			Origin: "GetBQTablePartitions",
-	// 			Code:   bu.ErrGeneric,
-	// 			Err:    err,
-	// 		}
-	// 	}
-	// 	partitions = append(partitions, partitionTime)
-	// }
-
-	return statsValues, nil
+	return columnStats.Map(), nil
 }
\ No newline at end of file
@@ -0,0 +1,173 @@
+package bqtools
+
+import (
+	"fmt"
+	"sync"
+
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/net/context"
+
+	bu "github.com/belboo/boo-go-tools/misc"
+)
+
+// DefaultPricePerTiB is the on-demand price (USD) of a TiB processed used when a policy does not set one
+const DefaultPricePerTiB = 6.25
+
+// QueryEstimate is the result of a query dry run
+type QueryEstimate struct {
+	TotalBytesProcessed int64
+	ReferencedTables    []*bigquery.Table
+	Schema              bigquery.Schema
+	StatementType       string
+}
+
+// Cost returns the on-demand cost of the query at a given price per TiB
+func (e *QueryEstimate) Cost(pricePerTiB float64) float64 {
+	return float64(e.TotalBytesProcessed) / float64(1<<40) * pricePerTiB
+}
+
+// EstimateQuery dry-runs a query (parameters as for RunQuery) returning what it would process
+func EstimateQuery(ctx context.Context, bqClient *bigquery.Client, sql string, params interface{}) (*QueryEstimate, error) {
+	qParams, err := QueryParameters(params)
+	if err != nil {
+		return nil, err
+	}
+	qry := bqClient.Query(sql)
+	qry.Parameters = qParams
+
+	return estimateQuery(ctx, qry, "EstimateQuery")
+}
+
+// estimateQuery dry-runs a copy of a configured query
+func estimateQuery(ctx context.Context, qry *bigquery.Query, origin string) (*QueryEstimate, error) {
+	dry := *qry
+	dry.DryRun = true
+
+	job, err := dry.Run(ctx)
+	if err == nil {
+		err = job.LastStatus().Err()
+	}
+	if err != nil {
+		return nil, bu.TError{
+			Msg:    "dry run failed",
+			Origin: origin,
+			Code:   bu.ErrDataQuery,
+			Err:    err,
+		}
+	}
+
+	est := &QueryEstimate{}
+	if stats := job.LastStatus().Statistics; stats != nil {
+		est.TotalBytesProcessed = stats.TotalBytesProcessed
+		if qs, ok := stats.Details.(*bigquery.QueryStatistics); ok {
+			est.ReferencedTables = qs.ReferencedTables
+			est.Schema = qs.Schema
+			est.StatementType = qs.StatementType
+		}
+	}
+	return est, nil
+}
+
+// BudgetAction is what a BudgetPolicy does with queries over budget
+type BudgetAction int
+
+// BudgetAction ENUM values
+const (
+	BudgetRefuse BudgetAction = iota // fail with ErrBudgetExceeded without running the query
+	BudgetWarn                       // log a warning and run the query anyway
+)
+
+// BudgetPolicy limits the queries bqtools issues with a client, every query is dry-run first
+type BudgetPolicy struct {
+	MaxBytes    int64   // 0 means no bytes limit
+	MaxCost     float64 // USD, 0 means no cost limit
+	PricePerTiB float64 // defaults to DefaultPricePerTiB
+	Action      BudgetAction
+
+	Logger *bu.TLogger // warnings of BudgetWarn go here
+}
+
+var (
+	budgetMu       sync.RWMutex
+	budgetPolicies = make(map[*bigquery.Client]*BudgetPolicy)
+)
+
+// SetBudgetPolicy sets the budget policy of the queries bqtools runs with a client, nil removes it
+func SetBudgetPolicy(bqClient *bigquery.Client, policy *BudgetPolicy) {
+	budgetMu.Lock()
+	defer budgetMu.Unlock()
+	if policy == nil {
+		delete(budgetPolicies, bqClient)
+		return
+	}
+	p := *policy
+	if p.PricePerTiB <= 0 {
+		p.PricePerTiB = DefaultPricePerTiB
+	}
+	budgetPolicies[bqClient] = &p
+}
+
+// GetBudgetPolicy returns the budget policy of a client, nil if none
+func GetBudgetPolicy(bqClient *bigquery.Client) *BudgetPolicy {
+	budgetMu.RLock()
+	defer budgetMu.RUnlock()
+	return budgetPolicies[bqClient]
+}
+
+// checkBudget applies the client's budget policy (if any) to a query about to run, the query
+// is capped with MaxBytesBilled as well so the estimate cannot be exceeded unnoticed
+func checkBudget(ctx context.Context, bqClient *bigquery.Client, qry *bigquery.Query, origin string) error {
+	policy := GetBudgetPolicy(bqClient)
+	if policy == nil || (policy.MaxBytes <= 0 && policy.MaxCost <= 0) {
+		return nil
+	}
+
+	est, err := estimateQuery(ctx, qry, origin)
+	if err != nil {
+		return err
+	}
+	return applyBudget(policy, est, qry, origin)
+}
+
+// applyBudget decides on a query with a given estimate, capping its MaxBytesBilled when it is let through
+func applyBudget(policy *BudgetPolicy, est *QueryEstimate, qry *bigquery.Query, origin string) error {
+	cost := est.Cost(policy.PricePerTiB)
+	over := (policy.MaxBytes > 0 && est.TotalBytesProcessed > policy.MaxBytes) || (policy.MaxCost > 0 && cost > policy.MaxCost)
+	if !over {
+		if policy.MaxBytes > 0 && policy.Action == BudgetRefuse && (qry.MaxBytesBilled <= 0 || qry.MaxBytesBilled > policy.MaxBytes) {
+			qry.MaxBytesBilled = policy.MaxBytes
+		}
+		return nil
+	}
+
+	msg := fmt.Sprintf("query would process %v (~$%.2f), over the budget of %v / $%.2f",
+		bu.FormatBytes(est.TotalBytesProcessed), cost, bu.FormatBytes(policy.MaxBytes), policy.MaxCost)
+	if policy.Action == BudgetWarn {
+		if policy.Logger != nil {
+			policy.Logger.Errf("%v: %v\n", origin, msg)
+		}
+		return nil
+	}
+	return bu.TError{
+		Msg:    msg,
+		Origin: origin,
+		Code:   bu.ErrBudgetExceeded,
+		Err:    nil,
+	}
+}
+
+// readQuery runs a query under the client's budget policy and returns its results
+func readQuery(ctx context.Context, bqClient *bigquery.Client, qry *bigquery.Query, origin string) (*bigquery.RowIterator, error) {
+	if err := checkBudget(ctx, bqClient, qry, origin); err != nil {
+		return nil, err
+	}
+	return qry.Read(ctx)
+}
+
+// runQuery starts a query job under the client's budget policy
+func runQuery(ctx context.Context, bqClient *bigquery.Client, qry *bigquery.Query, origin string) (*bigquery.Job, error) {
+	if err := checkBudget(ctx, bqClient, qry, origin); err != nil {
+		return nil, err
+	}
+	return qry.Run(ctx)
+}
@@ -0,0 +1,84 @@
+package bqtools
+
+import (
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/net/context"
+
+	bu "github.com/belboo/boo-go-tools/misc"
+)
+
+func TestApplyBudget(t *testing.T) {
+	const tib = int64(1) << 40
+
+	tests := []struct {
+		name      string
+		policy    BudgetPolicy
+		bytes     int64
+		maxBilled int64
+		wantErr   bool
+		wantCap   int64
+	}{
+		{"under bytes", BudgetPolicy{MaxBytes: 100}, 50, 0, false, 100},
+		{"exactly at bytes", BudgetPolicy{MaxBytes: 100}, 100, 0, false, 100},
+		{"over bytes", BudgetPolicy{MaxBytes: 100}, 101, 0, true, 0},
+		{"lower cap kept", BudgetPolicy{MaxBytes: 100}, 50, 80, false, 80},
+		{"higher cap lowered", BudgetPolicy{MaxBytes: 100}, 50, 200, false, 100},
+		{"under cost", BudgetPolicy{MaxCost: 10, PricePerTiB: 5}, 2 * tib, 0, false, 0},
+		{"over cost", BudgetPolicy{MaxCost: 10, PricePerTiB: 5}, 3 * tib, 0, true, 0},
+		{"over and warned", BudgetPolicy{MaxBytes: 100, Action: BudgetWarn}, 101, 0, false, 0},
+		{"under and warned", BudgetPolicy{MaxBytes: 100, Action: BudgetWarn}, 50, 0, false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qry := &bigquery.Query{}
+			qry.MaxBytesBilled = tt.maxBilled
+			err := applyBudget(&tt.policy, &QueryEstimate{TotalBytesProcessed: tt.bytes}, qry, "test")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applyBudget() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if te, ok := err.(bu.TError); err != nil && (!ok || te.Code != bu.ErrBudgetExceeded) {
+				t.Errorf("applyBudget() error = %v, want an ErrBudgetExceeded TError", err)
+			}
+			if !tt.wantErr && qry.MaxBytesBilled != tt.wantCap {
+				t.Errorf("MaxBytesBilled = %v, want %v", qry.MaxBytesBilled, tt.wantCap)
+			}
+		})
+	}
+}
+
+func TestCheckBudgetWithoutLimits(t *testing.T) {
+	client := &bigquery.Client{}
+	qry := &bigquery.Query{}
+
+	// neither needs a dry run, which would fail with this client
+	if err := checkBudget(context.Background(), client, qry, "test"); err != nil {
+		t.Errorf("checkBudget() without a policy error = %v", err)
+	}
+	SetBudgetPolicy(client, &BudgetPolicy{Action: BudgetRefuse})
+	defer SetBudgetPolicy(client, nil)
+	if err := checkBudget(context.Background(), client, qry, "test"); err != nil {
+		t.Errorf("checkBudget() without limits error = %v", err)
+	}
+}
+
+func TestSetBudgetPolicy(t *testing.T) {
+	client := &bigquery.Client{}
+	policy := &BudgetPolicy{MaxBytes: 100}
+
+	SetBudgetPolicy(client, policy)
+	got := GetBudgetPolicy(client)
+	if got == nil || got == policy || got.PricePerTiB != DefaultPricePerTiB || got.MaxBytes != 100 {
+		t.Errorf("GetBudgetPolicy() = %+v, want a copy with the default price", got)
+	}
+	if GetBudgetPolicy(&bigquery.Client{}) != nil {
+		t.Errorf("GetBudgetPolicy() of another client is not nil")
+	}
+
+	SetBudgetPolicy(client, nil)
+	if got := GetBudgetPolicy(client); got != nil {
+		t.Errorf("GetBudgetPolicy() after removal = %+v, want nil", got)
+	}
+}
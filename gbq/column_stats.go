@@ -0,0 +1,487 @@
+package bqtools
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/net/context"
+	"google.golang.org/api/iterator"
+
+	bu "github.com/belboo/boo-go-tools/misc"
+)
+
+// ColumnStat is a column statistic ENUM
+type ColumnStat string
+
+// ColumnStat ENUM values
+const (
+	StatCount          ColumnStat = "count"
+	StatNulls          ColumnStat = "nulls"
+	StatDistinct       ColumnStat = "distinct"
+	StatApproxDistinct ColumnStat = "approx_distinct"
+	StatMin            ColumnStat = "min"
+	StatMax            ColumnStat = "max"
+	StatAvg            ColumnStat = "avg"
+	StatStddev         ColumnStat = "stddev"
+	StatQuantiles      ColumnStat = "quantiles"
+	StatTopN           ColumnStat = "top_n"
+	StatMinLength      ColumnStat = "min_length"
+	StatMaxLength      ColumnStat = "max_length"
+)
+
+// ValueCount is a value and its frequency as returned by StatTopN
+type ValueCount struct {
+	Value bigquery.Value `json:"value"`
+	Count int64          `json:"count"`
+}
+
+// ColumnStats holds the statistics computed for a column, statistics not requested are nil
+type ColumnStats struct {
+	Column   string             `json:"column"`
+	Type     bigquery.FieldType `json:"type"`
+	Repeated bool               `json:"repeated,omitempty"` // statistics are over array elements
+
+	Count int64 `json:"count"` // rows considered, always computed
+	Nulls int64 `json:"nulls"` // always computed
+
+	Distinct       *int64           `json:"distinct,omitempty"`
+	ApproxDistinct *int64           `json:"approx_distinct,omitempty"`
+	Min            bigquery.Value   `json:"min,omitempty"`
+	Max            bigquery.Value   `json:"max,omitempty"`
+	Avg            *float64         `json:"avg,omitempty"`
+	Stddev         *float64         `json:"stddev,omitempty"`
+	Quantiles      []bigquery.Value `json:"quantiles,omitempty"`
+	TopN           []ValueCount     `json:"top_n,omitempty"`
+	MinLength      *int64           `json:"min_length,omitempty"`
+	MaxLength      *int64           `json:"max_length,omitempty"`
+}
+
+// NullRatio returns the share of null values
+func (cs *ColumnStats) NullRatio() float64 {
+	if cs.Count == 0 {
+		return 0
+	}
+	return float64(cs.Nulls) / float64(cs.Count)
+}
+
+// Map returns the computed statistics keyed by their ColumnStat names
+func (cs *ColumnStats) Map() map[string]interface{} {
+	m := map[string]interface{}{
+		string(StatCount): cs.Count,
+		string(StatNulls): cs.Nulls,
+	}
+	if cs.Distinct != nil {
+		m[string(StatDistinct)] = *cs.Distinct
+	}
+	if cs.ApproxDistinct != nil {
+		m[string(StatApproxDistinct)] = *cs.ApproxDistinct
+	}
+	if cs.Min != nil {
+		m[string(StatMin)] = cs.Min
+	}
+	if cs.Max != nil {
+		m[string(StatMax)] = cs.Max
+	}
+	if cs.Avg != nil {
+		m[string(StatAvg)] = *cs.Avg
+	}
+	if cs.Stddev != nil {
+		m[string(StatStddev)] = *cs.Stddev
+	}
+	if cs.Quantiles != nil {
+		m[string(StatQuantiles)] = cs.Quantiles
+	}
+	if cs.TopN != nil {
+		m[string(StatTopN)] = cs.TopN
+	}
+	if cs.MinLength != nil {
+		m[string(StatMinLength)] = *cs.MinLength
+	}
+	if cs.MaxLength != nil {
+		m[string(StatMaxLength)] = *cs.MaxLength
+	}
+	return m
+}
+
+// ColumnStatsOptions tunes GetColumnStats and GetColumnsStats
+type ColumnStatsOptions struct {
+	// Stats to compute, empty computes everything applicable to the column type
+	// except the exact (and expensive) StatDistinct
+	Stats []ColumnStat
+
+	Quantiles int // number of quantile intervals, defaults to 4 (quartiles)
+	TopN      int // number of most frequent values, defaults to 10
+
+	// PartitionsFrom and PartitionsTo restrict the statistics to time partitions in [from, to)
+	PartitionsFrom time.Time
+	PartitionsTo   time.Time
+	// Filter is an optional extra SQL condition, with its named parameters in FilterParams
+	Filter       string
+	FilterParams []bigquery.QueryParameter
+
+	MaxBytesBilled int64
+}
+
+// statsFor returns the statistics applicable to a field type
+func statsFor(t bigquery.FieldType) []ColumnStat {
+	base := []ColumnStat{StatCount, StatNulls}
+	switch t {
+	case bigquery.IntegerFieldType, bigquery.FloatFieldType, bigquery.NumericFieldType, bigquery.BigNumericFieldType:
+		return append(base, StatDistinct, StatApproxDistinct, StatMin, StatMax, StatAvg, StatStddev, StatQuantiles, StatTopN)
+	case bigquery.StringFieldType:
+		return append(base, StatDistinct, StatApproxDistinct, StatMin, StatMax, StatQuantiles, StatTopN, StatMinLength, StatMaxLength)
+	case bigquery.BytesFieldType:
+		return append(base, StatDistinct, StatApproxDistinct, StatTopN, StatMinLength, StatMaxLength)
+	case bigquery.DateFieldType, bigquery.TimestampFieldType, bigquery.DateTimeFieldType, bigquery.TimeFieldType:
+		return append(base, StatDistinct, StatApproxDistinct, StatMin, StatMax, StatQuantiles, StatTopN)
+	case bigquery.BooleanFieldType:
+		return append(base, StatDistinct, StatApproxDistinct, StatMin, StatMax, StatTopN)
+	}
+	return base
+}
+
+// statColumn is a column expression to compute statistics on
+type statColumn struct {
+	name  string
+	expr  string
+	field *bigquery.FieldSchema
+	stats []ColumnStat
+}
+
+// LookupField finds a field by its dotted path (case-insensitively), repeated tells if the
+// path crosses or ends in a REPEATED field
+func LookupField(schema bigquery.Schema, path string) (field *bigquery.FieldSchema, repeated bool) {
+	parts := strings.Split(path, ".")
+	for i, part := range parts {
+		field = nil
+		for _, f := range schema {
+			if strings.EqualFold(f.Name, part) {
+				field = f
+				break
+			}
+		}
+		if field == nil {
+			return nil, false
+		}
+		repeated = repeated || field.Repeated
+		if i < len(parts)-1 {
+			schema = field.Schema
+		}
+	}
+	return field, repeated
+}
+
+// resolveStats checks the requested statistics against the column type
+func resolveStats(column string, field *bigquery.FieldSchema, requested []ColumnStat) ([]ColumnStat, error) {
+	applicable := statsFor(field.Type)
+	if len(requested) == 0 {
+		out := make([]ColumnStat, 0, len(applicable))
+		for _, s := range applicable {
+			if s != StatDistinct {
+				out = append(out, s)
+			}
+		}
+		return out, nil
+	}
+
+	allowed := make(map[ColumnStat]bool, len(applicable))
+	for _, s := range applicable {
+		allowed[s] = true
+	}
+	for _, s := range requested {
+		if !allowed[s] {
+			return nil, bu.TError{
+				Msg:    fmt.Sprintf("statistic %v is not available for %v column %v", s, field.Type, column),
+				Origin: "GetColumnStats",
+				Code:   bu.ErrConfigError,
+				Err:    nil,
+			}
+		}
+	}
+	return requested, nil
+}
+
+// statsSelectSQL returns the aggregate select list for a set of columns, aliases are c<i>_<stat>
+func statsSelectSQL(cols []statColumn, opts ColumnStatsOptions) string {
+	quantiles := opts.Quantiles
+	if quantiles <= 0 {
+		quantiles = 4
+	}
+	topN := opts.TopN
+	if topN <= 0 {
+		topN = 10
+	}
+
+	exprs := []string{"COUNT(*) AS n"}
+	for i, c := range cols {
+		for _, s := range c.stats {
+			alias := fmt.Sprintf("c%v_%v", i, s)
+			var e string
+			switch s {
+			case StatCount:
+				continue
+			case StatNulls:
+				e = fmt.Sprintf("COUNTIF(%v IS NULL)", c.expr)
+			case StatDistinct:
+				e = fmt.Sprintf("COUNT(DISTINCT %v)", c.expr)
+			case StatApproxDistinct:
+				e = fmt.Sprintf("APPROX_COUNT_DISTINCT(%v)", c.expr)
+			case StatMin:
+				e = fmt.Sprintf("MIN(%v)", c.expr)
+			case StatMax:
+				e = fmt.Sprintf("MAX(%v)", c.expr)
+			case StatAvg:
+				e = fmt.Sprintf("AVG(CAST(%v AS FLOAT64))", c.expr)
+			case StatStddev:
+				e = fmt.Sprintf("STDDEV(CAST(%v AS FLOAT64))", c.expr)
+			case StatQuantiles:
+				e = fmt.Sprintf("APPROX_QUANTILES(%v, %v)", c.expr, quantiles)
+			case StatTopN:
+				e = fmt.Sprintf("APPROX_TOP_COUNT(%v, %v)", c.expr, topN)
+			case StatMinLength:
+				e = fmt.Sprintf("MIN(LENGTH(%v))", c.expr)
+			case StatMaxLength:
+				e = fmt.Sprintf("MAX(LENGTH(%v))", c.expr)
+			}
+			exprs = append(exprs, e+" AS "+alias)
+		}
+	}
+	return strings.Join(exprs, ",\n  ")
+}
+
+// statsWhereSQL builds the WHERE clause (possibly empty) from the partition range and filter
+func statsWhereSQL(tMeta *bigquery.TableMetadata, opts ColumnStatsOptions) (string, []bigquery.QueryParameter, error) {
+	conds := make([]string, 0)
+	params := append([]bigquery.QueryParameter{}, opts.FilterParams...)
+
+	if !opts.PartitionsFrom.IsZero() || !opts.PartitionsTo.IsZero() {
+		cond, err := partitionRangeSQL(tMeta, "t", "pfrom", "pto", opts.PartitionsFrom, opts.PartitionsTo)
+		if err != nil {
+			return "", nil, err
+		}
+		conds = append(conds, cond)
+		if !opts.PartitionsFrom.IsZero() {
+			params = append(params, bigquery.QueryParameter{Name: "pfrom", Value: opts.PartitionsFrom.UTC()})
+		}
+		if !opts.PartitionsTo.IsZero() {
+			params = append(params, bigquery.QueryParameter{Name: "pto", Value: opts.PartitionsTo.UTC()})
+		}
+	}
+
+	if opts.Filter != "" {
+		conds = append(conds, "("+opts.Filter+")")
+	}
+
+	if len(conds) == 0 {
+		return "", params, nil
+	}
+	return "WHERE " + strings.Join(conds, " AND "), params, nil
+}
+
+// partitionRangeSQL is a condition restricting a time partitioned table (aliased as alias) to [@from, @to)
+// written so that BigQuery can prune partitions, zero bounds are left open
+func partitionRangeSQL(tMeta *bigquery.TableMetadata, alias string, fromParam string, toParam string, from time.Time, to time.Time) (string, error) {
+	pt, field := TablePartitioning(tMeta)
+	if pt == PartitionNone || pt == PartitionIntegerRange {
+		return "", bu.TError{
+			Msg:    fmt.Sprintf("table %v is not time partitioned", tMeta.Name),
+			Origin: "partitionRangeSQL",
+			Code:   bu.ErrTableNotPartitioned,
+			Err:    nil,
+		}
+	}
+
+	col, conv := alias+"._PARTITIONTIME", "%v"
+	if field != "" {
+		col = alias + ".`" + field + "`"
+		if f, _ := LookupField(tMeta.Schema, field); f != nil {
+			switch f.Type {
+			case bigquery.DateFieldType:
+				conv = "DATE(%v)"
+			case bigquery.DateTimeFieldType:
+				conv = "DATETIME(%v)"
+			}
+		}
+	}
+
+	conds := make([]string, 0, 2)
+	if !from.IsZero() {
+		conds = append(conds, fmt.Sprintf("%v >= "+conv, col, "@"+fromParam))
+	}
+	if !to.IsZero() {
+		conds = append(conds, fmt.Sprintf("%v < "+conv, col, "@"+toParam))
+	}
+	return strings.Join(conds, " AND "), nil
+}
+
+// readStatsRow runs an aggregate query and returns its single row
+func readStatsRow(ctx context.Context, bqClient *bigquery.Client, sql string, params []bigquery.QueryParameter, maxBytesBilled int64, origin string) (map[string]bigquery.Value, error) {
+	qry := bqClient.Query(sql)
+	qry.Parameters = params
+	qry.MaxBytesBilled = maxBytesBilled
+
+	it, err := readQuery(ctx, bqClient, qry, origin)
+	if _, ok := err.(bu.TError); ok {
+		return nil, err
+	}
+	if err != nil {
+		return nil, bu.TError{
+			Msg:    "statistics query failed",
+			Origin: origin,
+			Code:   bu.ErrDataQuery,
+			Err:    err,
+		}
+	}
+
+	var row map[string]bigquery.Value
+	err = it.Next(&row)
+	if err == iterator.Done {
+		return map[string]bigquery.Value{}, nil
+	}
+	if err != nil {
+		return nil, bu.TError{
+			Msg:    "statistics query result is weird",
+			Origin: origin,
+			Code:   bu.ErrDataQuery,
+			Err:    err,
+		}
+	}
+	return row, nil
+}
+
+// parseStatsRow fills ColumnStats for every column from an aggregate result row
+func parseStatsRow(row map[string]bigquery.Value, cols []statColumn) map[string]*ColumnStats {
+	n, _ := row["n"].(int64)
+
+	out := make(map[string]*ColumnStats, len(cols))
+	for i, c := range cols {
+		cs := &ColumnStats{Column: c.name, Type: c.field.Type, Count: n}
+		get := func(s ColumnStat) bigquery.Value {
+			return row[fmt.Sprintf("c%v_%v", i, s)]
+		}
+
+		for _, s := range c.stats {
+			v := get(s)
+			switch s {
+			case StatNulls:
+				cs.Nulls, _ = v.(int64)
+			case StatDistinct:
+				cs.Distinct = int64Ptr(v)
+			case StatApproxDistinct:
+				cs.ApproxDistinct = int64Ptr(v)
+			case StatMin:
+				cs.Min = v
+			case StatMax:
+				cs.Max = v
+			case StatAvg:
+				cs.Avg = float64Ptr(v)
+			case StatStddev:
+				cs.Stddev = float64Ptr(v)
+			case StatQuantiles:
+				cs.Quantiles, _ = v.([]bigquery.Value)
+			case StatTopN:
+				tops, _ := v.([]bigquery.Value)
+				cs.TopN = make([]ValueCount, 0, len(tops))
+				for _, t := range tops {
+					// STRUCT<value, count>, a map when read into a map, a slice otherwise
+					switch top := t.(type) {
+					case map[string]bigquery.Value:
+						cnt, _ := top["count"].(int64)
+						cs.TopN = append(cs.TopN, ValueCount{Value: top["value"], Count: cnt})
+					case []bigquery.Value:
+						if len(top) == 2 {
+							cnt, _ := top[1].(int64)
+							cs.TopN = append(cs.TopN, ValueCount{Value: top[0], Count: cnt})
+						}
+					}
+				}
+			case StatMinLength:
+				cs.MinLength = int64Ptr(v)
+			case StatMaxLength:
+				cs.MaxLength = int64Ptr(v)
+			}
+		}
+		out[c.name] = cs
+	}
+	return out
+}
+
+func int64Ptr(v bigquery.Value) *int64 {
+	if i, ok := v.(int64); ok {
+		return &i
+	}
+	return nil
+}
+
+func float64Ptr(v bigquery.Value) *float64 {
+	if f, ok := v.(float64); ok {
+		return &f
+	}
+	return nil
+}
+
+// GetColumnsStats computes statistics on several (possibly nested, non-repeated) columns of a table in one query
+func GetColumnsStats(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string, columns []string, opts ColumnStatsOptions) (map[string]*ColumnStats, error) {
+	tMeta, err := getTableMeta(ctx, bqClient, bqDataset, bqTable, "GetColumnsStats")
+	if err != nil {
+		return nil, err
+	}
+
+	cols := make([]statColumn, 0, len(columns))
+	for _, column := range columns {
+		field, repeated := LookupField(tMeta.Schema, column)
+		if field == nil {
+			return nil, bu.TError{
+				Msg:    fmt.Sprintf("column %v not in %v.%v", column, bqDataset, bqTable),
+				Origin: "GetColumnsStats",
+				Code:   bu.ErrGeneric,
+				Err:    nil,
+			}
+		}
+		if repeated {
+			return nil, bu.TError{
+				Msg:    fmt.Sprintf("column %v of %v.%v is repeated, use ProfileTable for repeated fields", column, bqDataset, bqTable),
+				Origin: "GetColumnsStats",
+				Code:   bu.ErrConfigError,
+				Err:    nil,
+			}
+		}
+		stats, err := resolveStats(column, field, opts.Stats)
+		if err != nil {
+			return nil, err
+		}
+
+		parts := strings.Split(column, ".")
+		cols = append(cols, statColumn{
+			name:  column,
+			expr:  "t.`" + strings.Join(parts, "`.`") + "`",
+			field: field,
+			stats: stats,
+		})
+	}
+
+	where, params, err := statsWhereSQL(tMeta, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	sql := fmt.Sprintf("SELECT\n  %v\nFROM `%v`.`%v` AS t\n%v", statsSelectSQL(cols, opts), bqDataset, bqTable, where)
+
+	row, err := readStatsRow(ctx, bqClient, sql, params, opts.MaxBytesBilled, "GetColumnsStats")
+	if err != nil {
+		return nil, err
+	}
+
+	return parseStatsRow(row, cols), nil
+}
+
+// GetColumnStats computes statistics on a single column of a table
+func GetColumnStats(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string, bqColumn string, opts ColumnStatsOptions) (*ColumnStats, error) {
+	stats, err := GetColumnsStats(ctx, bqClient, bqDataset, bqTable, []string{bqColumn}, opts)
+	if err != nil {
+		return nil, err
+	}
+	return stats[bqColumn], nil
+}
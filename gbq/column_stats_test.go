@@ -0,0 +1,186 @@
+package bqtools
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestLookupField(t *testing.T) {
+	items := field("items", bigquery.RecordFieldType)
+	items.Repeated = true
+	items.Schema = bigquery.Schema{field("sku", bigquery.StringFieldType)}
+	payload := field("payload", bigquery.RecordFieldType)
+	payload.Schema = bigquery.Schema{field("id", bigquery.IntegerFieldType), items}
+	schema := bigquery.Schema{field("day", bigquery.DateFieldType), payload}
+
+	tests := []struct {
+		path         string
+		want         string
+		wantRepeated bool
+	}{
+		{"day", "day", false},
+		{"PAYLOAD.Id", "id", false},
+		{"payload.items", "items", true},
+		{"payload.items.sku", "sku", true},
+		{"payload.missing", "", false},
+		{"day.sub", "", false},
+	}
+
+	for _, tt := range tests {
+		f, repeated := LookupField(schema, tt.path)
+		got := ""
+		if f != nil {
+			got = f.Name
+		}
+		if got != tt.want || repeated != tt.wantRepeated {
+			t.Errorf("LookupField(%v) = %q, %v, want %q, %v", tt.path, got, repeated, tt.want, tt.wantRepeated)
+		}
+	}
+}
+
+func TestResolveStats(t *testing.T) {
+	tests := []struct {
+		typ       bigquery.FieldType
+		requested []ColumnStat
+		want      []ColumnStat
+		wantErr   bool
+	}{
+		{bigquery.BooleanFieldType, nil, []ColumnStat{StatCount, StatNulls, StatApproxDistinct, StatMin, StatMax, StatTopN}, false},
+		{bigquery.GeographyFieldType, nil, []ColumnStat{StatCount, StatNulls}, false},
+		{bigquery.IntegerFieldType, []ColumnStat{StatDistinct, StatAvg}, []ColumnStat{StatDistinct, StatAvg}, false},
+		{bigquery.StringFieldType, []ColumnStat{StatAvg}, nil, true},
+		{bigquery.BytesFieldType, []ColumnStat{StatMin}, nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := resolveStats("c", field("c", tt.typ), tt.requested)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("resolveStats(%v, %v) error = %v, wantErr %v", tt.typ, tt.requested, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("resolveStats(%v, %v) = %v, want %v", tt.typ, tt.requested, got, tt.want)
+		}
+	}
+}
+
+func TestStatsSelectSQL(t *testing.T) {
+	cols := []statColumn{
+		{name: "amount", expr: "t.`amount`", stats: []ColumnStat{StatCount, StatNulls, StatAvg, StatQuantiles}},
+		{name: "name", expr: "t.`name`", stats: []ColumnStat{StatDistinct, StatTopN, StatMaxLength}},
+	}
+
+	tests := []struct {
+		name string
+		opts ColumnStatsOptions
+		want string
+	}{
+		{"defaults", ColumnStatsOptions{},
+			"COUNT(*) AS n,\n" +
+				"  COUNTIF(t.`amount` IS NULL) AS c0_nulls,\n" +
+				"  AVG(CAST(t.`amount` AS FLOAT64)) AS c0_avg,\n" +
+				"  APPROX_QUANTILES(t.`amount`, 4) AS c0_quantiles,\n" +
+				"  COUNT(DISTINCT t.`name`) AS c1_distinct,\n" +
+				"  APPROX_TOP_COUNT(t.`name`, 10) AS c1_top_n,\n" +
+				"  MAX(LENGTH(t.`name`)) AS c1_max_length"},
+		{"sizes", ColumnStatsOptions{Quantiles: 100, TopN: 3},
+			"COUNT(*) AS n,\n" +
+				"  COUNTIF(t.`amount` IS NULL) AS c0_nulls,\n" +
+				"  AVG(CAST(t.`amount` AS FLOAT64)) AS c0_avg,\n" +
+				"  APPROX_QUANTILES(t.`amount`, 100) AS c0_quantiles,\n" +
+				"  COUNT(DISTINCT t.`name`) AS c1_distinct,\n" +
+				"  APPROX_TOP_COUNT(t.`name`, 3) AS c1_top_n,\n" +
+				"  MAX(LENGTH(t.`name`)) AS c1_max_length"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := statsSelectSQL(cols, tt.opts); got != tt.want {
+				t.Errorf("statsSelectSQL() =\n%v\nwant\n%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseStatsRow(t *testing.T) {
+	cols := []statColumn{
+		{name: "amount", field: field("amount", bigquery.FloatFieldType),
+			stats: []ColumnStat{StatCount, StatNulls, StatMin, StatAvg, StatStddev, StatQuantiles}},
+		{name: "name", field: field("name", bigquery.StringFieldType),
+			stats: []ColumnStat{StatApproxDistinct, StatTopN, StatMinLength}},
+	}
+	row := map[string]bigquery.Value{
+		"n":                  int64(10),
+		"c0_nulls":           int64(2),
+		"c0_min":             1.5,
+		"c0_avg":             3.0,
+		"c0_stddev":          nil, // a single value has none
+		"c0_quantiles":       []bigquery.Value{1.5, 2.0, 5.0},
+		"c1_approx_distinct": int64(4),
+		"c1_top_n": []bigquery.Value{
+			map[string]bigquery.Value{"value": "a", "count": int64(5)},
+			[]bigquery.Value{"b", int64(3)},
+		},
+		"c1_min_length": int64(1),
+	}
+
+	got := parseStatsRow(row, cols)
+
+	avg, distinct, minLength := 3.0, int64(4), int64(1)
+	want := map[string]*ColumnStats{
+		"amount": {Column: "amount", Type: bigquery.FloatFieldType, Count: 10, Nulls: 2, Min: 1.5, Avg: &avg,
+			Quantiles: []bigquery.Value{1.5, 2.0, 5.0}},
+		"name": {Column: "name", Type: bigquery.StringFieldType, Count: 10, ApproxDistinct: &distinct,
+			TopN: []ValueCount{{"a", 5}, {"b", 3}}, MinLength: &minLength},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseStatsRow() = %+v, %+v, want %+v, %+v", got["amount"], got["name"], want["amount"], want["name"])
+	}
+	if r := got["amount"].NullRatio(); r != 0.2 {
+		t.Errorf("NullRatio() = %v, want 0.2", r)
+	}
+	if m := got["name"].Map(); len(m) != 5 || m["approx_distinct"] != int64(4) {
+		t.Errorf("Map() = %v", m)
+	}
+}
+
+func TestStatsWhereSQL(t *testing.T) {
+	daily := &bigquery.TableMetadata{Name: "t", TimePartitioning: &bigquery.TimePartitioning{Field: "day"},
+		Schema: bigquery.Schema{field("day", bigquery.DateFieldType)}}
+	ingestion := &bigquery.TableMetadata{Name: "t", TimePartitioning: &bigquery.TimePartitioning{}}
+	from := time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		tMeta      *bigquery.TableMetadata
+		opts       ColumnStatsOptions
+		want       string
+		wantParams int
+		wantErr    bool
+	}{
+		{"nothing", daily, ColumnStatsOptions{}, "", 0, false},
+		{"date column", daily, ColumnStatsOptions{PartitionsFrom: from, PartitionsTo: to},
+			"WHERE t.`day` >= DATE(@pfrom) AND t.`day` < DATE(@pto)", 2, false},
+		{"ingestion time, open end", ingestion, ColumnStatsOptions{PartitionsFrom: from},
+			"WHERE t._PARTITIONTIME >= @pfrom", 1, false},
+		{"filter", daily, ColumnStatsOptions{PartitionsTo: to, Filter: "x = @x", FilterParams: []bigquery.QueryParameter{{Name: "x", Value: 1}}},
+			"WHERE t.`day` < DATE(@pto) AND (x = @x)", 2, false},
+		{"unpartitioned", &bigquery.TableMetadata{Name: "t"}, ColumnStatsOptions{PartitionsFrom: from}, "", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, params, err := statsWhereSQL(tt.tMeta, tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("statsWhereSQL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want || len(params) != tt.wantParams {
+				t.Errorf("statsWhereSQL() = %q with %v params, want %q with %v", got, len(params), tt.want, tt.wantParams)
+			}
+		})
+	}
+}
@@ -0,0 +1,452 @@
+package bqtools
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/gammazero/workerpool"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+
+	bu "github.com/belboo/boo-go-tools/misc"
+)
+
+// CopyOptions tunes CopyTable and CopyDataset
+type CopyOptions struct {
+	// SrcProject and DstProject default to the client's project
+	SrcProject string
+	DstProject string
+	// DstLocation overrides the location of a created dataset (copy jobs need both in the same location)
+	DstLocation string
+
+	// Overwrite replaces the data of existing destination tables, otherwise they must be empty,
+	// and the query of existing destination views, otherwise they must have the same one
+	Overwrite bool
+	// KeepExpiration gives created tables the expiration time of their source, by default they never expire
+	KeepExpiration bool
+	// KeepEncryption gives created tables the KMS key of their source, DstKMSKeyName sets another one.
+	// By default they use the destination dataset's default encryption.
+	KeepEncryption bool
+	DstKMSKeyName  string
+	// Pattern is an optional regexp the table (or view) names have to match to be copied
+	Pattern string
+
+	Concurrency int // copy jobs in flight, defaults to 4
+	Logger      *bu.TLogger
+}
+
+// project returns p or the client's project
+func (opts CopyOptions) project(bqClient *bigquery.Client, p string) string {
+	if p == "" {
+		return bqClient.Project()
+	}
+	return p
+}
+
+// DatasetCopyReport is the result of CopyDataset
+type DatasetCopyReport struct {
+	Tables  []string // copied tables
+	Views   []string // recreated (materialized) views
+	Skipped []string // filtered out or of a type that cannot be copied
+	Errors  []error
+}
+
+// isAlreadyExists checks if a BQ API error is a duplicate one
+func isAlreadyExists(err error) bool {
+	erg, ok := err.(*googleapi.Error)
+	return ok && erg.Code == http.StatusConflict
+}
+
+// CopyTable copies srcDataset.srcTable into dstDataset.dstTable, creating a missing destination from GetTableMetaCopy
+// so that partitioning, clustering, labels and description are preserved, then filling it with a copy job.
+// An existing destination is used as is and has to be empty unless opts.Overwrite is set.
+func CopyTable(ctx context.Context, bqClient *bigquery.Client, srcDataset string, srcTable string,
+	dstDataset string, dstTable string, opts CopyOptions) error {
+
+	srcT := bqClient.DatasetInProject(opts.project(bqClient, opts.SrcProject), srcDataset).Table(srcTable)
+	srcMeta, err := srcT.Metadata(ctx)
+	if err != nil {
+		return bu.TError{
+			Msg:    fmt.Sprintf("failed to get metadata of %v.%v", srcDataset, srcTable),
+			Origin: "CopyTable",
+			Code:   bu.ErrGetTableMeta,
+			Err:    err,
+		}
+	}
+
+	return copyTable(ctx, bqClient, srcT, srcMeta, dstDataset, dstTable, opts)
+}
+
+// copyTable copies a regular table with known metadata
+func copyTable(ctx context.Context, bqClient *bigquery.Client, srcT *bigquery.Table, srcMeta *bigquery.TableMetadata,
+	dstDataset string, dstTable string, opts CopyOptions) error {
+
+	if srcMeta.Type != bigquery.RegularTable {
+		return bu.TError{
+			Msg:    fmt.Sprintf("%v.%v is a %v, only regular tables can be copied", srcT.DatasetID, srcT.TableID, srcMeta.Type),
+			Origin: "CopyTable",
+			Code:   bu.ErrConfigError,
+			Err:    nil,
+		}
+	}
+
+	dstT := bqClient.DatasetInProject(opts.project(bqClient, opts.DstProject), dstDataset).Table(dstTable)
+	dstMeta, err := dstT.Metadata(ctx)
+	switch {
+	case err == nil:
+		if !opts.Overwrite && (dstMeta.NumRows > 0 || dstMeta.StreamingBuffer != nil) {
+			return bu.TError{
+				Msg:    fmt.Sprintf("%v.%v already exists and is not empty", dstDataset, dstTable),
+				Origin: "CopyTable",
+				Code:   bu.ErrConfigError,
+				Err:    nil,
+			}
+		}
+	case isNotFound(err):
+		dstMeta = GetTableMetaCopy(srcMeta)
+		if !opts.KeepExpiration {
+			dstMeta.ExpirationTime = time.Time{}
+		}
+		if !opts.KeepEncryption {
+			dstMeta.EncryptionConfig = nil
+		}
+		if opts.DstKMSKeyName != "" {
+			dstMeta.EncryptionConfig = &bigquery.EncryptionConfig{KMSKeyName: opts.DstKMSKeyName}
+		}
+		if err := dstT.Create(ctx, dstMeta); err != nil {
+			return bu.TError{
+				Msg:    fmt.Sprintf("failed to create %v.%v", dstDataset, dstTable),
+				Origin: "CopyTable",
+				Code:   bu.ErrCreateTable,
+				Err:    err,
+			}
+		}
+	default:
+		return bu.TError{
+			Msg:    fmt.Sprintf("failed to get metadata of %v.%v", dstDataset, dstTable),
+			Origin: "CopyTable",
+			Code:   bu.ErrGetTableMeta,
+			Err:    err,
+		}
+	}
+
+	copier := dstT.CopierFrom(srcT)
+	copier.CreateDisposition = bigquery.CreateNever
+	copier.DestinationEncryptionConfig = dstMeta.EncryptionConfig
+	copier.WriteDisposition = bigquery.WriteEmpty
+	if opts.Overwrite {
+		copier.WriteDisposition = bigquery.WriteTruncate
+	}
+
+	job, err := copier.Run(ctx)
+	if err == nil {
+		var status *bigquery.JobStatus
+		if status, err = job.Wait(ctx); err == nil {
+			err = status.Err()
+		}
+	}
+	if err != nil {
+		return bu.TError{
+			Msg:    fmt.Sprintf("failed to copy %v.%v to %v.%v", srcT.DatasetID, srcT.TableID, dstDataset, dstTable),
+			Origin: "CopyTable",
+			Code:   bu.ErrAPI,
+			Err:    err,
+		}
+	}
+
+	return nil
+}
+
+// RewriteDatasetRefs rewrites references to tables of srcProject.srcDataset in a (standard or legacy SQL)
+// query into references to dstProject.dstDataset. References without a project keep having none.
+func RewriteDatasetRefs(query string, srcProject string, srcDataset string, dstProject string, dstDataset string) string {
+	re := regexp.MustCompile("(^|[^\\w.`\\-])(`?)(?:(" + regexp.QuoteMeta(srcProject) + ")(`?)([.:])(`?))?" +
+		regexp.QuoteMeta(srcDataset) + "(`?)\\.")
+
+	return re.ReplaceAllStringFunc(query, func(m string) string {
+		g := re.FindStringSubmatch(m)
+		out := g[1] + g[2]
+		if g[3] != "" {
+			out += dstProject + g[4] + g[5] + g[6]
+		}
+		return out + dstDataset + g[7] + "."
+	})
+}
+
+// copyView recreates a view or materialized view with its query pointing at the destination dataset.
+// An existing destination view with the same query is left as is, one with another query is updated
+// if overwrite is set.
+func copyView(ctx context.Context, bqClient *bigquery.Client, srcProject string, srcDataset string, srcMeta *bigquery.TableMetadata,
+	dstProject string, dstDataset string, viewName string, overwrite bool) error {
+
+	dstMeta := &bigquery.TableMetadata{
+		Name:        srcMeta.Name,
+		Description: srcMeta.Description,
+		Labels:      srcMeta.Labels,
+	}
+	if srcMeta.Type == bigquery.MaterializedView {
+		mv := srcMeta.MaterializedView
+		dstMeta.MaterializedView = &bigquery.MaterializedViewDefinition{
+			Query:                         RewriteDatasetRefs(mv.Query, srcProject, srcDataset, dstProject, dstDataset),
+			EnableRefresh:                 mv.EnableRefresh,
+			RefreshInterval:               mv.RefreshInterval,
+			AllowNonIncrementalDefinition: mv.AllowNonIncrementalDefinition,
+			MaxStaleness:                  mv.MaxStaleness,
+		}
+		dstMeta.TimePartitioning = srcMeta.TimePartitioning
+		dstMeta.Clustering = srcMeta.Clustering
+	} else {
+		dstMeta.ViewQuery = RewriteDatasetRefs(srcMeta.ViewQuery, srcProject, srcDataset, dstProject, dstDataset)
+		dstMeta.UseLegacySQL = srcMeta.UseLegacySQL
+	}
+
+	dstT := bqClient.DatasetInProject(dstProject, dstDataset).Table(viewName)
+	err := dstT.Create(ctx, dstMeta)
+	if isAlreadyExists(err) {
+		return updateView(ctx, dstT, dstMeta, overwrite)
+	}
+	if err != nil {
+		return bu.TError{
+			Msg:    fmt.Sprintf("failed to create view %v.%v", dstDataset, viewName),
+			Origin: "CopyDataset",
+			Code:   bu.ErrCreateTable,
+			Err:    err,
+		}
+	}
+	return nil
+}
+
+// updateView brings an existing view in line with the wanted definition
+func updateView(ctx context.Context, t *bigquery.Table, want *bigquery.TableMetadata, overwrite bool) error {
+	live, err := t.Metadata(ctx)
+	if err != nil {
+		return bu.TError{
+			Msg:    fmt.Sprintf("failed to get metadata of %v.%v", t.DatasetID, t.TableID),
+			Origin: "CopyDataset",
+			Code:   bu.ErrGetTableMeta,
+			Err:    err,
+		}
+	}
+
+	switch {
+	case live.Type != viewType(want):
+		return bu.TError{
+			Msg:    fmt.Sprintf("%v.%v already exists as a %v", t.DatasetID, t.TableID, live.Type),
+			Origin: "CopyDataset",
+			Code:   bu.ErrConfigError,
+			Err:    nil,
+		}
+	case sameViewQuery(live, want):
+		return nil
+	case !overwrite:
+		return bu.TError{
+			Msg:    fmt.Sprintf("view %v.%v already exists with a different query", t.DatasetID, t.TableID),
+			Origin: "CopyDataset",
+			Code:   bu.ErrConfigError,
+			Err:    nil,
+		}
+	}
+
+	upd := bigquery.TableMetadataToUpdate{Description: want.Description}
+	if want.MaterializedView != nil {
+		upd.MaterializedView = want.MaterializedView
+	} else {
+		upd.ViewQuery = want.ViewQuery
+		upd.UseLegacySQL = want.UseLegacySQL
+	}
+	if _, err := t.Update(ctx, upd, live.ETag); err != nil {
+		return bu.TError{
+			Msg:    fmt.Sprintf("failed to update view %v.%v", t.DatasetID, t.TableID),
+			Origin: "CopyDataset",
+			Code:   bu.ErrUpdateTable,
+			Err:    err,
+		}
+	}
+	return nil
+}
+
+// viewType returns the table type a view definition creates
+func viewType(meta *bigquery.TableMetadata) bigquery.TableType {
+	if meta.MaterializedView != nil {
+		return bigquery.MaterializedView
+	}
+	return bigquery.ViewTable
+}
+
+// sameViewQuery tells if two views of the same type select the same thing
+func sameViewQuery(a *bigquery.TableMetadata, b *bigquery.TableMetadata) bool {
+	if a.MaterializedView != nil || b.MaterializedView != nil {
+		return a.MaterializedView != nil && b.MaterializedView != nil &&
+			strings.TrimSpace(a.MaterializedView.Query) == strings.TrimSpace(b.MaterializedView.Query)
+	}
+	return a.UseLegacySQL == b.UseLegacySQL && strings.TrimSpace(a.ViewQuery) == strings.TrimSpace(b.ViewQuery)
+}
+
+// CopyDataset copies srcDataset into dstDataset (created from GetDatasetMetaCopy if missing): tables with
+// copy jobs and views recreated with references to srcDataset rewritten to dstDataset. Views depending on
+// other views are retried until no more can be created. Individual failures end up in the report's Errors.
+func CopyDataset(ctx context.Context, bqClient *bigquery.Client, srcDataset string, dstDataset string, opts CopyOptions) (*DatasetCopyReport, error) {
+	srcProject := opts.project(bqClient, opts.SrcProject)
+	dstProject := opts.project(bqClient, opts.DstProject)
+	if srcProject == dstProject && srcDataset == dstDataset {
+		return nil, bu.TError{
+			Msg:    fmt.Sprintf("cannot copy %v.%v onto itself", srcProject, srcDataset),
+			Origin: "CopyDataset",
+			Code:   bu.ErrSameDstSrc,
+			Err:    nil,
+		}
+	}
+
+	var pattern *regexp.Regexp
+	if opts.Pattern != "" {
+		var err error
+		if pattern, err = regexp.Compile(opts.Pattern); err != nil {
+			return nil, bu.TError{
+				Msg:    fmt.Sprintf("invalid table pattern %q", opts.Pattern),
+				Origin: "CopyDataset",
+				Code:   bu.ErrConfigError,
+				Err:    err,
+			}
+		}
+	}
+
+	srcDS := bqClient.DatasetInProject(srcProject, srcDataset)
+	srcDSMeta, err := srcDS.Metadata(ctx)
+	if err != nil {
+		return nil, bu.TError{
+			Msg:    fmt.Sprintf("failed to get metadata of dataset %v.%v", srcProject, srcDataset),
+			Origin: "CopyDataset",
+			Code:   bu.ErrGetDatasetMeta,
+			Err:    err,
+		}
+	}
+
+	dstDSMeta := GetDatasetMetaCopy(srcDSMeta)
+	if opts.DstLocation != "" {
+		dstDSMeta.Location = opts.DstLocation
+	}
+	if err := bqClient.DatasetInProject(dstProject, dstDataset).Create(ctx, dstDSMeta); err != nil && !isAlreadyExists(err) {
+		return nil, bu.TError{
+			Msg:    fmt.Sprintf("failed to create dataset %v.%v", dstProject, dstDataset),
+			Origin: "CopyDataset",
+			Code:   bu.ErrCreateDataset,
+			Err:    err,
+		}
+	}
+
+	report := &DatasetCopyReport{
+		Tables:  make([]string, 0),
+		Views:   make([]string, 0),
+		Skipped: make([]string, 0),
+		Errors:  make([]error, 0),
+	}
+	views := make(map[string]*bigquery.TableMetadata)
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+	var mu sync.Mutex
+	wp := workerpool.New(concurrency)
+
+	it := srcDS.Tables(ctx)
+	for {
+		t, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			wp.StopWait()
+			return report, bu.TError{
+				Msg:    fmt.Sprintf("failed to list tables of %v.%v", srcProject, srcDataset),
+				Origin: "CopyDataset",
+				Code:   bu.ErrAPI,
+				Err:    err,
+			}
+		}
+		if pattern != nil && !pattern.MatchString(t.TableID) {
+			mu.Lock()
+			report.Skipped = append(report.Skipped, t.TableID)
+			mu.Unlock()
+			continue
+		}
+
+		tMeta, err := t.Metadata(ctx)
+		if err != nil {
+			mu.Lock()
+			report.Errors = append(report.Errors, bu.TError{
+				Msg:    fmt.Sprintf("failed to get metadata of %v.%v", srcDataset, t.TableID),
+				Origin: "CopyDataset",
+				Code:   bu.ErrGetTableMeta,
+				Err:    err,
+			})
+			mu.Unlock()
+			continue
+		}
+
+		switch tMeta.Type {
+		case bigquery.RegularTable:
+			t := t
+			wp.Submit(func() {
+				err := copyTable(ctx, bqClient, t, tMeta, dstDataset, t.TableID, opts)
+
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					report.Errors = append(report.Errors, err)
+					return
+				}
+				report.Tables = append(report.Tables, t.TableID)
+				if opts.Logger != nil {
+					opts.Logger.Logf("CopyDataset: copied %v\n", t.TableID)
+				}
+			})
+		case bigquery.ViewTable, bigquery.MaterializedView:
+			views[t.TableID] = tMeta
+		default:
+			mu.Lock()
+			report.Skipped = append(report.Skipped, t.TableID)
+			mu.Unlock()
+		}
+	}
+	wp.StopWait()
+
+	// Views can only be created once what they select from exists, keep going while some get created
+	for len(views) > 0 {
+		failed := make(map[string]error)
+		for name, vMeta := range views {
+			if err := copyView(ctx, bqClient, srcProject, srcDataset, vMeta, dstProject, dstDataset, name, opts.Overwrite); err != nil {
+				failed[name] = err
+				continue
+			}
+			mu.Lock()
+			report.Views = append(report.Views, name)
+			mu.Unlock()
+		}
+		if len(failed) == len(views) {
+			mu.Lock()
+			for _, err := range failed {
+				report.Errors = append(report.Errors, err)
+			}
+			mu.Unlock()
+			break
+		}
+		for name := range views {
+			if _, ok := failed[name]; !ok {
+				delete(views, name)
+			}
+		}
+	}
+
+	sort.Strings(report.Tables)
+	sort.Strings(report.Views)
+
+	return report, nil
+}
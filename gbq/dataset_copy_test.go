@@ -0,0 +1,69 @@
+package bqtools
+
+import (
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestRewriteDatasetRefs(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"bare", "SELECT * FROM src.t", "SELECT * FROM dst.t"},
+		{"quoted table", "SELECT * FROM `src.t`", "SELECT * FROM `dst.t`"},
+		{"quoted parts", "SELECT * FROM `src`.`t`", "SELECT * FROM `dst`.`t`"},
+		{"with project", "SELECT * FROM `p1.src.t`", "SELECT * FROM `p2.dst.t`"},
+		{"quoted project", "SELECT * FROM `p1`.`src`.`t`", "SELECT * FROM `p2`.`dst`.`t`"},
+		{"legacy", "SELECT * FROM [p1:src.t]", "SELECT * FROM [p2:dst.t]"},
+		{"several", "SELECT * FROM src.a JOIN src.b USING (id)", "SELECT * FROM dst.a JOIN dst.b USING (id)"},
+		{"line start", "src.t", "dst.t"},
+		{"other project", "SELECT * FROM `p3.src.t`", "SELECT * FROM `p3.src.t`"},
+		{"other dataset", "SELECT * FROM src2.t, my_src.t, `x-src.t`", "SELECT * FROM src2.t, my_src.t, `x-src.t`"},
+		{"column", "SELECT t.src FROM src.t AS t", "SELECT t.src FROM dst.t AS t"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RewriteDatasetRefs(tt.query, "p1", "src", "p2", "dst"); got != tt.want {
+				t.Errorf("RewriteDatasetRefs(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSameViewQuery(t *testing.T) {
+	view := func(q string, legacy bool) *bigquery.TableMetadata {
+		return &bigquery.TableMetadata{ViewQuery: q, UseLegacySQL: legacy}
+	}
+	mview := func(q string) *bigquery.TableMetadata {
+		return &bigquery.TableMetadata{MaterializedView: &bigquery.MaterializedViewDefinition{Query: q}}
+	}
+
+	tests := []struct {
+		name string
+		a, b *bigquery.TableMetadata
+		want bool
+	}{
+		{"same", view("SELECT 1", false), view("SELECT 1\n", false), true},
+		{"other query", view("SELECT 1", false), view("SELECT 2", false), false},
+		{"other dialect", view("SELECT 1", false), view("SELECT 1", true), false},
+		{"same materialized", mview("SELECT 1"), mview(" SELECT 1"), true},
+		{"other materialized", mview("SELECT 1"), mview("SELECT 2"), false},
+		{"view and materialized", view("SELECT 1", false), mview("SELECT 1"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sameViewQuery(tt.a, tt.b); got != tt.want {
+				t.Errorf("sameViewQuery() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if viewType(view("SELECT 1", false)) != bigquery.ViewTable || viewType(mview("SELECT 1")) != bigquery.MaterializedView {
+		t.Errorf("viewType() does not tell views and materialized views apart")
+	}
+}
@@ -0,0 +1,206 @@
+package bqtools
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/net/context"
+
+	bu "github.com/belboo/boo-go-tools/misc"
+)
+
+// PartitionDedup is the outcome of deduplicating a single partition (or an unpartitioned table)
+type PartitionDedup struct {
+	Partition Partition // zero for unpartitioned tables
+	Rows      int64     // rows before
+	Removed   int64
+	JobID     string // of the rewrite, empty if there was nothing to remove
+}
+
+// DedupReport is the result of Dedup
+type DedupReport struct {
+	Partitions []PartitionDedup
+	Removed    int64
+}
+
+// Dedup keeps a single row per keys combination in bqDataset.bqTable, the first one by orderBy (an SQL
+// ORDER BY list, e.g. "updated_at DESC", empty for any). Partitioned tables are rewritten partition by
+// partition, partitions is a slice of anything PartitionFor accepts or nil for all of them. Partitions
+// without duplicates are left alone. Duplicates are only found within a partition. Unpartitioned tables
+// are deduplicated with a MERGE, so their column descriptions and policy tags stay and concurrent loads
+// are not lost; rows loaded into a partition while it is rewritten are. Tables with a streaming buffer
+// are refused.
+func Dedup(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string, keys []string, orderBy string, partitions interface{}) (*DedupReport, error) {
+	tMeta, err := getTableMeta(ctx, bqClient, bqDataset, bqTable, "Dedup")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return nil, bu.TError{
+			Msg:    "no key columns to deduplicate by",
+			Origin: "Dedup",
+			Code:   bu.ErrConfigError,
+			Err:    nil,
+		}
+	}
+	quoted := make([]string, len(keys))
+	for i, k := range keys {
+		if f, repeated := LookupField(tMeta.Schema, k); f == nil || repeated || f.Type == bigquery.RecordFieldType {
+			return nil, bu.TError{
+				Msg:    fmt.Sprintf("%v is not a scalar column of %v.%v", k, bqDataset, bqTable),
+				Origin: "Dedup",
+				Code:   bu.ErrConfigError,
+				Err:    nil,
+			}
+		}
+		quoted[i] = "t." + quoteColumn(k)
+	}
+
+	// rows in the streaming buffer can neither be rewritten nor deleted
+	if tMeta.StreamingBuffer != nil {
+		return nil, bu.TError{
+			Msg:    fmt.Sprintf("%v.%v has a streaming buffer, retry once it is flushed", bqDataset, bqTable),
+			Origin: "Dedup",
+			Code:   bu.ErrConfigError,
+			Err:    nil,
+		}
+	}
+
+	if err := autoSnapshot(ctx, bqClient, bqDataset, bqTable, "Dedup"); err != nil {
+		return nil, err
+	}
+
+	report := &DedupReport{Partitions: make([]PartitionDedup, 0)}
+
+	pt, _ := TablePartitioning(tMeta)
+	if pt == PartitionNone {
+		if partitions != nil {
+			return nil, bu.TError{
+				Msg:    fmt.Sprintf("table %v.%v is not partitioned", bqDataset, bqTable),
+				Origin: "Dedup",
+				Code:   bu.ErrTableNotPartitioned,
+				Err:    nil,
+			}
+		}
+		pd, err := dedupPartition(ctx, bqClient, bqDataset, bqTable, tMeta, nil, quoted, orderBy)
+		if err != nil {
+			return report, err
+		}
+		report.Partitions = append(report.Partitions, pd)
+		report.Removed += pd.Removed
+		return report, nil
+	}
+
+	var parts []Partition
+	if partitions == nil {
+		if parts, err = GetBQTablePartitionsWithOptions(ctx, bqClient, bqDataset, bqTable,
+			PartitionListOptions{Method: PartitionsFromInformationSchema, SkipSpecial: true}); err != nil {
+			return nil, err
+		}
+	} else {
+		pv := reflect.ValueOf(partitions)
+		if pv.Kind() != reflect.Slice {
+			return nil, bu.TError{
+				Msg:    "partitions is not a slice",
+				Origin: "Dedup",
+				Code:   bu.ErrGeneric,
+				Err:    nil,
+			}
+		}
+		for i := 0; i < pv.Len(); i++ {
+			p, err := PartitionFor(tMeta, pv.Index(i).Interface())
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, p)
+		}
+	}
+
+	for _, p := range parts {
+		if p.IsSpecial() {
+			continue
+		}
+		p := p
+		pd, err := dedupPartition(ctx, bqClient, bqDataset, bqTable, tMeta, &p, quoted, orderBy)
+		if err != nil {
+			return report, err
+		}
+		report.Partitions = append(report.Partitions, pd)
+		report.Removed += pd.Removed
+	}
+
+	return report, nil
+}
+
+// dedupPartition counts the duplicates of a partition (the whole table if p is nil) and rewrites it if there are any,
+// an unpartitioned table with a MERGE replacing its rows by the deduplicated ones
+func dedupPartition(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string,
+	tMeta *bigquery.TableMetadata, p *Partition, keys []string, orderBy string) (PartitionDedup, error) {
+
+	pd := PartitionDedup{}
+	where, dst := "", bqTable
+	var params []bigquery.QueryParameter
+	if p != nil {
+		pd.Partition = *p
+		cond, pParams, err := partitionSQL(tMeta, "t", *p)
+		if err != nil {
+			return pd, err
+		}
+		where, params, dst = "WHERE "+cond, pParams, p.Decorator(bqTable)
+	}
+
+	row, err := readStatsRow(ctx, bqClient,
+		fmt.Sprintf("SELECT COUNT(*) AS n, COUNT(DISTINCT TO_JSON_STRING(STRUCT(%v))) AS u FROM `%v`.`%v` AS t %v",
+			strings.Join(keys, ", "), bqDataset, bqTable, where),
+		params, 0, "Dedup")
+	if err != nil {
+		return pd, err
+	}
+	n, _ := row["n"].(int64)
+	u, _ := row["u"].(int64)
+	pd.Rows, pd.Removed = n, n-u
+	if pd.Removed == 0 {
+		return pd, nil
+	}
+
+	qOpts := QueryOptions{Labels: map[string]string{"bqtools": "dedup"}}
+	if p != nil {
+		qOpts.DstDataset, qOpts.DstTable = bqDataset, dst
+		qOpts.WriteDisposition, qOpts.CreateDisposition = bigquery.WriteTruncate, bigquery.CreateNever
+	}
+	sql := dedupSQL(bqDataset, bqTable, keys, orderBy, where, p == nil)
+
+	qr, err := RunQuery(ctx, bqClient, sql, params, nil, qOpts)
+	if err != nil {
+		return pd, err
+	}
+	pd.JobID = qr.JobID
+
+	return pd, nil
+}
+
+// dedupSQL selects the first row per keys of the table (aliased t) rows matching where, as a MERGE
+// replacing the rows of the table if merge is set
+func dedupSQL(bqDataset string, bqTable string, keys []string, orderBy string, where string, merge bool) string {
+	order := ""
+	if orderBy != "" {
+		order = " ORDER BY " + orderBy
+	}
+	sql := fmt.Sprintf("SELECT * EXCEPT(_bqtools_rn) FROM (\n"+
+		"  SELECT t.*, ROW_NUMBER() OVER (PARTITION BY %v%v) AS _bqtools_rn FROM `%v`.`%v` AS t %v\n"+
+		") WHERE _bqtools_rn = 1",
+		strings.Join(keys, ", "), order, bqDataset, bqTable, where)
+	if !merge {
+		return sql
+	}
+
+	return fmt.Sprintf("MERGE `%v`.`%v` AS t\n"+
+		"USING (\n%v\n) AS s\n"+
+		"ON FALSE\n"+
+		"WHEN NOT MATCHED BY SOURCE THEN DELETE\n"+
+		"WHEN NOT MATCHED THEN INSERT ROW",
+		bqDataset, bqTable, sql)
+}
@@ -0,0 +1,43 @@
+package bqtools
+
+import "testing"
+
+func TestDedupSQL(t *testing.T) {
+	keys := []string{"t.`id`", "t.`a`.`b`"}
+
+	tests := []struct {
+		name    string
+		orderBy string
+		where   string
+		merge   bool
+		want    string
+	}{
+		{"partition", "", "WHERE t.`day` >= DATE(@pfrom) AND t.`day` < DATE(@pto)", false,
+			"SELECT * EXCEPT(_bqtools_rn) FROM (\n" +
+				"  SELECT t.*, ROW_NUMBER() OVER (PARTITION BY t.`id`, t.`a`.`b`) AS _bqtools_rn FROM `ds`.`t` AS t " +
+				"WHERE t.`day` >= DATE(@pfrom) AND t.`day` < DATE(@pto)\n" +
+				") WHERE _bqtools_rn = 1"},
+		{"ordered partition", "updated_at DESC", "WHERE x", false,
+			"SELECT * EXCEPT(_bqtools_rn) FROM (\n" +
+				"  SELECT t.*, ROW_NUMBER() OVER (PARTITION BY t.`id`, t.`a`.`b` ORDER BY updated_at DESC) AS _bqtools_rn FROM `ds`.`t` AS t WHERE x\n" +
+				") WHERE _bqtools_rn = 1"},
+		{"unpartitioned", "updated_at DESC", "", true,
+			"MERGE `ds`.`t` AS t\n" +
+				"USING (\n" +
+				"SELECT * EXCEPT(_bqtools_rn) FROM (\n" +
+				"  SELECT t.*, ROW_NUMBER() OVER (PARTITION BY t.`id`, t.`a`.`b` ORDER BY updated_at DESC) AS _bqtools_rn FROM `ds`.`t` AS t \n" +
+				") WHERE _bqtools_rn = 1\n" +
+				") AS s\n" +
+				"ON FALSE\n" +
+				"WHEN NOT MATCHED BY SOURCE THEN DELETE\n" +
+				"WHEN NOT MATCHED THEN INSERT ROW"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dedupSQL("ds", "t", keys, tt.orderBy, tt.where, tt.merge); got != tt.want {
+				t.Errorf("dedupSQL() =\n%v\nwant\n%v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,299 @@
+package bqtools
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	"google.golang.org/api/iterator"
+
+	bu "github.com/belboo/boo-go-tools/misc"
+)
+
+// ExtractSpec tunes ExtractTableToGCS and ExportQueryToGCS
+type ExtractSpec struct {
+	// Format of the produced objects (CSV, JSON, Avro or Parquet), defaults to Parquet
+	Format bigquery.DataFormat
+	// Compression: GZIP for CSV and JSON, DEFLATE or SNAPPY for Avro, GZIP or SNAPPY for Parquet
+	Compression bigquery.Compression
+
+	DisableHeader       bool   // CSV only
+	FieldDelimiter      string // CSV only
+	UseAvroLogicalTypes bool   // Avro only
+
+	// Sharded appends a "-*" wildcard to object names without one, needed for tables over 1 GB.
+	// BigQuery replaces the wildcard with a 12 digit shard number.
+	Sharded bool
+
+	// Partition extracts a single partition (anything PartitionFor accepts) of the table
+	Partition interface{}
+
+	Labels map[string]string
+}
+
+// ExportedObject is an object produced by an extract job
+type ExportedObject struct {
+	Bucket string
+	Name   string
+	Size   int64
+}
+
+// URI returns the gs:// URI of the object
+func (o ExportedObject) URI() string {
+	return "gs://" + o.Bucket + "/" + o.Name
+}
+
+// validate checks format specific options
+func (spec ExtractSpec) validate() error {
+	fail := func(format string, args ...interface{}) error {
+		return bu.TError{
+			Msg:    fmt.Sprintf(format, args...),
+			Origin: "ExtractSpec",
+			Code:   bu.ErrConfigError,
+			Err:    nil,
+		}
+	}
+
+	allowed := map[bigquery.DataFormat][]bigquery.Compression{
+		bigquery.CSV:     {bigquery.Gzip},
+		bigquery.JSON:    {bigquery.Gzip},
+		bigquery.Avro:    {bigquery.Deflate, bigquery.Snappy},
+		bigquery.Parquet: {bigquery.Gzip, bigquery.Snappy},
+	}
+	format := spec.format()
+	compressions, ok := allowed[format]
+	if !ok {
+		return fail("unsupported extract format %v", format)
+	}
+	if spec.Compression != "" && spec.Compression != bigquery.None {
+		ok = false
+		for _, c := range compressions {
+			ok = ok || c == spec.Compression
+		}
+		if !ok {
+			return fail("%v compression is not available for %v", spec.Compression, format)
+		}
+	}
+	if format != bigquery.CSV && (spec.DisableHeader || spec.FieldDelimiter != "") {
+		return fail("CSV options given for a %v extract", format)
+	}
+	return nil
+}
+
+// format returns the destination format defaulting to Parquet
+func (spec ExtractSpec) format() bigquery.DataFormat {
+	if spec.Format == "" {
+		return bigquery.Parquet
+	}
+	return spec.Format
+}
+
+// ExtractTableToGCS extracts bqDataset.bqTable (or one of its partitions) into gs://gcsBucket/gcsObject,
+// gcsObject may contain a single * wildcard for sharded output. The objects produced are found by listing
+// the destination and returned with their sizes.
+func ExtractTableToGCS(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string,
+	gcsBucket string, gcsObject string, spec ExtractSpec) ([]ExportedObject, error) {
+
+	src, err := extractSource(ctx, bqClient, bqDataset, bqTable, spec, "ExtractTableToGCS")
+	if err != nil {
+		return nil, err
+	}
+
+	return extractToGCS(ctx, src, gcsBucket, gcsObject, spec, "ExtractTableToGCS")
+}
+
+// extractSource returns the table to extract, the partition decorated one if spec.Partition is set
+func extractSource(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string, spec ExtractSpec, origin string) (*bigquery.Table, error) {
+	table := bqTable
+	if spec.Partition != nil {
+		tMeta, err := getTableMeta(ctx, bqClient, bqDataset, bqTable, origin)
+		if err != nil {
+			return nil, err
+		}
+		p, err := PartitionFor(tMeta, spec.Partition)
+		if err != nil {
+			return nil, err
+		}
+		table = p.Decorator(bqTable)
+	}
+
+	return bqClient.Dataset(bqDataset).Table(table), nil
+}
+
+// ExportQueryToGCS runs a query (parameters as for RunQuery, under the client's budget policy) and extracts
+// its results into gs://gcsBucket/gcsObject like ExtractTableToGCS
+func ExportQueryToGCS(ctx context.Context, bqClient *bigquery.Client, sql string, params interface{},
+	gcsBucket string, gcsObject string, spec ExtractSpec) ([]ExportedObject, error) {
+
+	if spec.Partition != nil {
+		return nil, bu.TError{
+			Msg:    "query results have no partitions to extract",
+			Origin: "ExportQueryToGCS",
+			Code:   bu.ErrConfigError,
+			Err:    nil,
+		}
+	}
+	if err := spec.validate(); err != nil {
+		return nil, err
+	}
+
+	qParams, err := QueryParameters(params)
+	if err != nil {
+		return nil, err
+	}
+
+	job, err := runQuery(ctx, bqClient, newQuery(bqClient, sql, qParams, QueryOptions{Labels: spec.Labels}), "ExportQueryToGCS")
+	if _, ok := err.(bu.TError); ok {
+		return nil, err
+	}
+	if err == nil {
+		var status *bigquery.JobStatus
+		if status, err = job.Wait(ctx); err == nil {
+			err = status.Err()
+		}
+	}
+	if err != nil {
+		return nil, bu.TError{
+			Msg:    "export query failed",
+			Origin: "ExportQueryToGCS",
+			Code:   bu.ErrDataQuery,
+			Err:    err,
+		}
+	}
+
+	// Results land in an anonymous table, extract from there
+	cfg, err := job.Config()
+	qc, ok := cfg.(*bigquery.QueryConfig)
+	if err != nil || !ok || qc.Dst == nil {
+		return nil, bu.TError{
+			Msg:    fmt.Sprintf("no destination table for results of query job %v", job.ID()),
+			Origin: "ExportQueryToGCS",
+			Code:   bu.ErrAPI,
+			Err:    err,
+		}
+	}
+
+	return extractToGCS(ctx, qc.Dst, gcsBucket, gcsObject, spec, "ExportQueryToGCS")
+}
+
+// newExtractor validates spec and the destination and sets up the extract of src, the returned object
+// name has the wildcard added for sharded output
+func newExtractor(src *bigquery.Table, gcsBucket string, gcsObject string, spec ExtractSpec, origin string) (*bigquery.Extractor, string, error) {
+	if err := spec.validate(); err != nil {
+		return nil, "", err
+	}
+	if strings.Count(gcsObject, "*") > 1 {
+		return nil, "", bu.TError{
+			Msg:    fmt.Sprintf("object name %v has more than one wildcard", gcsObject),
+			Origin: origin,
+			Code:   bu.ErrConfigError,
+			Err:    nil,
+		}
+	}
+	if spec.Sharded && !strings.Contains(gcsObject, "*") {
+		gcsObject += "-*"
+	}
+
+	gcsRef := bigquery.NewGCSReference("gs://" + gcsBucket + "/" + gcsObject)
+	gcsRef.DestinationFormat = spec.format()
+	gcsRef.Compression = spec.Compression
+	gcsRef.FieldDelimiter = spec.FieldDelimiter
+
+	extractor := src.ExtractorTo(gcsRef)
+	extractor.DisableHeader = spec.DisableHeader
+	extractor.UseAvroLogicalTypes = spec.UseAvroLogicalTypes
+	extractor.Labels = spec.Labels
+
+	return extractor, gcsObject, nil
+}
+
+// extractToGCS runs and waits for an extract job then lists what it produced
+func extractToGCS(ctx context.Context, src *bigquery.Table, gcsBucket string, gcsObject string, spec ExtractSpec, origin string) ([]ExportedObject, error) {
+	extractor, gcsObject, err := newExtractor(src, gcsBucket, gcsObject, spec, origin)
+	if err != nil {
+		return nil, err
+	}
+
+	started := time.Now()
+	job, err := extractor.Run(ctx)
+	if err == nil {
+		var status *bigquery.JobStatus
+		if status, err = job.Wait(ctx); err == nil {
+			err = status.Err()
+			if status.Statistics != nil && !status.Statistics.StartTime.IsZero() {
+				started = status.Statistics.StartTime
+			}
+		}
+	}
+	if err != nil {
+		return nil, bu.TError{
+			Msg:    fmt.Sprintf("failed to extract %v.%v to gs://%v/%v", src.DatasetID, src.TableID, gcsBucket, gcsObject),
+			Origin: origin,
+			Code:   bu.ErrGCS,
+			Err:    err,
+		}
+	}
+
+	return listExported(ctx, gcsBucket, gcsObject, started, origin)
+}
+
+// listExported lists the objects matching an extract destination written since the job started
+func listExported(ctx context.Context, gcsBucket string, gcsObject string, since time.Time, origin string) ([]ExportedObject, error) {
+	gcsClient, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, bu.TError{
+			Msg:    "failed to create GCS client",
+			Origin: origin,
+			Code:   bu.ErrGCS,
+			Err:    err,
+		}
+	}
+	defer gcsClient.Close()
+
+	prefix := gcsObject
+	if i := strings.Index(gcsObject, "*"); i >= 0 {
+		prefix = gcsObject[:i]
+	}
+
+	objects := make([]ExportedObject, 0)
+	it := gcsClient.Bucket(gcsBucket).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return objects, bu.TError{
+				Msg:    fmt.Sprintf("failed to list gs://%v/%v", gcsBucket, prefix),
+				Origin: origin,
+				Code:   bu.ErrGCS,
+				Err:    err,
+			}
+		}
+		if !matchesExport(attrs.Name, gcsObject) {
+			continue
+		}
+		// a minute of slack for clock skew between here and GCS
+		if attrs.Updated.Before(since.Add(-time.Minute)) {
+			continue
+		}
+		objects = append(objects, ExportedObject{Bucket: gcsBucket, Name: attrs.Name, Size: attrs.Size})
+	}
+
+	return objects, nil
+}
+
+// matchesExport tells if an object name matches an extract destination with at most one wildcard. The listing
+// is recursive, the wildcard only matches within the "directory" of the URI.
+func matchesExport(name string, gcsObject string) bool {
+	i := strings.Index(gcsObject, "*")
+	if i < 0 {
+		return name == gcsObject
+	}
+	prefix, suffix := gcsObject[:i], gcsObject[i+1:]
+	return len(name) >= len(prefix)+len(suffix) && strings.HasPrefix(name, prefix) && strings.HasSuffix(name, suffix) &&
+		!strings.Contains(name[len(prefix):len(name)-len(suffix)], "/")
+}
@@ -0,0 +1,84 @@
+package bqtools
+
+import (
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestExtractSpecValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    ExtractSpec
+		wantErr bool
+	}{
+		{"defaults", ExtractSpec{}, false},
+		{"snappy parquet", ExtractSpec{Compression: bigquery.Snappy}, false},
+		{"deflate parquet", ExtractSpec{Compression: bigquery.Deflate}, true},
+		{"gzip CSV", ExtractSpec{Format: bigquery.CSV, Compression: bigquery.Gzip, DisableHeader: true, FieldDelimiter: ";"}, false},
+		{"snappy JSON", ExtractSpec{Format: bigquery.JSON, Compression: bigquery.Snappy}, true},
+		{"deflate avro", ExtractSpec{Format: bigquery.Avro, Compression: bigquery.Deflate, UseAvroLogicalTypes: true}, false},
+		{"gzip avro", ExtractSpec{Format: bigquery.Avro, Compression: bigquery.Gzip}, true},
+		{"uncompressed", ExtractSpec{Format: bigquery.JSON, Compression: bigquery.None}, false},
+		{"ORC", ExtractSpec{Format: bigquery.ORC}, true},
+		{"CSV header for JSON", ExtractSpec{Format: bigquery.JSON, DisableHeader: true}, true},
+		{"CSV delimiter for parquet", ExtractSpec{FieldDelimiter: ","}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.spec.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewExtractorObject(t *testing.T) {
+	tests := []struct {
+		object  string
+		sharded bool
+		want    string
+		wantErr bool
+	}{
+		{"out/t.parquet", false, "out/t.parquet", false},
+		{"out/t", true, "out/t-*", false},
+		{"out/t-*.parquet", true, "out/t-*.parquet", false},
+		{"out/*/t-*", false, "", true},
+	}
+
+	for _, tt := range tests {
+		_, got, err := newExtractor(&bigquery.Table{}, "bucket", tt.object, ExtractSpec{Sharded: tt.sharded}, "test")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("newExtractor(%v) error = %v, wantErr %v", tt.object, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("newExtractor(%v) object = %v, want %v", tt.object, got, tt.want)
+		}
+	}
+}
+
+func TestMatchesExport(t *testing.T) {
+	tests := []struct {
+		name   string
+		object string
+		want   bool
+	}{
+		{"out/t.parquet", "out/t.parquet", true},
+		{"out/t.parquet.bak", "out/t.parquet", false},
+		{"out/t-000000000000", "out/t-*", true},
+		{"out/t-", "out/t-*", true},
+		{"out/t-000000000001.csv.gz", "out/t-*.csv.gz", true},
+		{"out/t-000000000001.csv", "out/t-*.csv.gz", false},
+		{"out/t-old/000000000000", "out/t-*", false},
+		{"out/t.gz", "out/t*t.gz", false},
+		{"other/t-000000000000", "out/t-*", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchesExport(tt.name, tt.object); got != tt.want {
+			t.Errorf("matchesExport(%v, %v) = %v, want %v", tt.name, tt.object, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package bqtools
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/net/context"
+	"google.golang.org/api/iterator"
+
+	bu "github.com/belboo/boo-go-tools/misc"
+)
+
+// JobOptions sets the identity of a submitted job
+type JobOptions struct {
+	// JobID makes resubmitting the same job idempotent: a job with an existing ID is not run again, the
+	// existing one is returned instead. Use JobIDFor to derive one, empty generates a random ID.
+	JobID    string
+	Location string
+	Labels   map[string]string
+}
+
+// jobIDConfig applies the options to a job
+func (opts JobOptions) jobIDConfig() bigquery.JobIDConfig {
+	return bigquery.JobIDConfig{JobID: opts.JobID, Location: opts.Location}
+}
+
+// mergeLabels returns labels with the job option labels added
+func (opts JobOptions) mergeLabels(labels map[string]string) map[string]string {
+	if len(opts.Labels) == 0 {
+		return labels
+	}
+	out := make(map[string]string, len(labels)+len(opts.Labels))
+	for k, v := range labels {
+		out[k] = v
+	}
+	for k, v := range opts.Labels {
+		out[k] = v
+	}
+	return out
+}
+
+var jobIDInvalid = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// JobIDFor derives a deterministic job ID from a prefix and whatever identifies the work (e.g. the
+// destination table and the partition), the same arguments always give the same ID
+func JobIDFor(prefix string, parts ...interface{}) string {
+	h := sha1.New()
+	for _, p := range parts {
+		fmt.Fprintf(h, "%v\x00", p)
+	}
+	prefix = jobIDInvalid.ReplaceAllString(prefix, "_")
+	if len(prefix) > 900 {
+		prefix = prefix[:900]
+	}
+	return prefix + "_" + hex.EncodeToString(h.Sum(nil))
+}
+
+// submitJob runs a job, returning the existing one if a job with the same ID was submitted before
+func submitJob(ctx context.Context, bqClient *bigquery.Client, opts JobOptions, run func() (*bigquery.Job, error), origin string) (*bigquery.Job, error) {
+	job, err := run()
+	if err != nil && opts.JobID != "" && isAlreadyExists(err) {
+		job, err = bqClient.JobFromIDLocation(ctx, opts.JobID, opts.Location)
+	}
+	if _, ok := err.(bu.TError); ok {
+		return nil, err
+	}
+	if err != nil {
+		return nil, bu.TError{
+			Msg:    fmt.Sprintf("failed to submit job %v", opts.JobID),
+			Origin: origin,
+			Code:   bu.ErrAPI,
+			Err:    err,
+		}
+	}
+	return job, nil
+}
+
+// SubmitLoad starts a load job into bqDataset.bqTable without waiting for it
+func SubmitLoad(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string, spec LoadSpec, opts JobOptions) (*bigquery.Job, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	loader := spec.Loader(bqClient.Dataset(bqDataset).Table(bqTable))
+	loader.JobIDConfig = opts.jobIDConfig()
+	loader.Labels = opts.mergeLabels(loader.Labels)
+
+	return submitJob(ctx, bqClient, opts, func() (*bigquery.Job, error) { return loader.Run(ctx) }, "SubmitLoad")
+}
+
+// SubmitQuery starts a query job (under the client's budget policy) without waiting for it, use
+// job.Read once done to get the results
+func SubmitQuery(ctx context.Context, bqClient *bigquery.Client, sql string, params interface{}, qOpts QueryOptions, opts JobOptions) (*bigquery.Job, error) {
+	qParams, err := QueryParameters(params)
+	if err != nil {
+		return nil, err
+	}
+	qry := newQuery(bqClient, sql, qParams, qOpts)
+	qry.JobIDConfig = opts.jobIDConfig()
+	qry.Labels = opts.mergeLabels(qry.Labels)
+
+	return submitJob(ctx, bqClient, opts, func() (*bigquery.Job, error) { return runQuery(ctx, bqClient, qry, "SubmitQuery") }, "SubmitQuery")
+}
+
+// SubmitCopy starts a copy job of srcDataset.srcTable into dstDataset.dstTable (both may be partition decorated)
+func SubmitCopy(ctx context.Context, bqClient *bigquery.Client, srcDataset string, srcTable string, dstDataset string, dstTable string,
+	write bigquery.TableWriteDisposition, opts JobOptions) (*bigquery.Job, error) {
+
+	copier := bqClient.Dataset(dstDataset).Table(dstTable).CopierFrom(bqClient.Dataset(srcDataset).Table(srcTable))
+	copier.WriteDisposition = write
+	copier.JobIDConfig = opts.jobIDConfig()
+	copier.Labels = opts.mergeLabels(nil)
+
+	return submitJob(ctx, bqClient, opts, func() (*bigquery.Job, error) { return copier.Run(ctx) }, "SubmitCopy")
+}
+
+// SubmitExtract starts an extract job of bqDataset.bqTable into gs://gcsBucket/gcsObject, the objects can be
+// listed once it is done
+func SubmitExtract(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string, gcsBucket string, gcsObject string,
+	spec ExtractSpec, opts JobOptions) (*bigquery.Job, error) {
+
+	src, err := extractSource(ctx, bqClient, bqDataset, bqTable, spec, "SubmitExtract")
+	if err != nil {
+		return nil, err
+	}
+	extractor, _, err := newExtractor(src, gcsBucket, gcsObject, spec, "SubmitExtract")
+	if err != nil {
+		return nil, err
+	}
+	extractor.JobIDConfig = opts.jobIDConfig()
+	extractor.Labels = opts.mergeLabels(spec.Labels)
+
+	return submitJob(ctx, bqClient, opts, func() (*bigquery.Job, error) { return extractor.Run(ctx) }, "SubmitExtract")
+}
+
+// JobInfo is a snapshot of a job's status
+type JobInfo struct {
+	ID       string
+	Location string
+	State    bigquery.State
+	Err      error // set if the job is done and failed
+	Labels   map[string]string
+
+	Created time.Time
+	Started time.Time
+	Ended   time.Time
+	Stats   *bigquery.JobStatistics
+}
+
+// Done tells if the job is finished, successfully or not
+func (ji *JobInfo) Done() bool {
+	return ji.State == bigquery.Done
+}
+
+// jobLabels returns the labels of a job from its configuration
+func jobLabels(job *bigquery.Job) map[string]string {
+	cfg, err := job.Config()
+	if err != nil {
+		return nil
+	}
+	switch c := cfg.(type) {
+	case *bigquery.QueryConfig:
+		return c.Labels
+	case *bigquery.LoadConfig:
+		return c.Labels
+	case *bigquery.CopyConfig:
+		return c.Labels
+	case *bigquery.ExtractConfig:
+		return c.Labels
+	}
+	return nil
+}
+
+// newJobInfo builds a JobInfo from a job and its status
+func newJobInfo(job *bigquery.Job, status *bigquery.JobStatus) *JobInfo {
+	ji := &JobInfo{
+		ID:       job.ID(),
+		Location: job.Location(),
+		Labels:   jobLabels(job),
+	}
+	if status != nil {
+		ji.State = status.State
+		ji.Err = status.Err()
+		ji.Stats = status.Statistics
+		if s := status.Statistics; s != nil {
+			ji.Created, ji.Started, ji.Ended = s.CreationTime, s.StartTime, s.EndTime
+		}
+	}
+	return ji
+}
+
+// PollJob fetches the current status of a job without waiting for it
+func PollJob(ctx context.Context, bqClient *bigquery.Client, jobID string, location string) (*JobInfo, error) {
+	job, err := bqClient.JobFromIDLocation(ctx, jobID, location)
+	if err != nil {
+		code := bu.ErrAPI
+		if isNotFound(err) {
+			code = bu.ErrNotFound
+		}
+		return nil, bu.TError{
+			Msg:    fmt.Sprintf("failed to get job %v", jobID),
+			Origin: "PollJob",
+			Code:   code,
+			Err:    err,
+		}
+	}
+	return newJobInfo(job, job.LastStatus()), nil
+}
+
+// CancelJob requests the cancellation of a job, it may still complete
+func CancelJob(ctx context.Context, bqClient *bigquery.Client, jobID string, location string) error {
+	job, err := bqClient.JobFromIDLocation(ctx, jobID, location)
+	if err == nil {
+		err = job.Cancel(ctx)
+	}
+	if err != nil {
+		return bu.TError{
+			Msg:    fmt.Sprintf("failed to cancel job %v", jobID),
+			Origin: "CancelJob",
+			Code:   bu.ErrAPI,
+			Err:    err,
+		}
+	}
+	return nil
+}
+
+// JobFilter selects the jobs ListJobs returns
+type JobFilter struct {
+	Labels   map[string]string // jobs must have all of these labels
+	State    bigquery.State    // zero for any
+	Since    time.Time         // created after, zero for any time
+	AllUsers bool              // include jobs of other users of the project
+	Limit    int               // maximum number of jobs, 0 for no limit
+}
+
+// ListJobs lists recent jobs of the client's project, newest first
+func ListJobs(ctx context.Context, bqClient *bigquery.Client, filter JobFilter) ([]*JobInfo, error) {
+	it := bqClient.Jobs(ctx)
+	it.State = filter.State
+	it.MinCreationTime = filter.Since
+	it.AllUsers = filter.AllUsers
+
+	jobs := make([]*JobInfo, 0)
+	for filter.Limit <= 0 || len(jobs) < filter.Limit {
+		job, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return jobs, bu.TError{
+				Msg:    "failed to list jobs",
+				Origin: "ListJobs",
+				Code:   bu.ErrAPI,
+				Err:    err,
+			}
+		}
+
+		ji := newJobInfo(job, job.LastStatus())
+		matches := true
+		for k, v := range filter.Labels {
+			if ji.Labels[k] != v {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			jobs = append(jobs, ji)
+		}
+	}
+
+	return jobs, nil
+}
+
+// JobErrors aggregates the failures of WaitAll
+type JobErrors map[string]error
+
+// Error implemented to comply with error interface
+func (je JobErrors) Error() string {
+	lines := make([]string, 0, len(je))
+	for id, err := range je {
+		lines = append(lines, fmt.Sprintf("job %v: %v", id, err))
+	}
+	return fmt.Sprintf("%v jobs failed:\n%v", len(je), strings.Join(lines, "\n"))
+}
+
+// WaitAll waits for jobs to finish, for at most timeout (0 for no limit). Failed jobs and the ones still
+// running at the timeout end up in the returned JobErrors keyed by job ID, jobs are not cancelled.
+func WaitAll(ctx context.Context, jobs []*bigquery.Job, timeout time.Duration) ([]*JobInfo, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	infos := make([]*JobInfo, len(jobs))
+	errs := make(JobErrors)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for i, job := range jobs {
+		wg.Add(1)
+		go func(i int, job *bigquery.Job) {
+			defer wg.Done()
+
+			status, err := job.Wait(ctx)
+			if err != nil {
+				status = job.LastStatus()
+			} else {
+				err = status.Err()
+			}
+			infos[i] = newJobInfo(job, status)
+
+			if err != nil {
+				mu.Lock()
+				errs[job.ID()] = err
+				mu.Unlock()
+			}
+		}(i, job)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return infos, errs
+	}
+	return infos, nil
+}
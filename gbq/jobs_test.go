@@ -0,0 +1,77 @@
+package bqtools
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestJobIDFor(t *testing.T) {
+	valid := regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	base := JobIDFor("load", "ds.t", "20190528")
+
+	tests := []struct {
+		name   string
+		prefix string
+		parts  []interface{}
+		same   bool
+	}{
+		{"same arguments", "load", []interface{}{"ds.t", "20190528"}, true},
+		{"other part", "load", []interface{}{"ds.t", "20190529"}, false},
+		{"parts not concatenated", "load", []interface{}{"ds.t2", "0190528"}, false},
+		{"other prefix", "copy", []interface{}{"ds.t", "20190528"}, false},
+		{"invalid prefix characters", "load ds.t/2019:05", []interface{}{1}, false},
+		{"long prefix", strings.Repeat("p", 2000), []interface{}{1}, false},
+		{"no parts", "load", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := JobIDFor(tt.prefix, tt.parts...)
+			if (got == base) != tt.same {
+				t.Errorf("JobIDFor() = %v, same as %v: %v, want %v", got, base, got == base, tt.same)
+			}
+			if !valid.MatchString(got) || len(got) > 1024 {
+				t.Errorf("JobIDFor() = %v is not a valid job ID", got)
+			}
+		})
+	}
+
+	if got := JobIDFor("load ds.t", 1); !strings.HasPrefix(got, "load_ds_t_") {
+		t.Errorf("JobIDFor() = %v, want the prefix sanitised", got)
+	}
+}
+
+func TestJobOptionsMergeLabels(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   JobOptions
+		labels map[string]string
+		want   map[string]string
+	}{
+		{"none", JobOptions{}, nil, nil},
+		{"job labels only", JobOptions{}, map[string]string{"a": "1"}, map[string]string{"a": "1"}},
+		{"option labels only", JobOptions{Labels: map[string]string{"b": "2"}}, nil, map[string]string{"b": "2"}},
+		{"options win", JobOptions{Labels: map[string]string{"a": "x", "b": "2"}}, map[string]string{"a": "1", "c": "3"},
+			map[string]string{"a": "x", "b": "2", "c": "3"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var before map[string]string
+			if tt.labels != nil {
+				before = make(map[string]string)
+				for k, v := range tt.labels {
+					before[k] = v
+				}
+			}
+			if got := tt.opts.mergeLabels(tt.labels); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeLabels() = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(tt.labels, before) {
+				t.Errorf("mergeLabels() modified its argument: %v", tt.labels)
+			}
+		})
+	}
+}
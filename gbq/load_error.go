@@ -0,0 +1,126 @@
+package bqtools
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+
+	bu "github.com/belboo/boo-go-tools/misc"
+)
+
+// LoadError is a failed load job with everything BigQuery reported about it
+type LoadError struct {
+	Dataset string
+	Table   string
+	Sources []string
+
+	ProjectID string
+	Location  string
+	JobID     string
+
+	Result *bigquery.Error   // the error the job failed with
+	Errors []*bigquery.Error // all errors the job ran into, e.g. one per bad row or file
+
+	Code bu.TErrorCode // classification of Result, see classifyLoadError
+}
+
+// newLoadError builds a LoadError from a finished job
+func newLoadError(job *bigquery.Job, status *bigquery.JobStatus, bqDataset string, bqTable string, sources []string) *LoadError {
+	le := &LoadError{
+		Dataset:   bqDataset,
+		Table:     bqTable,
+		Sources:   sources,
+		ProjectID: job.ProjectID(),
+		Location:  job.Location(),
+		JobID:     job.ID(),
+		Errors:    status.Errors,
+	}
+	if be, ok := status.Err().(*bigquery.Error); ok {
+		le.Result = be
+	} else if len(status.Errors) > 0 {
+		le.Result = status.Errors[0]
+	}
+	le.Code = classifyLoadError(le.Result, le.Errors)
+	return le
+}
+
+// classifyLoadError maps BigQuery error reasons (and messages, reasons are coarse) to TErrorCodes
+func classifyLoadError(result *bigquery.Error, errs []*bigquery.Error) bu.TErrorCode {
+	all := errs
+	if result != nil {
+		all = append([]*bigquery.Error{result}, errs...)
+	}
+
+	code := bu.ErrLoadGCS
+	for _, e := range all {
+		msg := strings.ToLower(e.Message)
+		switch e.Reason {
+		case "quotaExceeded", "rateLimitExceeded":
+			return bu.ErrQuotaExceeded
+		case "notFound":
+			if strings.Contains(msg, "table") {
+				return bu.ErrTableNotFound
+			}
+			return bu.ErrNotFound
+		case "invalid", "invalidQuery":
+			if strings.Contains(msg, "schema") || strings.Contains(msg, "no such field") ||
+				(strings.Contains(msg, "field") && strings.Contains(msg, "changed type")) {
+				return bu.ErrSchemaMismatch
+			}
+			code = bu.ErrBadData
+		}
+	}
+	return code
+}
+
+// JobRef returns the job reference as used by the bq tool, e.g. project:EU.job_id
+func (e *LoadError) JobRef() string {
+	return fmt.Sprintf("%v:%v.%v", e.ProjectID, e.Location, e.JobID)
+}
+
+// Link returns the URL of the job in the cloud console
+func (e *LoadError) Link() string {
+	return fmt.Sprintf("https://console.cloud.google.com/bigquery?project=%v&j=%v&page=queryresults",
+		url.QueryEscape(e.ProjectID), url.QueryEscape("bq:"+e.Location+":"+e.JobID))
+}
+
+// Retryable tells if running the same load again may succeed
+func (e *LoadError) Retryable() bool {
+	if e.Code == bu.ErrQuotaExceeded {
+		return true
+	}
+	return e.Result != nil && (e.Result.Reason == "backendError" || e.Result.Reason == "internalError")
+}
+
+// Error implemented to comply with error interface, lists every error of the job
+func (e *LoadError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Error: loading into %v.%v from %v failed in job %v (Code: %v)",
+		e.Dataset, e.Table, strings.Join(e.Sources, ", "), e.JobRef(), e.Code)
+	if e.Result != nil {
+		fmt.Fprintf(&sb, "\n %v: %v", e.Result.Reason, e.Result.Message)
+	}
+	for _, be := range e.Errors {
+		if e.Result != nil && *be == *e.Result {
+			continue
+		}
+		if be.Location != "" {
+			fmt.Fprintf(&sb, "\n  %v at %v: %v", be.Reason, be.Location, be.Message)
+		} else {
+			fmt.Fprintf(&sb, "\n  %v: %v", be.Reason, be.Message)
+		}
+	}
+	return sb.String()
+}
+
+// TError converts the load error for callers handling TErrors only
+func (e *LoadError) TError(origin string) bu.TError {
+	return bu.TError{
+		Msg:    fmt.Sprintf("loading into %v.%v failed in job %v", e.Dataset, e.Table, e.JobRef()),
+		Origin: origin,
+		Code:   e.Code,
+		Err:    e,
+	}
+}
@@ -0,0 +1,62 @@
+package bqtools
+
+import (
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+
+	bu "github.com/belboo/boo-go-tools/misc"
+)
+
+func TestClassifyLoadError(t *testing.T) {
+	bqErr := func(reason string, msg string) *bigquery.Error {
+		return &bigquery.Error{Reason: reason, Message: msg}
+	}
+
+	tests := []struct {
+		name   string
+		result *bigquery.Error
+		errs   []*bigquery.Error
+		want   bu.TErrorCode
+	}{
+		{"nothing", nil, nil, bu.ErrLoadGCS},
+		{"backend", bqErr("backendError", "oops"), nil, bu.ErrLoadGCS},
+		{"quota", bqErr("quotaExceeded", "too many loads"), nil, bu.ErrQuotaExceeded},
+		{"rate limit among row errors", bqErr("invalid", "bad rows"), []*bigquery.Error{bqErr("rateLimitExceeded", "slow down")},
+			bu.ErrQuotaExceeded},
+		{"missing table", bqErr("notFound", "Not found: Table p:ds.t"), nil, bu.ErrTableNotFound},
+		{"missing object", bqErr("notFound", "Not found: URI gs://bucket/x"), nil, bu.ErrNotFound},
+		{"bad rows", bqErr("invalid", "Error while reading data"), []*bigquery.Error{bqErr("invalid", "Could not parse 'x' as INT64")},
+			bu.ErrBadData},
+		{"schema in a row error", bqErr("invalid", "Error while reading data"),
+			[]*bigquery.Error{bqErr("invalid", "Provided Schema does not match Table p:ds.t")}, bu.ErrSchemaMismatch},
+		{"unknown field", bqErr("invalid", "JSON parsing error: No such field: x."), nil, bu.ErrSchemaMismatch},
+		{"changed type", bqErr("invalidQuery", "Field amount has changed type from INTEGER to FLOAT"), nil, bu.ErrSchemaMismatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyLoadError(tt.result, tt.errs); got != tt.want {
+				t.Errorf("classifyLoadError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadErrorRetryable(t *testing.T) {
+	tests := []struct {
+		err  LoadError
+		want bool
+	}{
+		{LoadError{Code: bu.ErrQuotaExceeded}, true},
+		{LoadError{Code: bu.ErrLoadGCS, Result: &bigquery.Error{Reason: "backendError"}}, true},
+		{LoadError{Code: bu.ErrBadData, Result: &bigquery.Error{Reason: "invalid"}}, false},
+		{LoadError{Code: bu.ErrLoadGCS}, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.err.Retryable(); got != tt.want {
+			t.Errorf("Retryable() of %v = %v, want %v", tt.err.Code, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package bqtools
+
+import (
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/net/context"
+
+	bu "github.com/belboo/boo-go-tools/misc"
+)
+
+// LoadSpec describes a load job from GCS for InsertFromGCSIntoBQWithSpec
+type LoadSpec struct {
+	// URIs of the objects to load (gs://bucket/object), each may contain a single * wildcard
+	URIs []string
+	// Format of the objects (CSV, JSON, Avro, ORC or Parquet), defaults to Parquet
+	Format      bigquery.DataFormat
+	Compression bigquery.Compression // CSV and JSON only
+
+	WriteDisposition  bigquery.TableWriteDisposition  // WriteAppend (default), WriteTruncate or WriteEmpty
+	CreateDisposition bigquery.TableCreateDisposition // CreateNever (default) or CreateIfNeeded
+
+	// Schema of the data, required to create the table from CSV or JSON unless AutoDetect is set
+	Schema     bigquery.Schema
+	AutoDetect bool
+	// Partitioning and clustering of a table created by the load, or of the write for TimePartitioning
+	TimePartitioning  *bigquery.TimePartitioning
+	RangePartitioning *bigquery.RangePartitioning
+	Clustering        *bigquery.Clustering
+
+	// SchemaUpdateOptions allowed when appending or truncating (AllowFieldAddition, AllowFieldRelaxation),
+	// SchemaChanges.SchemaUpdateOptions returns the ones a schema change needs
+	SchemaUpdateOptions []string
+
+	MaxBadRecords       int64
+	IgnoreUnknownValues bool
+
+	CSV                 *bigquery.CSVOptions // CSV only
+	UseAvroLogicalTypes bool                 // Avro only
+	// DecimalTargetTypes lists the types NUMERIC/BIGNUMERIC source columns may be converted to, in order of preference
+	DecimalTargetTypes []bigquery.DecimalTargetType
+
+	// HivePartitioning detects partition columns from the object paths, e.g. gs://bucket/table/dt=2019-05-28/file
+	// with SourceURIPrefix gs://bucket/table
+	HivePartitioning *bigquery.HivePartitioningOptions
+
+	Labels map[string]string
+}
+
+// Validate checks the spec for obvious mistakes before submitting a job
+func (spec LoadSpec) Validate() error {
+	fail := func(format string, args ...interface{}) error {
+		return bu.TError{
+			Msg:    fmt.Sprintf(format, args...),
+			Origin: "LoadSpec.Validate",
+			Code:   bu.ErrConfigError,
+			Err:    nil,
+		}
+	}
+
+	if len(spec.URIs) == 0 {
+		return fail("no source URIs")
+	}
+	for _, uri := range spec.URIs {
+		if !strings.HasPrefix(uri, "gs://") {
+			return fail("source URI %v is not a gs:// one", uri)
+		}
+		if strings.Count(uri, "*") > 1 {
+			return fail("source URI %v has more than one wildcard", uri)
+		}
+	}
+
+	switch spec.Format {
+	case "", bigquery.CSV, bigquery.JSON, bigquery.Avro, bigquery.ORC, bigquery.Parquet:
+	default:
+		return fail("unsupported load format %v", spec.Format)
+	}
+	format := spec.format()
+	if format != bigquery.CSV && spec.CSV != nil {
+		return fail("CSV options given for a %v load", format)
+	}
+	if format != bigquery.CSV && format != bigquery.JSON && spec.Compression != "" && spec.Compression != bigquery.None {
+		return fail("compression can only be set for CSV and JSON loads")
+	}
+
+	if spec.CreateDisposition == bigquery.CreateIfNeeded && len(spec.Schema) == 0 && !spec.AutoDetect &&
+		(format == bigquery.CSV || format == bigquery.JSON) {
+		return fail("creating a table from %v needs a Schema or AutoDetect", format)
+	}
+	for _, o := range spec.SchemaUpdateOptions {
+		if o != AllowFieldAddition && o != AllowFieldRelaxation {
+			return fail("unknown schema update option %v", o)
+		}
+	}
+	if len(spec.SchemaUpdateOptions) > 0 && spec.WriteDisposition == bigquery.WriteEmpty {
+		return fail("schema update options need an append or truncate write disposition")
+	}
+	if spec.HivePartitioning != nil && spec.HivePartitioning.SourceURIPrefix == "" {
+		return fail("hive partitioning needs a SourceURIPrefix")
+	}
+
+	return nil
+}
+
+// format returns the source format defaulting to Parquet
+func (spec LoadSpec) format() bigquery.DataFormat {
+	if spec.Format == "" {
+		return bigquery.Parquet
+	}
+	return spec.Format
+}
+
+// Loader returns a loader of the spec into a table (or a partition decorated one)
+func (spec LoadSpec) Loader(t *bigquery.Table) *bigquery.Loader {
+	gcsO := bigquery.NewGCSReference(spec.URIs...)
+	gcsO.SourceFormat = spec.format()
+	gcsO.Compression = spec.Compression
+	gcsO.Schema = spec.Schema
+	gcsO.AutoDetect = spec.AutoDetect
+	gcsO.MaxBadRecords = spec.MaxBadRecords
+	gcsO.IgnoreUnknownValues = spec.IgnoreUnknownValues
+	if spec.CSV != nil {
+		gcsO.CSVOptions = *spec.CSV
+	}
+
+	loader := t.LoaderFrom(gcsO)
+	loader.WriteDisposition = spec.WriteDisposition
+	if loader.WriteDisposition == "" {
+		loader.WriteDisposition = bigquery.WriteAppend
+	}
+	loader.CreateDisposition = spec.CreateDisposition
+	if loader.CreateDisposition == "" {
+		loader.CreateDisposition = bigquery.CreateNever
+	}
+	loader.TimePartitioning = spec.TimePartitioning
+	loader.RangePartitioning = spec.RangePartitioning
+	loader.Clustering = spec.Clustering
+	loader.SchemaUpdateOptions = spec.SchemaUpdateOptions
+	loader.UseAvroLogicalTypes = spec.UseAvroLogicalTypes
+	loader.DecimalTargetTypes = spec.DecimalTargetTypes
+	loader.HivePartitioningOptions = spec.HivePartitioning
+	loader.Labels = spec.Labels
+
+	return loader
+}
+
+// InsertFromGCSIntoBQWithSpec loads GCS objects described by spec into bqDataset.bqTable (which may be
+// partition decorated) and returns the statistics of the load job. A job that ran but failed is
+// reported as a *LoadError.
+func InsertFromGCSIntoBQWithSpec(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string, spec LoadSpec) (*bigquery.LoadStatistics, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	if spec.WriteDisposition == bigquery.WriteTruncate {
+		if err := autoSnapshot(ctx, bqClient, bqDataset, bqTable, "InsertFromGCSIntoBQ"); err != nil {
+			return nil, err
+		}
+	}
+
+	return loadFromGCS(ctx, bqClient, bqDataset, bqTable, spec)
+}
+
+// loadFromGCS runs and waits for the load job of a validated spec
+func loadFromGCS(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string, spec LoadSpec) (*bigquery.LoadStatistics, error) {
+
+	src := strings.Join(spec.URIs, ", ")
+	job, err := spec.Loader(bqClient.Dataset(bqDataset).Table(bqTable)).Run(ctx)
+	if err != nil {
+		return nil, bu.TError{
+			Msg:    fmt.Sprintf("could not load data into %v.%v from %v", bqDataset, bqTable, src),
+			Origin: "InsertFromGCSIntoBQ",
+			Code:   bu.ErrGCS,
+			Err:    err,
+		}
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return nil, bu.TError{
+			Msg:    fmt.Sprintf("loading into %v.%v from %v failed", bqDataset, bqTable, src),
+			Origin: "InsertFromGCSIntoBQ",
+			Code:   bu.ErrLoadGCS,
+			Err:    err,
+		}
+	}
+	if status.Err() != nil {
+		return nil, newLoadError(job, status, bqDataset, bqTable, spec.URIs)
+	}
+
+	var stats *bigquery.LoadStatistics
+	if status.Statistics != nil {
+		stats, _ = status.Statistics.Details.(*bigquery.LoadStatistics)
+	}
+	return stats, nil
+}
@@ -0,0 +1,46 @@
+package bqtools
+
+import (
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestLoadSpecValidate(t *testing.T) {
+	uris := []string{"gs://bucket/data/*.parquet"}
+
+	tests := []struct {
+		name    string
+		spec    LoadSpec
+		wantErr bool
+	}{
+		{"defaults", LoadSpec{URIs: uris}, false},
+		{"no URIs", LoadSpec{}, true},
+		{"not GCS", LoadSpec{URIs: []string{"s3://bucket/data"}}, true},
+		{"two wildcards", LoadSpec{URIs: []string{"gs://bucket/*/part-*"}}, true},
+		{"unknown format", LoadSpec{URIs: uris, Format: "XML"}, true},
+		{"CSV options for parquet", LoadSpec{URIs: uris, CSV: &bigquery.CSVOptions{}}, true},
+		{"CSV", LoadSpec{URIs: uris, Format: bigquery.CSV, CSV: &bigquery.CSVOptions{SkipLeadingRows: 1},
+			Compression: bigquery.Gzip}, false},
+		{"compressed avro", LoadSpec{URIs: uris, Format: bigquery.Avro, Compression: bigquery.Gzip}, true},
+		{"uncompressed avro", LoadSpec{URIs: uris, Format: bigquery.Avro, Compression: bigquery.None}, false},
+		{"creating from JSON without a schema", LoadSpec{URIs: uris, Format: bigquery.JSON, CreateDisposition: bigquery.CreateIfNeeded}, true},
+		{"creating from JSON with auto detection", LoadSpec{URIs: uris, Format: bigquery.JSON, CreateDisposition: bigquery.CreateIfNeeded,
+			AutoDetect: true}, false},
+		{"creating from parquet", LoadSpec{URIs: uris, CreateDisposition: bigquery.CreateIfNeeded}, false},
+		{"schema update options", LoadSpec{URIs: uris, SchemaUpdateOptions: []string{AllowFieldAddition, AllowFieldRelaxation}}, false},
+		{"unknown schema update option", LoadSpec{URIs: uris, SchemaUpdateOptions: []string{"ALLOW_ANYTHING"}}, true},
+		{"schema update options on an empty table", LoadSpec{URIs: uris, WriteDisposition: bigquery.WriteEmpty,
+			SchemaUpdateOptions: []string{AllowFieldAddition}}, true},
+		{"hive partitioning without a prefix", LoadSpec{URIs: uris, HivePartitioning: &bigquery.HivePartitioningOptions{}}, true},
+		{"hive partitioning", LoadSpec{URIs: uris, HivePartitioning: &bigquery.HivePartitioningOptions{SourceURIPrefix: "gs://bucket/data"}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.spec.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
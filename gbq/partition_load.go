@@ -0,0 +1,129 @@
+package bqtools
+
+import (
+	"fmt"
+
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/net/context"
+
+	bu "github.com/belboo/boo-go-tools/misc"
+)
+
+// PartitionLoad is the result of ReplacePartitionFromGCS
+type PartitionLoad struct {
+	Partition Partition
+	JobID     string
+	Stats     *bigquery.LoadStatistics
+	Rows      int64 // rows found in the partition after the load
+}
+
+// ReplacePartitionFromGCS atomically replaces a partition (anything PartitionFor accepts) of bqDataset.bqTable
+// with the content of a Parquet object by loading it into the partition decorator with WRITE_TRUNCATE:
+// until the load succeeds the old data stays in place. Rows falling outside the partition fail the load
+// (with a *LoadError) and the partition is checked to hold exactly the loaded rows afterwards.
+func ReplacePartitionFromGCS(ctx context.Context, bqClient *bigquery.Client, gcsBucket string, gcsObject string,
+	bqDataset string, bqTable string, partition interface{}) (*PartitionLoad, error) {
+
+	tMeta, err := getTableMeta(ctx, bqClient, bqDataset, bqTable, "ReplacePartitionFromGCS")
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := PartitionFor(tMeta, partition)
+	if err != nil {
+		return nil, err
+	}
+	if p.IsSpecial() {
+		return nil, bu.TError{
+			Msg:    fmt.Sprintf("partition %v of %v.%v cannot be replaced", p, bqDataset, bqTable),
+			Origin: "ReplacePartitionFromGCS",
+			Code:   bu.ErrConfigError,
+			Err:    nil,
+		}
+	}
+	if err := autoSnapshot(ctx, bqClient, bqDataset, bqTable, "ReplacePartitionFromGCS"); err != nil {
+		return nil, err
+	}
+
+	gcsO := bigquery.NewGCSReference("gs://" + gcsBucket + "/" + gcsObject)
+	gcsO.SourceFormat = bigquery.Parquet
+	loader := bqClient.Dataset(bqDataset).Table(p.Decorator(bqTable)).LoaderFrom(gcsO)
+	loader.CreateDisposition = bigquery.CreateNever
+	loader.WriteDisposition = bigquery.WriteTruncate
+
+	job, err := loader.Run(ctx)
+	if err != nil {
+		return nil, bu.TError{
+			Msg:    fmt.Sprintf("could not load data into %v.%v from %v/%v", bqDataset, p.Decorator(bqTable), gcsBucket, gcsObject),
+			Origin: "ReplacePartitionFromGCS",
+			Code:   bu.ErrGCS,
+			Err:    err,
+		}
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return nil, bu.TError{
+			Msg:    fmt.Sprintf("loading into %v.%v from %v/%v failed", bqDataset, p.Decorator(bqTable), gcsBucket, gcsObject),
+			Origin: "ReplacePartitionFromGCS",
+			Code:   bu.ErrLoadGCS,
+			Err:    err,
+		}
+	}
+	if status.Err() != nil {
+		return nil, newLoadError(job, status, bqDataset, p.Decorator(bqTable), []string{gcsO.URIs[0]})
+	}
+
+	res := &PartitionLoad{Partition: p, JobID: job.ID()}
+	if status.Statistics != nil {
+		res.Stats, _ = status.Statistics.Details.(*bigquery.LoadStatistics)
+	}
+
+	if res.Rows, err = countPartitionRows(ctx, bqClient, bqDataset, bqTable, tMeta, p); err != nil {
+		return res, err
+	}
+	if res.Stats != nil && res.Rows != res.Stats.OutputRows {
+		return res, bu.TError{
+			Msg:    fmt.Sprintf("loaded %v rows into %v.%v but the partition holds %v", res.Stats.OutputRows, bqDataset, p.Decorator(bqTable), res.Rows),
+			Origin: "ReplacePartitionFromGCS",
+			Code:   bu.ErrLoadGCS,
+			Err:    nil,
+		}
+	}
+
+	return res, nil
+}
+
+// countPartitionRows counts the rows of a single partition with a query BigQuery can prune
+func countPartitionRows(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string, tMeta *bigquery.TableMetadata, p Partition) (int64, error) {
+	cond, params, err := partitionSQL(tMeta, "t", p)
+	if err != nil {
+		return 0, err
+	}
+
+	sql := fmt.Sprintf("SELECT COUNT(*) AS n FROM `%v`.`%v` AS t WHERE %v", bqDataset, bqTable, cond)
+	row, err := readStatsRow(ctx, bqClient, sql, params, 0, "countPartitionRows")
+	if err != nil {
+		return 0, err
+	}
+	n, _ := row["n"].(int64)
+	return n, nil
+}
+
+// partitionSQL is a condition (with @pfrom and @pto parameters) selecting the rows of a single
+// time or integer range partition of a table aliased as alias
+func partitionSQL(tMeta *bigquery.TableMetadata, alias string, p Partition) (string, []bigquery.QueryParameter, error) {
+	if p.Type == PartitionIntegerRange {
+		_, field := TablePartitioning(tMeta)
+		cond := fmt.Sprintf("%[1]v.`%[2]v` >= @pfrom AND %[1]v.`%[2]v` < @pto", alias, field)
+		return cond, []bigquery.QueryParameter{
+			{Name: "pfrom", Value: p.RangeStart},
+			{Name: "pto", Value: p.RangeStart + tMeta.RangePartitioning.Range.Interval},
+		}, nil
+	}
+
+	cond, err := partitionRangeSQL(tMeta, alias, "pfrom", "pto", p.Time, p.End())
+	if err != nil {
+		return "", nil, err
+	}
+	return cond, []bigquery.QueryParameter{{Name: "pfrom", Value: p.Time}, {Name: "pto", Value: p.End()}}, nil
+}
@@ -0,0 +1,64 @@
+package bqtools
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestPartitionSQL(t *testing.T) {
+	day := time.Date(2019, 5, 28, 0, 0, 0, 0, time.UTC)
+	hour := time.Date(2019, 5, 28, 14, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		tMeta      *bigquery.TableMetadata
+		p          Partition
+		want       string
+		wantParams []interface{}
+		wantErr    bool
+	}{
+		{"ingestion time",
+			&bigquery.TableMetadata{Name: "t", TimePartitioning: &bigquery.TimePartitioning{Type: bigquery.DayPartitioningType}},
+			NewTimePartition(PartitionDay, day),
+			"t._PARTITIONTIME >= @pfrom AND t._PARTITIONTIME < @pto", []interface{}{day, day.AddDate(0, 0, 1)}, false},
+		{"date column by month",
+			&bigquery.TableMetadata{Name: "t", TimePartitioning: &bigquery.TimePartitioning{Type: bigquery.MonthPartitioningType, Field: "day"},
+				Schema: bigquery.Schema{field("day", bigquery.DateFieldType)}},
+			NewTimePartition(PartitionMonth, day),
+			"t.`day` >= DATE(@pfrom) AND t.`day` < DATE(@pto)",
+			[]interface{}{time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC), time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)}, false},
+		{"timestamp column by hour",
+			&bigquery.TableMetadata{Name: "t", TimePartitioning: &bigquery.TimePartitioning{Type: bigquery.HourPartitioningType, Field: "ts"},
+				Schema: bigquery.Schema{field("ts", bigquery.TimestampFieldType)}},
+			NewTimePartition(PartitionHour, hour),
+			"t.`ts` >= @pfrom AND t.`ts` < @pto", []interface{}{hour, hour.Add(time.Hour)}, false},
+		{"integer range",
+			&bigquery.TableMetadata{Name: "t", RangePartitioning: &bigquery.RangePartitioning{Field: "id",
+				Range: &bigquery.RangePartitioningRange{Start: 0, End: 1000, Interval: 10}}},
+			NewRangePartition(40),
+			"t.`id` >= @pfrom AND t.`id` < @pto", []interface{}{int64(40), int64(50)}, false},
+		{"unpartitioned", &bigquery.TableMetadata{Name: "t"}, NewTimePartition(PartitionDay, day), "", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, params, err := partitionSQL(tt.tMeta, "t", tt.p)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("partitionSQL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("partitionSQL() = %q, want %q", got, tt.want)
+			}
+			var values []interface{}
+			for _, p := range params {
+				values = append(values, p.Value)
+			}
+			if !reflect.DeepEqual(values, tt.wantParams) {
+				t.Errorf("partitionSQL() params = %v, want %v", values, tt.wantParams)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package bqtools
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/gammazero/workerpool"
+	"golang.org/x/net/context"
+
+	bu "github.com/belboo/boo-go-tools/misc"
+)
+
+// SyncOptions tunes SyncPartitions
+type SyncOptions struct {
+	// From and To restrict time partitioned tables to partitions starting in [From, To), zero bounds are open
+	From time.Time
+	To   time.Time
+
+	// A partition present on both sides is stale if the row counts differ (CompareRows)
+	// or the source one was modified after the destination one (CompareLastModified)
+	CompareRows         bool
+	CompareLastModified bool
+
+	SkipEmpty   bool // leave out source partitions without rows
+	Concurrency int  // copy jobs in flight, defaults to 4
+	DryRun      bool // only find what needs syncing
+
+	Logger *bu.TLogger
+}
+
+// SyncReport is the result of SyncPartitions
+type SyncReport struct {
+	Missing []Partition // in the source only
+	Stale   []Partition // in both but out of date in the destination
+	Extra   []Partition // in the destination only, left alone
+
+	Copied []Partition
+	Errors []error
+	DryRun bool
+}
+
+// SyncPartitions brings the partitions of dstDataset.dstTable in line with srcDataset.srcTable by copying
+// the missing and stale ones with partition decorated copy jobs (WRITE_TRUNCATE, so every copy is atomic).
+// Both tables must be partitioned the same way and have the same columns (descriptions and policy tags
+// aside), partition copies do not evolve schemas. Failed copies are listed in the report's Errors.
+func SyncPartitions(ctx context.Context, bqClient *bigquery.Client, srcDataset string, srcTable string,
+	dstDataset string, dstTable string, opts SyncOptions) (*SyncReport, error) {
+
+	srcMeta, err := getTableMeta(ctx, bqClient, srcDataset, srcTable, "SyncPartitions")
+	if err != nil {
+		return nil, err
+	}
+	dstMeta, err := getTableMeta(ctx, bqClient, dstDataset, dstTable, "SyncPartitions")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkPartitioningCompatible(srcMeta, dstMeta); err != nil {
+		return nil, err
+	}
+	changes := SchemaDiff(dstMeta.Schema, srcMeta.Schema).OfKind(FieldAdded, FieldRemoved, FieldRetyped, FieldModeChanged, FieldReordered)
+	if changes.HasChanges() {
+		return nil, bu.TError{
+			Msg:    fmt.Sprintf("schemas of %v.%v and %v.%v differ:\n%v", dstDataset, dstTable, srcDataset, srcTable, changes),
+			Origin: "SyncPartitions",
+			Code:   bu.ErrSchemaMismatch,
+			Err:    nil,
+		}
+	}
+
+	listOpts := PartitionListOptions{Method: PartitionsFromInformationSchema, SkipSpecial: true}
+	srcParts, err := GetBQTablePartitionsWithOptions(ctx, bqClient, srcDataset, srcTable, listOpts)
+	if err != nil {
+		return nil, err
+	}
+	dstParts, err := GetBQTablePartitionsWithOptions(ctx, bqClient, dstDataset, dstTable, listOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	report := planSync(srcParts, dstParts, opts)
+	if opts.Logger != nil {
+		opts.Logger.Logf("SyncPartitions %v.%v -> %v.%v: %v missing, %v stale, %v extra\n",
+			srcDataset, srcTable, dstDataset, dstTable, len(report.Missing), len(report.Stale), len(report.Extra))
+	}
+	if opts.DryRun {
+		return report, nil
+	}
+	if len(report.Stale) > 0 {
+		if err := autoSnapshot(ctx, bqClient, dstDataset, dstTable, "SyncPartitions"); err != nil {
+			return report, err
+		}
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+
+	var mu sync.Mutex
+	wp := workerpool.New(concurrency)
+	for _, p := range append(append([]Partition{}, report.Missing...), report.Stale...) {
+		p := p
+		wp.Submit(func() {
+			err := copyPartition(ctx, bqClient, srcDataset, srcTable, dstDataset, dstTable, p)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				report.Errors = append(report.Errors, err)
+				return
+			}
+			report.Copied = append(report.Copied, p)
+			if opts.Logger != nil {
+				opts.Logger.Logf("SyncPartitions: copied %v\n", p.Decorator(srcTable))
+			}
+		})
+	}
+	wp.StopWait()
+
+	sort.Slice(report.Copied, func(i, j int) bool { return report.Copied[i].ID < report.Copied[j].ID })
+
+	return report, nil
+}
+
+// planSync sorts the source partitions into missing and stale ones
+func planSync(srcParts []Partition, dstParts []Partition, opts SyncOptions) *SyncReport {
+	report := &SyncReport{
+		Missing: make([]Partition, 0),
+		Stale:   make([]Partition, 0),
+		Extra:   make([]Partition, 0),
+		Copied:  make([]Partition, 0),
+		Errors:  make([]error, 0),
+		DryRun:  opts.DryRun,
+	}
+
+	inRange := func(p Partition) bool {
+		if p.Type == PartitionIntegerRange {
+			return true
+		}
+		return (opts.From.IsZero() || !p.Time.Before(opts.From)) && (opts.To.IsZero() || p.Time.Before(opts.To))
+	}
+
+	dstIdx := make(map[string]Partition, len(dstParts))
+	for _, p := range dstParts {
+		dstIdx[p.ID] = p
+	}
+	srcIdx := make(map[string]bool, len(srcParts))
+
+	for _, sp := range srcParts {
+		srcIdx[sp.ID] = true
+		if !inRange(sp) || (opts.SkipEmpty && sp.Rows == 0) {
+			continue
+		}
+		dp, ok := dstIdx[sp.ID]
+		switch {
+		case !ok:
+			report.Missing = append(report.Missing, sp)
+		case opts.CompareRows && sp.Rows >= 0 && sp.Rows != dp.Rows:
+			report.Stale = append(report.Stale, sp)
+		case opts.CompareLastModified && sp.LastModified.After(dp.LastModified):
+			report.Stale = append(report.Stale, sp)
+		}
+	}
+
+	for _, dp := range dstParts {
+		if !srcIdx[dp.ID] && inRange(dp) {
+			report.Extra = append(report.Extra, dp)
+		}
+	}
+
+	return report
+}
+
+// checkPartitioningCompatible makes sure partitions of src can be copied into the same partitions of dst
+func checkPartitioningCompatible(srcMeta *bigquery.TableMetadata, dstMeta *bigquery.TableMetadata) error {
+	srcType, srcField := TablePartitioning(srcMeta)
+	dstType, dstField := TablePartitioning(dstMeta)
+
+	switch {
+	case srcType == PartitionNone || dstType == PartitionNone:
+		return bu.TError{
+			Msg:    fmt.Sprintf("both %v and %v must be partitioned", srcMeta.Name, dstMeta.Name),
+			Origin: "SyncPartitions",
+			Code:   bu.ErrTableNotPartitioned,
+			Err:    nil,
+		}
+	case srcType != dstType:
+		return bu.TError{
+			Msg:    fmt.Sprintf("%v is partitioned by %v and %v by %v", srcMeta.Name, srcType, dstMeta.Name, dstType),
+			Origin: "SyncPartitions",
+			Code:   bu.ErrMetaMismatch,
+			Err:    nil,
+		}
+	case !strings.EqualFold(srcField, dstField):
+		return bu.TError{
+			Msg:    fmt.Sprintf("%v is partitioned on %q and %v on %q", srcMeta.Name, srcField, dstMeta.Name, dstField),
+			Origin: "SyncPartitions",
+			Code:   bu.ErrMetaMismatch,
+			Err:    nil,
+		}
+	case srcType == PartitionIntegerRange && !sameRange(srcMeta.RangePartitioning.Range, dstMeta.RangePartitioning.Range):
+		return bu.TError{
+			Msg:    fmt.Sprintf("%v and %v have different integer partition ranges", srcMeta.Name, dstMeta.Name),
+			Origin: "SyncPartitions",
+			Code:   bu.ErrMetaMismatch,
+			Err:    nil,
+		}
+	}
+	return nil
+}
+
+// sameRange compares integer partition ranges, a missing range only matches another missing one
+func sameRange(a *bigquery.RangePartitioningRange, b *bigquery.RangePartitioningRange) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// copyPartition replaces a destination partition with the same source one
+func copyPartition(ctx context.Context, bqClient *bigquery.Client, srcDataset string, srcTable string,
+	dstDataset string, dstTable string, p Partition) error {
+
+	src := bqClient.Dataset(srcDataset).Table(p.Decorator(srcTable))
+	copier := bqClient.Dataset(dstDataset).Table(p.Decorator(dstTable)).CopierFrom(src)
+	copier.CreateDisposition = bigquery.CreateNever
+	copier.WriteDisposition = bigquery.WriteTruncate
+
+	job, err := copier.Run(ctx)
+	if err == nil {
+		var status *bigquery.JobStatus
+		if status, err = job.Wait(ctx); err == nil {
+			err = status.Err()
+		}
+	}
+	if err != nil {
+		return bu.TError{
+			Msg:    fmt.Sprintf("failed to copy %v.%v to %v.%v", srcDataset, p.Decorator(srcTable), dstDataset, p.Decorator(dstTable)),
+			Origin: "SyncPartitions",
+			Code:   bu.ErrAPI,
+			Err:    err,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package bqtools
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestPlanSync(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2019, 5, d, 0, 0, 0, 0, time.UTC) }
+	part := func(d int, rows int64, modified int) Partition {
+		p := NewTimePartition(PartitionDay, day(d))
+		p.Rows = rows
+		p.LastModified = day(modified)
+		return p
+	}
+
+	src := []Partition{part(1, 10, 1), part(2, 10, 5), part(3, 0, 3), part(4, 7, 4), part(5, -1, 9)}
+	dst := []Partition{part(1, 10, 2), part(2, 10, 2), part(4, 8, 4), part(5, 3, 5), part(6, 1, 6)}
+
+	tests := []struct {
+		name        string
+		opts        SyncOptions
+		wantMissing []string
+		wantStale   []string
+		wantExtra   []string
+	}{
+		{"presence only", SyncOptions{}, []string{"20190503"}, nil, []string{"20190506"}},
+		{"rows", SyncOptions{CompareRows: true}, []string{"20190503"}, []string{"20190504"}, []string{"20190506"}},
+		{"last modified", SyncOptions{CompareLastModified: true}, []string{"20190503"}, []string{"20190502", "20190505"},
+			[]string{"20190506"}},
+		{"skip empty", SyncOptions{SkipEmpty: true}, nil, nil, []string{"20190506"}},
+		{"range", SyncOptions{CompareRows: true, From: day(2), To: day(4)}, []string{"20190503"}, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := planSync(src, dst, tt.opts)
+			for _, c := range []struct {
+				kind string
+				got  []Partition
+				want []string
+			}{{"Missing", report.Missing, tt.wantMissing}, {"Stale", report.Stale, tt.wantStale}, {"Extra", report.Extra, tt.wantExtra}} {
+				if got := partitionIDs(c.got); !equalStrings(got, c.want) {
+					t.Errorf("%v = %v, want %v", c.kind, got, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckPartitioningCompatible(t *testing.T) {
+	daily := &bigquery.TableMetadata{Name: "a", TimePartitioning: &bigquery.TimePartitioning{Field: "day"}}
+	monthly := &bigquery.TableMetadata{Name: "b", TimePartitioning: &bigquery.TimePartitioning{Type: bigquery.MonthPartitioningType, Field: "day"}}
+	ranged := func(r *bigquery.RangePartitioningRange) *bigquery.TableMetadata {
+		return &bigquery.TableMetadata{Name: "r", RangePartitioning: &bigquery.RangePartitioning{Field: "id", Range: r}}
+	}
+	r := &bigquery.RangePartitioningRange{Start: 0, End: 100, Interval: 10}
+
+	tests := []struct {
+		name     string
+		src, dst *bigquery.TableMetadata
+		wantErr  bool
+	}{
+		{"same", daily, &bigquery.TableMetadata{Name: "c", TimePartitioning: &bigquery.TimePartitioning{Field: "DAY"}}, false},
+		{"unpartitioned", daily, &bigquery.TableMetadata{Name: "c"}, true},
+		{"other type", daily, monthly, true},
+		{"other field", daily, &bigquery.TableMetadata{Name: "c", TimePartitioning: &bigquery.TimePartitioning{}}, true},
+		{"same range", ranged(r), ranged(&bigquery.RangePartitioningRange{Start: 0, End: 100, Interval: 10}), false},
+		{"other range", ranged(r), ranged(&bigquery.RangePartitioningRange{Start: 0, End: 100, Interval: 5}), true},
+		{"missing range", ranged(r), ranged(nil), true},
+		{"both ranges missing", ranged(nil), ranged(nil), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkPartitioningCompatible(tt.src, tt.dst); (err != nil) != tt.wantErr {
+				t.Errorf("checkPartitioningCompatible() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func partitionIDs(parts []Partition) []string {
+	ids := make([]string, len(parts))
+	for i, p := range parts {
+		ids[i] = p.ID
+	}
+	return ids
+}
+
+// equalStrings compares slices treating nil and empty alike
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
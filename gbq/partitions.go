@@ -0,0 +1,392 @@
+package bqtools
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/net/context"
+	"google.golang.org/api/iterator"
+
+	bu "github.com/belboo/boo-go-tools/misc"
+)
+
+// Special partition ids BigQuery uses besides the time and range ones
+const (
+	NullPartitionID          = "__NULL__"
+	UnpartitionedPartitionID = "__UNPARTITIONED__"
+)
+
+// Partition identifies a single partition of a time or integer range partitioned table
+type Partition struct {
+	ID   string // decorator suffix, e.g. "2019052814", "20190528", "201905", "2019", "1000" or NullPartitionID
+	Type PartitionType
+
+	Time       time.Time // start of a time partition (UTC)
+	RangeStart int64     // start of an integer range partition
+
+	// Filled in by partition listings, -1 or zero when the listing method cannot tell
+	Rows         int64
+	LogicalBytes int64
+	LastModified time.Time
+}
+
+// String implemented to print partitions by their ids
+func (p Partition) String() string {
+	return p.ID
+}
+
+// Decorator returns the partition decorated table name, e.g. "events$20190528"
+func (p Partition) Decorator(bqTable string) string {
+	return bqTable + "$" + p.ID
+}
+
+// IsSpecial tells if p is the __NULL__ or __UNPARTITIONED__ partition
+func (p Partition) IsSpecial() bool {
+	return p.ID == NullPartitionID || p.ID == UnpartitionedPartitionID
+}
+
+// End returns the (exclusive) end of a time partition
+func (p Partition) End() time.Time {
+	switch p.Type {
+	case PartitionHour:
+		return p.Time.Add(time.Hour)
+	case PartitionDay:
+		return p.Time.AddDate(0, 0, 1)
+	case PartitionMonth:
+		return p.Time.AddDate(0, 1, 0)
+	case PartitionYear:
+		return p.Time.AddDate(1, 0, 0)
+	}
+	return p.Time
+}
+
+// partitionLayout is the decorator time layout of a time partitioning type
+func partitionLayout(pt PartitionType) string {
+	switch pt {
+	case PartitionHour:
+		return "2006010215"
+	case PartitionDay:
+		return "20060102"
+	case PartitionMonth:
+		return "200601"
+	case PartitionYear:
+		return "2006"
+	}
+	return ""
+}
+
+// partitionSQLFormat is the FORMAT_TIMESTAMP equivalent of partitionLayout
+func partitionSQLFormat(pt PartitionType) string {
+	switch pt {
+	case PartitionHour:
+		return "%Y%m%d%H"
+	case PartitionDay:
+		return "%Y%m%d"
+	case PartitionMonth:
+		return "%Y%m"
+	case PartitionYear:
+		return "%Y"
+	}
+	return ""
+}
+
+// NewTimePartition returns the partition of type pt containing t
+func NewTimePartition(pt PartitionType, t time.Time) Partition {
+	t = t.UTC()
+	switch pt {
+	case PartitionHour:
+		t = t.Truncate(time.Hour)
+	case PartitionDay:
+		t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	case PartitionMonth:
+		t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	case PartitionYear:
+		t = time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return Partition{ID: t.Format(partitionLayout(pt)), Type: pt, Time: t}
+}
+
+// NewRangePartition returns the integer range partition starting at start
+func NewRangePartition(start int64) Partition {
+	return Partition{ID: strconv.FormatInt(start, 10), Type: PartitionIntegerRange, RangeStart: start}
+}
+
+// ParsePartitionID parses a decorator suffix of a table partitioned by pt
+func ParsePartitionID(pt PartitionType, id string) (Partition, error) {
+	if id == NullPartitionID || id == UnpartitionedPartitionID {
+		return Partition{ID: id, Type: pt}, nil
+	}
+
+	if pt == PartitionIntegerRange {
+		start, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return Partition{}, bu.TError{
+				Msg:    fmt.Sprintf("invalid integer range partition id %v", id),
+				Origin: "ParsePartitionID",
+				Code:   bu.ErrParse,
+				Err:    err,
+			}
+		}
+		return NewRangePartition(start), nil
+	}
+
+	layout := partitionLayout(pt)
+	if layout == "" || len(id) != len(layout) {
+		return Partition{}, bu.TError{
+			Msg:    fmt.Sprintf("invalid partition id %v for %q partitioning", id, pt),
+			Origin: "ParsePartitionID",
+			Code:   bu.ErrParse,
+			Err:    nil,
+		}
+	}
+	t, err := time.Parse(layout, id)
+	if err != nil {
+		return Partition{}, bu.TError{
+			Msg:    fmt.Sprintf("invalid partition id %v for %q partitioning", id, pt),
+			Origin: "ParsePartitionID",
+			Code:   bu.ErrParse,
+			Err:    err,
+		}
+	}
+	return Partition{ID: id, Type: pt, Time: t}, nil
+}
+
+// TablePartitioning returns the partitioning type and column of a table ("" column for ingestion time)
+func TablePartitioning(tMeta *bigquery.TableMetadata) (PartitionType, string) {
+	switch {
+	case tMeta.TimePartitioning != nil:
+		pt := PartitionType(tMeta.TimePartitioning.Type)
+		if pt == "" {
+			pt = PartitionDay
+		}
+		return pt, tMeta.TimePartitioning.Field
+	case tMeta.RangePartitioning != nil:
+		return PartitionIntegerRange, tMeta.RangePartitioning.Field
+	}
+	return PartitionNone, ""
+}
+
+// PartitionFor converts a partition specification into a Partition of a table with the given metadata.
+// Accepted are a Partition, a decorator id string, a time.Time (time partitioning) or an integer
+// value falling into a range partition.
+func PartitionFor(tMeta *bigquery.TableMetadata, partition interface{}) (Partition, error) {
+	pt, _ := TablePartitioning(tMeta)
+	if pt == PartitionNone {
+		return Partition{}, bu.TError{
+			Msg:    fmt.Sprintf("table %v is not partitioned", tMeta.Name),
+			Origin: "PartitionFor",
+			Code:   bu.ErrTableNotPartitioned,
+			Err:    nil,
+		}
+	}
+
+	switch p := partition.(type) {
+	case Partition:
+		if p.Type != pt {
+			return ParsePartitionID(pt, p.ID)
+		}
+		return p, nil
+	case string:
+		return ParsePartitionID(pt, p)
+	case time.Time:
+		if pt != PartitionIntegerRange {
+			return NewTimePartition(pt, p), nil
+		}
+	case int, int32, int64:
+		if pt == PartitionIntegerRange {
+			v := toInt64(p)
+			r := tMeta.RangePartitioning.Range
+			if r == nil || v < r.Start || v >= r.End {
+				return Partition{ID: UnpartitionedPartitionID, Type: pt}, nil
+			}
+			return NewRangePartition(r.Start + (v-r.Start)/r.Interval*r.Interval), nil
+		}
+	}
+
+	return Partition{}, bu.TError{
+		Msg:    fmt.Sprintf("invalid partition specification [%v] for %q partitioning", partition, pt),
+		Origin: "PartitionFor",
+		Code:   bu.ErrGeneric,
+		Err:    nil,
+	}
+}
+
+// toInt64 widens the integer kinds PartitionFor accepts
+func toInt64(v interface{}) int64 {
+	switch i := v.(type) {
+	case int:
+		return int64(i)
+	case int32:
+		return int64(i)
+	case int64:
+		return i
+	}
+	return 0
+}
+
+// PartitionTimes returns the start times of time partitions, e.g. to use with DateSetDiff
+func PartitionTimes(partitions []Partition) []time.Time {
+	times := make([]time.Time, 0, len(partitions))
+	for _, p := range partitions {
+		if p.Type != PartitionIntegerRange && !p.IsSpecial() {
+			times = append(times, p.Time)
+		}
+	}
+	return times
+}
+
+// partitionKeySQL is an SQL expression computing the partition id of every row
+func partitionKeySQL(tMeta *bigquery.TableMetadata) string {
+	pt, field := TablePartitioning(tMeta)
+
+	if pt == PartitionIntegerRange {
+		r := tMeta.RangePartitioning.Range
+		return fmt.Sprintf(
+			"CASE WHEN `%[1]v` IS NULL THEN '%[2]v' "+
+				"WHEN `%[1]v` < %[3]v OR `%[1]v` >= %[4]v THEN '%[5]v' "+
+				"ELSE CAST(%[3]v + DIV(`%[1]v` - %[3]v, %[6]v) * %[6]v AS STRING) END",
+			field, NullPartitionID, r.Start, r.End, UnpartitionedPartitionID, r.Interval)
+	}
+
+	missing := NullPartitionID
+	if field == "" {
+		field = "_PARTITIONTIME"
+		missing = UnpartitionedPartitionID
+	}
+	return fmt.Sprintf("IFNULL(FORMAT_TIMESTAMP('%v', TIMESTAMP(`%v`)), '%v')", partitionSQLFormat(pt), field, missing)
+}
+
+// PartitionListMethod selects how GetBQTablePartitionsWithOptions finds partitions
+type PartitionListMethod int
+
+// PartitionListMethod ENUM values
+const (
+	// PartitionsFromInformationSchema reads INFORMATION_SCHEMA.PARTITIONS, cheap and exact
+	PartitionsFromInformationSchema PartitionListMethod = iota
+	// PartitionsFromSummary reads the legacy $__PARTITIONS_SUMMARY__ meta table (no row counts or sizes)
+	PartitionsFromSummary
+	// PartitionsFromScan groups the whole table by partition, expensive on large tables
+	PartitionsFromScan
+)
+
+// PartitionListOptions tunes GetBQTablePartitionsWithOptions
+type PartitionListOptions struct {
+	Method PartitionListMethod
+	// SkipSpecial leaves out the __NULL__ and __UNPARTITIONED__ partitions
+	SkipSpecial bool
+}
+
+// GetBQTablePartitionsWithOptions lists the partitions of a BQ table ordered by id
+func GetBQTablePartitionsWithOptions(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string, opts PartitionListOptions) ([]Partition, error) {
+	tMeta, err := getTableMeta(ctx, bqClient, bqDataset, bqTable, "GetBQTablePartitions")
+	if err != nil {
+		return nil, err
+	}
+
+	pt, _ := TablePartitioning(tMeta)
+	if pt == PartitionNone {
+		return nil, bu.TError{
+			Msg:    fmt.Sprintf("table %v.%v is not partitioned", bqDataset, bqTable),
+			Origin: "GetBQTablePartitions",
+			Code:   bu.ErrTableNotPartitioned,
+			Err:    nil,
+		}
+	}
+
+	var qry *bigquery.Query
+	switch opts.Method {
+	case PartitionsFromInformationSchema:
+		qry = bqClient.Query(fmt.Sprintf(
+			"SELECT partition_id AS p, total_rows AS n, total_logical_bytes AS b, last_modified_time AS m "+
+				"FROM `%v`.`%v`.INFORMATION_SCHEMA.PARTITIONS WHERE table_name = @table ORDER BY p",
+			bqClient.Project(), bqDataset))
+		qry.Parameters = []bigquery.QueryParameter{{Name: "table", Value: bqTable}}
+	case PartitionsFromSummary:
+		qry = bqClient.Query(fmt.Sprintf(
+			"SELECT partition_id AS p, last_modified_time AS m FROM [%v:%v.%v$__PARTITIONS_SUMMARY__] ORDER BY p",
+			bqClient.Project(), bqDataset, bqTable))
+		qry.UseLegacySQL = true
+	case PartitionsFromScan:
+		qry = bqClient.Query(fmt.Sprintf(
+			"SELECT p, COUNT(*) AS n "+
+				"FROM (SELECT %v AS p FROM `%v`.`%v`) GROUP BY p ORDER BY p",
+			partitionKeySQL(tMeta), bqDataset, bqTable))
+	default:
+		return nil, bu.TError{
+			Msg:    fmt.Sprintf("unknown partition listing method %v", opts.Method),
+			Origin: "GetBQTablePartitions",
+			Code:   bu.ErrConfigError,
+			Err:    nil,
+		}
+	}
+
+	it, err := readQuery(ctx, bqClient, qry, "GetBQTablePartitions")
+	if _, ok := err.(bu.TError); ok {
+		return nil, err
+	}
+	if err != nil {
+		return nil, bu.TError{
+			Msg:    fmt.Sprintf("query to %v.%v failed", bqDataset, bqTable),
+			Origin: "GetBQTablePartitions",
+			Code:   bu.ErrDataQuery,
+			Err:    err,
+		}
+	}
+
+	partitions := make([]Partition, 0, it.TotalRows)
+
+	for {
+		var row map[string]bigquery.Value
+		err := it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, bu.TError{
+				Msg:    fmt.Sprintf("query result from %v.%v is weird", bqDataset, bqTable),
+				Origin: "GetBQTablePartitions",
+				Code:   bu.ErrDataQuery,
+				Err:    err,
+			}
+		}
+
+		id, _ := row["p"].(string)
+		if id == "" {
+			continue
+		}
+		partition, err := ParsePartitionID(pt, id)
+		if err != nil {
+			return nil, bu.TError{
+				Msg:    fmt.Sprintf("couldn't parse partition returned from %v.%v", bqDataset, bqTable),
+				Origin: "GetBQTablePartitions",
+				Code:   bu.ErrGeneric,
+				Err:    err,
+			}
+		}
+		if opts.SkipSpecial && partition.IsSpecial() {
+			continue
+		}
+
+		partition.Rows = -1
+		partition.LogicalBytes = -1
+		if n, ok := row["n"].(int64); ok {
+			partition.Rows = n
+		}
+		if b, ok := row["b"].(int64); ok {
+			partition.LogicalBytes = b
+		}
+		switch m := row["m"].(type) {
+		case time.Time:
+			partition.LastModified = m
+		case int64:
+			// Legacy summary reports milliseconds since epoch
+			partition.LastModified = time.Unix(0, m*int64(time.Millisecond)).UTC()
+		}
+
+		partitions = append(partitions, partition)
+	}
+
+	return partitions, nil
+}
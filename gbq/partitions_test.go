@@ -0,0 +1,133 @@
+package bqtools
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestParsePartitionID(t *testing.T) {
+	tests := []struct {
+		pt      PartitionType
+		id      string
+		want    Partition
+		wantErr bool
+	}{
+		{PartitionHour, "2019052814", Partition{ID: "2019052814", Type: PartitionHour, Time: time.Date(2019, 5, 28, 14, 0, 0, 0, time.UTC)}, false},
+		{PartitionDay, "20190528", Partition{ID: "20190528", Type: PartitionDay, Time: time.Date(2019, 5, 28, 0, 0, 0, 0, time.UTC)}, false},
+		{PartitionMonth, "201905", Partition{ID: "201905", Type: PartitionMonth, Time: time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)}, false},
+		{PartitionYear, "2019", Partition{ID: "2019", Type: PartitionYear, Time: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)}, false},
+		{PartitionIntegerRange, "-1000", NewRangePartition(-1000), false},
+		{PartitionDay, NullPartitionID, Partition{ID: NullPartitionID, Type: PartitionDay}, false},
+		{PartitionIntegerRange, UnpartitionedPartitionID, Partition{ID: UnpartitionedPartitionID, Type: PartitionIntegerRange}, false},
+		{PartitionDay, "2019052", Partition{}, true},
+		{PartitionDay, "2019052814", Partition{}, true},
+		{PartitionDay, "20191332", Partition{}, true},
+		{PartitionMonth, "20190528", Partition{}, true},
+		{PartitionIntegerRange, "12a", Partition{}, true},
+		{PartitionNone, "20190528", Partition{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.pt)+"/"+tt.id, func(t *testing.T) {
+			got, err := ParsePartitionID(tt.pt, tt.id)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePartitionID() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got.ID != tt.want.ID || got.Type != tt.want.Type || !got.Time.Equal(tt.want.Time) || got.RangeStart != tt.want.RangeStart {
+				t.Errorf("ParsePartitionID() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewTimePartition(t *testing.T) {
+	ts := time.Date(2019, 5, 28, 14, 30, 0, 0, time.FixedZone("CEST", 2*3600))
+
+	tests := []struct {
+		pt      PartitionType
+		wantID  string
+		wantEnd time.Time
+	}{
+		{PartitionHour, "2019052812", time.Date(2019, 5, 28, 13, 0, 0, 0, time.UTC)},
+		{PartitionDay, "20190528", time.Date(2019, 5, 29, 0, 0, 0, 0, time.UTC)},
+		{PartitionMonth, "201905", time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{PartitionYear, "2019", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		p := NewTimePartition(tt.pt, ts)
+		if p.ID != tt.wantID || !p.End().Equal(tt.wantEnd) {
+			t.Errorf("NewTimePartition(%v) = %v ending %v, want %v ending %v", tt.pt, p.ID, p.End(), tt.wantID, tt.wantEnd)
+		}
+	}
+}
+
+func TestPartitionFor(t *testing.T) {
+	daily := &bigquery.TableMetadata{Name: "daily", TimePartitioning: &bigquery.TimePartitioning{Field: "day"}}
+	ranged := &bigquery.TableMetadata{Name: "ranged", RangePartitioning: &bigquery.RangePartitioning{
+		Field: "id", Range: &bigquery.RangePartitioningRange{Start: -100, End: 100, Interval: 30}}}
+	unpartitioned := &bigquery.TableMetadata{Name: "plain"}
+
+	tests := []struct {
+		name      string
+		tMeta     *bigquery.TableMetadata
+		partition interface{}
+		wantID    string
+		wantErr   bool
+	}{
+		{"time", daily, time.Date(2019, 5, 28, 23, 0, 0, 0, time.UTC), "20190528", false},
+		{"id", daily, "20190528", "20190528", false},
+		{"partition", daily, NewTimePartition(PartitionDay, time.Date(2019, 5, 28, 0, 0, 0, 0, time.UTC)), "20190528", false},
+		{"partition of another type", daily, Partition{ID: "20190528", Type: PartitionMonth}, "20190528", false},
+		{"invalid id", daily, "201905", "", true},
+		{"integer on time partitioning", daily, 5, "", true},
+		{"range", ranged, 15, "-10", false},
+		{"range start", ranged, int64(-100), "-100", false},
+		{"below the range", ranged, int32(-101), UnpartitionedPartitionID, false},
+		{"range end", ranged, 100, UnpartitionedPartitionID, false},
+		{"time on range partitioning", ranged, time.Now(), "", true},
+		{"unpartitioned", unpartitioned, "20190528", "", true},
+		{"unsupported type", daily, 1.5, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PartitionFor(tt.tMeta, tt.partition)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PartitionFor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.ID != tt.wantID {
+				t.Errorf("PartitionFor() = %v, want %v", got.ID, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestPartitionKeySQL(t *testing.T) {
+	tests := []struct {
+		name  string
+		tMeta *bigquery.TableMetadata
+		want  string
+	}{
+		{"ingestion time", &bigquery.TableMetadata{TimePartitioning: &bigquery.TimePartitioning{}},
+			"IFNULL(FORMAT_TIMESTAMP('%Y%m%d', TIMESTAMP(`_PARTITIONTIME`)), '__UNPARTITIONED__')"},
+		{"hourly column", &bigquery.TableMetadata{TimePartitioning: &bigquery.TimePartitioning{Type: bigquery.HourPartitioningType, Field: "ts"}},
+			"IFNULL(FORMAT_TIMESTAMP('%Y%m%d%H', TIMESTAMP(`ts`)), '__NULL__')"},
+		{"monthly column", &bigquery.TableMetadata{TimePartitioning: &bigquery.TimePartitioning{Type: bigquery.MonthPartitioningType, Field: "day"}},
+			"IFNULL(FORMAT_TIMESTAMP('%Y%m', TIMESTAMP(`day`)), '__NULL__')"},
+		{"integer range", &bigquery.TableMetadata{RangePartitioning: &bigquery.RangePartitioning{
+			Field: "id", Range: &bigquery.RangePartitioningRange{Start: -100, End: 100, Interval: 30}}},
+			"CASE WHEN `id` IS NULL THEN '__NULL__' WHEN `id` < -100 OR `id` >= 100 THEN '__UNPARTITIONED__' " +
+				"ELSE CAST(-100 + DIV(`id` - -100, 30) * 30 AS STRING) END"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := partitionKeySQL(tt.tMeta); got != tt.want {
+				t.Errorf("partitionKeySQL() =\n%v\nwant\n%v", got, tt.want)
+			}
+		})
+	}
+}
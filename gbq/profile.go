@@ -0,0 +1,346 @@
+package bqtools
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/net/context"
+
+	bu "github.com/belboo/boo-go-tools/misc"
+)
+
+// ProfileOptions tunes ProfileTable
+type ProfileOptions struct {
+	// Stats to compute where applicable to the column type, empty computes the ColumnStatsOptions defaults.
+	// Partition range, filter, quantiles and top N are taken from here as well.
+	// MaxBytesBilled is the budget of the whole profile (not of every query), the queries are dry-run
+	// first and nothing is run if their estimated total exceeds it. 0 means no budget.
+	ColumnStatsOptions
+
+	ColumnsPerQuery int // columns aggregated by a single query, defaults to 50
+	MaxQueries      int // refuse to profile tables needing more queries than this, defaults to 20
+}
+
+// TableProfile is the result of ProfileTable
+type TableProfile struct {
+	Dataset string `json:"dataset"`
+	Table   string `json:"table"`
+
+	Rows           int64     `json:"rows"`
+	PartitionsFrom time.Time `json:"partitions_from"`
+	PartitionsTo   time.Time `json:"partitions_to"`
+	Filter         string    `json:"filter,omitempty"`
+
+	Queries        int       `json:"queries"`
+	BytesProcessed int64     `json:"bytes_processed"`
+	GeneratedAt    time.Time `json:"generated_at"`
+
+	Columns []*ColumnStats `json:"columns"` // in schema order, nested fields as dotted paths
+}
+
+// JSON returns the profile as indented JSON
+func (p *TableProfile) JSON() ([]byte, error) {
+	return json.MarshalIndent(p, "", "  ")
+}
+
+// Markdown returns the profile as a Markdown report
+func (p *TableProfile) Markdown() string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "# Profile of `%v.%v`\n\n", p.Dataset, p.Table)
+	fmt.Fprintf(&sb, "- Rows: %v\n", p.Rows)
+	if !p.PartitionsFrom.IsZero() || !p.PartitionsTo.IsZero() {
+		fmt.Fprintf(&sb, "- Partitions: [%v, %v)\n", profileValue(p.PartitionsFrom), profileValue(p.PartitionsTo))
+	}
+	if p.Filter != "" {
+		fmt.Fprintf(&sb, "- Filter: `%v`\n", p.Filter)
+	}
+	fmt.Fprintf(&sb, "- Queries: %v, %v processed\n", p.Queries, bu.FormatBytes(p.BytesProcessed))
+	fmt.Fprintf(&sb, "- Generated: %v\n\n", p.GeneratedAt.Format(time.RFC3339))
+
+	sb.WriteString("| Column | Type | Count | Null % | Distinct | Min | Max | Avg | Stddev | Length |\n")
+	sb.WriteString("|---|---|---:|---:|---:|---|---|---:|---:|---|\n")
+	for _, cs := range p.Columns {
+		name := cs.Column
+		if cs.Repeated {
+			name += " []"
+		}
+		distinct := ""
+		if cs.Distinct != nil {
+			distinct = fmt.Sprint(*cs.Distinct)
+		} else if cs.ApproxDistinct != nil {
+			distinct = fmt.Sprintf("~%v", *cs.ApproxDistinct)
+		}
+		length := ""
+		if cs.MinLength != nil && cs.MaxLength != nil {
+			length = fmt.Sprintf("%v-%v", *cs.MinLength, *cs.MaxLength)
+		}
+		fmt.Fprintf(&sb, "| %v | %v | %v | %.2f | %v | %v | %v | %v | %v | %v |\n",
+			mdCell(name), cs.Type, cs.Count, 100*cs.NullRatio(), distinct,
+			mdCell(profileValue(cs.Min)), mdCell(profileValue(cs.Max)),
+			profileValue(cs.Avg), profileValue(cs.Stddev), length)
+	}
+
+	for _, cs := range p.Columns {
+		if len(cs.Quantiles) == 0 && len(cs.TopN) == 0 {
+			continue
+		}
+		fmt.Fprintf(&sb, "\n## %v\n\n", mdCell(cs.Column))
+		if len(cs.Quantiles) > 0 {
+			qs := make([]string, len(cs.Quantiles))
+			for i, q := range cs.Quantiles {
+				qs[i] = mdCell(profileValue(q))
+			}
+			fmt.Fprintf(&sb, "Quantiles: %v\n\n", strings.Join(qs, " / "))
+		}
+		if len(cs.TopN) > 0 {
+			sb.WriteString("| Value | Count | Share % |\n|---|---:|---:|\n")
+			for _, vc := range cs.TopN {
+				share := 0.0
+				if cs.Count > 0 {
+					share = 100 * float64(vc.Count) / float64(cs.Count)
+				}
+				fmt.Fprintf(&sb, "| %v | %v | %.2f |\n", mdCell(profileValue(vc.Value)), vc.Count, share)
+			}
+		}
+	}
+
+	return sb.String()
+}
+
+// profileValue formats a statistic value for the Markdown report
+func profileValue(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case *float64:
+		if val == nil {
+			return ""
+		}
+		return fmt.Sprintf("%.6g", *val)
+	case float64:
+		return fmt.Sprintf("%.6g", val)
+	case *big.Rat:
+		return strings.TrimRight(strings.TrimRight(val.FloatString(9), "0"), ".")
+	case time.Time:
+		if val.IsZero() {
+			return ""
+		}
+		return val.Format(time.RFC3339)
+	case []byte:
+		return fmt.Sprintf("%d bytes", len(val))
+	}
+	return fmt.Sprint(v)
+}
+
+// mdCell escapes a Markdown table cell
+func mdCell(s string) string {
+	s = strings.Replace(s, "|", "\\|", -1)
+	return strings.Replace(s, "\n", " ", -1)
+}
+
+// profileScope is a set of columns sharing the same FROM clause (the table possibly unnested)
+type profileScope struct {
+	from string
+	cols []statColumn
+}
+
+// profileColumns walks the schema into scopes, one for the table and one for every REPEATED field
+func profileColumns(schema bigquery.Schema, requested []ColumnStat, expr string, name string, scope int, scopes *[]profileScope) {
+	for _, f := range schema {
+		fExpr := expr + ".`" + f.Name + "`"
+		fName := name + f.Name
+		fScope := scope
+
+		if f.Repeated {
+			alias := fmt.Sprintf("u%v", len(*scopes))
+			*scopes = append(*scopes, profileScope{
+				from: fmt.Sprintf("%v,\n  UNNEST(%v) AS %v", (*scopes)[scope].from, fExpr, alias),
+			})
+			fScope = len(*scopes) - 1
+			fExpr = alias
+		}
+
+		(*scopes)[fScope].cols = append((*scopes)[fScope].cols, statColumn{
+			name:  fName,
+			expr:  fExpr,
+			field: f,
+			stats: profileStats(f.Type, requested),
+		})
+
+		if f.Type == bigquery.RecordFieldType {
+			profileColumns(f.Schema, requested, fExpr, fName+".", fScope, scopes)
+		}
+	}
+}
+
+// profileStats picks the requested statistics applicable to a type, unlike resolveStats it does not complain
+func profileStats(t bigquery.FieldType, requested []ColumnStat) []ColumnStat {
+	applicable := statsFor(t)
+	out := make([]ColumnStat, 0, len(applicable))
+	for _, s := range applicable {
+		if len(requested) == 0 {
+			if s != StatDistinct {
+				out = append(out, s)
+			}
+			continue
+		}
+		if s == StatCount || s == StatNulls {
+			out = append(out, s)
+			continue
+		}
+		for _, r := range requested {
+			if r == s {
+				out = append(out, s)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// ProfileTable computes statistics on every column of a table, nested fields included, in a bounded number
+// of aggregate queries: one per ColumnsPerQuery columns of the table and of every REPEATED field (unnested).
+// Statistics of repeated fields are computed over their elements.
+func ProfileTable(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string, opts ProfileOptions) (*TableProfile, error) {
+	tMeta, err := getTableMeta(ctx, bqClient, bqDataset, bqTable, "ProfileTable")
+	if err != nil {
+		return nil, err
+	}
+
+	perQuery := opts.ColumnsPerQuery
+	if perQuery <= 0 {
+		perQuery = 50
+	}
+	maxQueries := opts.MaxQueries
+	if maxQueries <= 0 {
+		maxQueries = 20
+	}
+
+	scopes := []profileScope{{from: fmt.Sprintf("`%v`.`%v` AS t", bqDataset, bqTable)}}
+	profileColumns(tMeta.Schema, opts.Stats, "t", "", 0, &scopes)
+
+	where, params, err := statsWhereSQL(tMeta, opts.ColumnStatsOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	type profileQuery struct {
+		sql  string
+		cols []statColumn
+		top  bool // query on the table itself, its COUNT(*) is the row count
+	}
+	queries := make([]profileQuery, 0)
+	for i, s := range scopes {
+		for lo := 0; lo < len(s.cols) || (i == 0 && lo == 0); lo += perQuery {
+			hi := lo + perQuery
+			if hi > len(s.cols) {
+				hi = len(s.cols)
+			}
+			cols := s.cols[lo:hi]
+			queries = append(queries, profileQuery{
+				sql:  fmt.Sprintf("SELECT\n  %v\nFROM %v\n%v", statsSelectSQL(cols, opts.ColumnStatsOptions), s.from, where),
+				cols: cols,
+				top:  i == 0 && lo == 0,
+			})
+		}
+	}
+
+	if len(queries) > maxQueries {
+		return nil, bu.TError{
+			Msg:    fmt.Sprintf("profiling %v.%v needs %v queries, more than %v, raise ColumnsPerQuery or MaxQueries", bqDataset, bqTable, len(queries), maxQueries),
+			Origin: "ProfileTable",
+			Code:   bu.ErrConfigError,
+			Err:    nil,
+		}
+	}
+
+	profile := &TableProfile{
+		Dataset:        bqDataset,
+		Table:          bqTable,
+		PartitionsFrom: opts.PartitionsFrom,
+		PartitionsTo:   opts.PartitionsTo,
+		Filter:         opts.Filter,
+		Queries:        len(queries),
+		Columns:        make([]*ColumnStats, 0),
+	}
+
+	estimates := make([]int64, len(queries))
+	for i, q := range queries {
+		qry := bqClient.Query(q.sql)
+		qry.Parameters = params
+		est, err := estimateQuery(ctx, qry, "ProfileTable")
+		if err != nil {
+			return nil, err
+		}
+		estimates[i] = est.TotalBytesProcessed
+		profile.BytesProcessed += estimates[i]
+	}
+	if opts.MaxBytesBilled > 0 && profile.BytesProcessed > opts.MaxBytesBilled {
+		return nil, bu.TError{
+			Msg: fmt.Sprintf("profiling %v.%v would process %v, over the budget of %v",
+				bqDataset, bqTable, bu.FormatBytes(profile.BytesProcessed), bu.FormatBytes(opts.MaxBytesBilled)),
+			Origin: "ProfileTable",
+			Code:   bu.ErrBudgetExceeded,
+			Err:    nil,
+		}
+	}
+
+	stats := make(map[string]*ColumnStats)
+	remaining := opts.MaxBytesBilled
+	for i, q := range queries {
+		var maxBytes int64
+		if opts.MaxBytesBilled > 0 {
+			// billing rounds small queries up to 10 MB, do not let that fail the last queries
+			if maxBytes = remaining; maxBytes < 10<<20 {
+				maxBytes = 10 << 20
+			}
+			remaining -= estimates[i]
+		}
+
+		row, err := readStatsRow(ctx, bqClient, q.sql, params, maxBytes, "ProfileTable")
+		if err != nil {
+			return nil, err
+		}
+		if q.top {
+			profile.Rows, _ = row["n"].(int64)
+		}
+		for name, cs := range parseStatsRow(row, q.cols) {
+			stats[name] = cs
+		}
+	}
+
+	for _, s := range scopes {
+		for _, c := range s.cols {
+			if cs, ok := stats[c.name]; ok {
+				_, cs.Repeated = LookupField(tMeta.Schema, c.name)
+				profile.Columns = append(profile.Columns, cs)
+			}
+		}
+	}
+	sortProfileColumns(profile.Columns, tMeta.Schema)
+	profile.GeneratedAt = time.Now().UTC()
+
+	return profile, nil
+}
+
+// sortProfileColumns puts the columns back in schema order (scopes group them by repetition)
+func sortProfileColumns(cols []*ColumnStats, schema bigquery.Schema) {
+	order := make(map[string]int)
+	var walk func(s bigquery.Schema, prefix string)
+	walk = func(s bigquery.Schema, prefix string) {
+		for _, f := range s {
+			order[prefix+f.Name] = len(order)
+			walk(f.Schema, prefix+f.Name+".")
+		}
+	}
+	walk(schema, "")
+	sort.SliceStable(cols, func(i, j int) bool {
+		return order[cols[i].Column] < order[cols[j].Column]
+	})
+}
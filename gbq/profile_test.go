@@ -0,0 +1,77 @@
+package bqtools
+
+import (
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestProfileStats(t *testing.T) {
+	tests := []struct {
+		typ       bigquery.FieldType
+		requested []ColumnStat
+		want      []ColumnStat
+	}{
+		{bigquery.BooleanFieldType, nil, []ColumnStat{StatCount, StatNulls, StatApproxDistinct, StatMin, StatMax, StatTopN}},
+		{bigquery.BytesFieldType, []ColumnStat{StatAvg, StatMaxLength}, []ColumnStat{StatCount, StatNulls, StatMaxLength}},
+		{bigquery.IntegerFieldType, []ColumnStat{StatDistinct}, []ColumnStat{StatCount, StatNulls, StatDistinct}},
+		{bigquery.RecordFieldType, []ColumnStat{StatMin}, []ColumnStat{StatCount, StatNulls}},
+	}
+
+	for _, tt := range tests {
+		if got := profileStats(tt.typ, tt.requested); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("profileStats(%v, %v) = %v, want %v", tt.typ, tt.requested, got, tt.want)
+		}
+	}
+}
+
+func TestProfileColumns(t *testing.T) {
+	tags := field("tags", bigquery.StringFieldType)
+	tags.Repeated = true
+	items := field("items", bigquery.RecordFieldType)
+	items.Repeated = true
+	items.Schema = bigquery.Schema{field("sku", bigquery.StringFieldType)}
+	schema := bigquery.Schema{field("id", bigquery.IntegerFieldType), tags, items}
+
+	scopes := []profileScope{{from: "`ds`.`t` AS t"}}
+	profileColumns(schema, nil, "t", "", 0, &scopes)
+
+	type scope struct {
+		from  string
+		names []string
+		exprs []string
+	}
+	want := []scope{
+		{"`ds`.`t` AS t", []string{"id"}, []string{"t.`id`"}},
+		{"`ds`.`t` AS t,\n  UNNEST(t.`tags`) AS u1", []string{"tags"}, []string{"u1"}},
+		{"`ds`.`t` AS t,\n  UNNEST(t.`items`) AS u2", []string{"items", "items.sku"}, []string{"u2", "u2.`sku`"}},
+	}
+	got := make([]scope, len(scopes))
+	for i, s := range scopes {
+		got[i].from = s.from
+		for _, c := range s.cols {
+			got[i].names = append(got[i].names, c.name)
+			got[i].exprs = append(got[i].exprs, c.expr)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("profileColumns() = %q, want %q", got, want)
+	}
+
+	cols := []*ColumnStats{{Column: "items.sku"}, {Column: "tags"}, {Column: "id"}, {Column: "items"}}
+	sortProfileColumns(cols, schema)
+	order := make([]string, len(cols))
+	for i, c := range cols {
+		order[i] = c.Column
+	}
+	if want := []string{"id", "tags", "items", "items.sku"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("sortProfileColumns() = %v, want %v", order, want)
+	}
+}
+
+func TestMdCell(t *testing.T) {
+	if got, want := mdCell("a|b\nc"), "a\\|b c"; got != want {
+		t.Errorf("mdCell() = %q, want %q", got, want)
+	}
+}
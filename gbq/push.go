@@ -0,0 +1,358 @@
+package bqtools
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/gammazero/workerpool"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+
+	bu "github.com/belboo/boo-go-tools/misc"
+)
+
+// insertAll request limits, see https://cloud.google.com/bigquery/quotas#streaming_inserts
+const (
+	DefaultPushBatchRows  = 500
+	DefaultPushBatchBytes = 5 << 20
+	MaxPushBatchBytes     = 10 << 20
+)
+
+// PushOptions tunes PushToBQ
+type PushOptions struct {
+	Concurrency   int // batches in flight, defaults to 4. Reading the input waits while all of them are busy.
+	MaxBatchRows  int // defaults to DefaultPushBatchRows
+	MaxBatchBytes int // approximate (JSON encoded) request size, defaults to DefaultPushBatchBytes
+
+	SkipInvalidRows     bool // insert the valid rows of a batch with invalid ones
+	IgnoreUnknownValues bool
+
+	// InsertID returns the dedup ID of a row, by default it is a hash of InsertIDPrefix, the position of the
+	// row in the input and its content (ValueSavers returning an insert ID keep theirs): re-pushing the same
+	// input does not duplicate it while identical rows within it are all kept. Set a prefix per input.
+	InsertID       func(row interface{}) string
+	InsertIDPrefix string
+
+	MaxRetries   int           // retries of transient failures per batch, defaults to 5
+	RetryBackoff time.Duration // first retry delay, doubled on every retry, defaults to 1s
+
+	Logger *bu.TLogger
+}
+
+// RowError is a row PushToBQ failed to insert
+type RowError struct {
+	Index    int64 // position of the row in the input
+	InsertID string
+	Err      error
+}
+
+// PushReport is the result of PushToBQ
+type PushReport struct {
+	Rows     int64
+	Inserted int64
+	Failed   int64
+	Batches  int
+	Retries  int
+
+	RowErrors []RowError
+}
+
+// pushRow is an input row ready to insert
+type pushRow struct {
+	index    int64
+	insertID string
+	saver    bigquery.ValueSaver
+	size     int
+}
+
+// fixedIDSaver wraps a ValueSaver to return a given insert ID
+type fixedIDSaver struct {
+	row      map[string]bigquery.Value
+	insertID string
+}
+
+// Save implemented for bigquery.ValueSaver
+func (s fixedIDSaver) Save() (map[string]bigquery.Value, string, error) {
+	return s.row, s.insertID, nil
+}
+
+// newPushRow turns an input element (a struct, a pointer to one or a ValueSaver) into a pushRow
+func newPushRow(v interface{}, index int64, opts PushOptions) (pushRow, error) {
+	r := pushRow{index: index}
+
+	var content interface{}
+	if vs, ok := v.(bigquery.ValueSaver); ok {
+		row, insertID, err := vs.Save()
+		if err != nil {
+			return r, err
+		}
+		content = row
+		r.insertID = insertID
+		r.saver = fixedIDSaver{row: row}
+	} else {
+		rv := reflect.Indirect(reflect.ValueOf(v))
+		if rv.Kind() != reflect.Struct {
+			return r, fmt.Errorf("rows must be structs or bigquery.ValueSavers, got %T", v)
+		}
+		content = v
+		r.saver = &bigquery.StructSaver{Struct: v}
+	}
+
+	js, err := json.Marshal(content)
+	if err != nil {
+		return r, err
+	}
+	r.size = len(js)
+
+	switch {
+	case opts.InsertID != nil:
+		r.insertID = opts.InsertID(v)
+	case r.insertID == "" || r.insertID == bigquery.NoDedupeID:
+		h := sha1.New()
+		fmt.Fprintf(h, "%v\x00%v\x00", opts.InsertIDPrefix, index)
+		h.Write(js)
+		r.insertID = hex.EncodeToString(h.Sum(nil))
+	}
+
+	switch s := r.saver.(type) {
+	case fixedIDSaver:
+		s.insertID = r.insertID
+		r.saver = s
+	case *bigquery.StructSaver:
+		s.InsertID = r.insertID
+	}
+
+	return r, nil
+}
+
+// transientReasons are the insert error reasons worth retrying, "stopped" rows were valid but
+// not inserted because of other rows in the same request
+var transientReasons = map[string]bool{
+	"backendError":      true,
+	"internalError":     true,
+	"rateLimitExceeded": true,
+	"timeout":           true,
+	"stopped":           true,
+}
+
+// isTransient checks if a request error is worth retrying
+func isTransient(err error) bool {
+	if erg, ok := err.(*googleapi.Error); ok {
+		switch erg.Code {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		for _, e := range erg.Errors {
+			if transientReasons[e.Reason] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rowErrorTransient tells if all errors of a row are transient ones
+func rowErrorTransient(errs bigquery.MultiError) bool {
+	for _, e := range errs {
+		be, ok := e.(*bigquery.Error)
+		if !ok || !transientReasons[be.Reason] {
+			return false
+		}
+	}
+	return true
+}
+
+// pushBatch inserts a batch retrying transient failures, successes and failures are recorded in report
+func pushBatch(ctx context.Context, ins *bigquery.Inserter, batch []pushRow, opts PushOptions, report *PushReport, mu *sync.Mutex) {
+	backoff := opts.RetryBackoff
+	failed := make([]RowError, 0)
+
+	for attempt := 0; len(batch) > 0; attempt++ {
+		if attempt > 0 {
+			if opts.Logger != nil {
+				opts.Logger.Logf("PushToBQ: retrying %v rows (attempt %v)\n", len(batch), attempt+1)
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > 30*time.Second {
+				backoff = 30 * time.Second
+			}
+			mu.Lock()
+			report.Retries++
+			mu.Unlock()
+		}
+
+		savers := make([]bigquery.ValueSaver, len(batch))
+		for i, r := range batch {
+			savers[i] = r.saver
+		}
+
+		err := ins.Put(ctx, savers)
+		if err == nil {
+			break
+		}
+
+		lastAttempt := attempt >= opts.MaxRetries || ctx.Err() != nil
+		pme, ok := err.(bigquery.PutMultiError)
+		if !ok {
+			if !isTransient(err) || lastAttempt {
+				for _, r := range batch {
+					failed = append(failed, RowError{Index: r.index, InsertID: r.insertID, Err: err})
+				}
+				batch = nil
+			}
+			continue
+		}
+
+		retry := make([]pushRow, 0)
+		for _, rie := range pme {
+			r := batch[rie.RowIndex]
+			if rowErrorTransient(rie.Errors) && !lastAttempt {
+				retry = append(retry, r)
+				continue
+			}
+			failed = append(failed, RowError{Index: r.index, InsertID: r.insertID, Err: rie.Errors})
+		}
+		// rows without errors made it
+		mu.Lock()
+		report.Inserted += int64(len(batch) - len(pme))
+		mu.Unlock()
+		batch = retry
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	report.Inserted += int64(len(batch))
+	report.Failed += int64(len(failed))
+	report.RowErrors = append(report.RowErrors, failed...)
+}
+
+// PushToBQ streams rows into bqDataset.bqTable with insertAll requests pushed concurrently.
+// rows is a slice or a channel of structs (or pointers to them) or bigquery.ValueSavers, a channel
+// is read until closed. Rows are batched by count and approximate size, transient failures are
+// retried with exponential backoff and rows that still fail are listed in the report rather than
+// failing the push. The error is set for invalid input or a cancelled context only.
+func PushToBQ(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string, rows interface{}, opts PushOptions) (*PushReport, error) {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 4
+	}
+	if opts.MaxBatchRows <= 0 {
+		opts.MaxBatchRows = DefaultPushBatchRows
+	}
+	if opts.MaxBatchBytes <= 0 || opts.MaxBatchBytes > MaxPushBatchBytes {
+		opts.MaxBatchBytes = DefaultPushBatchBytes
+	}
+	if opts.MaxRetries < 0 {
+		opts.MaxRetries = 0
+	} else if opts.MaxRetries == 0 {
+		opts.MaxRetries = 5
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = time.Second
+	}
+
+	rv := reflect.ValueOf(rows)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array && rv.Kind() != reflect.Chan {
+		return nil, bu.TError{
+			Msg:    fmt.Sprintf("rows must be a slice or a channel, got %T", rows),
+			Origin: "PushToBQ",
+			Code:   bu.ErrConfigError,
+			Err:    nil,
+		}
+	}
+
+	ins := bqClient.Dataset(bqDataset).Table(bqTable).Inserter()
+	ins.SkipInvalidRows = opts.SkipInvalidRows
+	ins.IgnoreUnknownValues = opts.IgnoreUnknownValues
+
+	report := &PushReport{RowErrors: make([]RowError, 0)}
+	var mu sync.Mutex
+	wp := workerpool.New(opts.Concurrency)
+	// workerpool queues without limit, this bounds the batches held in memory
+	inflight := make(chan struct{}, opts.Concurrency)
+
+	batch := make([]pushRow, 0, opts.MaxBatchRows)
+	batchBytes := 0
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		b := batch
+		report.Batches++
+		inflight <- struct{}{}
+		wp.Submit(func() {
+			defer func() { <-inflight }()
+			pushBatch(ctx, ins, b, opts, report, &mu)
+		})
+		batch = make([]pushRow, 0, opts.MaxBatchRows)
+		batchBytes = 0
+	}
+
+	add := func(v interface{}) {
+		index := report.Rows
+		report.Rows++
+
+		r, err := newPushRow(v, index, opts)
+		if err != nil {
+			mu.Lock()
+			report.Failed++
+			report.RowErrors = append(report.RowErrors, RowError{Index: index, Err: err})
+			mu.Unlock()
+			return
+		}
+		if len(batch) > 0 && batchBytes+r.size > opts.MaxBatchBytes {
+			flush()
+		}
+		batch = append(batch, r)
+		batchBytes += r.size
+		if len(batch) >= opts.MaxBatchRows {
+			flush()
+		}
+	}
+
+	if rv.Kind() == reflect.Chan {
+		cases := []reflect.SelectCase{
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+			{Dir: reflect.SelectRecv, Chan: rv},
+		}
+		for {
+			chosen, v, ok := reflect.Select(cases)
+			if chosen == 0 || !ok {
+				break
+			}
+			add(v.Interface())
+		}
+	} else {
+		for i := 0; i < rv.Len() && ctx.Err() == nil; i++ {
+			add(rv.Index(i).Interface())
+		}
+	}
+	flush()
+	wp.StopWait()
+
+	if opts.Logger != nil {
+		opts.Logger.Logf("PushToBQ %v.%v: %v rows, %v inserted, %v failed in %v batches\n",
+			bqDataset, bqTable, report.Rows, report.Inserted, report.Failed, report.Batches)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return report, bu.TError{
+			Msg:    fmt.Sprintf("push to %v.%v interrupted after %v rows", bqDataset, bqTable, report.Rows),
+			Origin: "PushToBQ",
+			Code:   bu.ErrDataUpload,
+			Err:    err,
+		}
+	}
+
+	return report, nil
+}
@@ -0,0 +1,117 @@
+package bqtools
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+)
+
+type pushTestRow struct {
+	ID   int64  `bigquery:"id"`
+	Name string `bigquery:"name"`
+}
+
+// pushTestSaver is a ValueSaver with a fixed insert ID
+type pushTestSaver struct {
+	insertID string
+}
+
+func (s pushTestSaver) Save() (map[string]bigquery.Value, string, error) {
+	return map[string]bigquery.Value{"id": 1}, s.insertID, nil
+}
+
+func TestNewPushRow(t *testing.T) {
+	row := pushTestRow{ID: 1, Name: "a"}
+	id := func(v interface{}, index int64, opts PushOptions) string {
+		r, err := newPushRow(v, index, opts)
+		if err != nil {
+			t.Fatalf("newPushRow(%v) error = %v", v, err)
+		}
+		return r.insertID
+	}
+
+	base := id(row, 0, PushOptions{})
+	if base == "" || base != id(&row, 0, PushOptions{}) {
+		t.Errorf("insert ID of a struct and a pointer to it differ: %q, %q", base, id(&row, 0, PushOptions{}))
+	}
+
+	tests := []struct {
+		name  string
+		v     interface{}
+		index int64
+		opts  PushOptions
+	}{
+		{"position", row, 1, PushOptions{}},
+		{"prefix", row, 0, PushOptions{InsertIDPrefix: "run-2"}},
+		{"content", pushTestRow{ID: 2, Name: "a"}, 0, PushOptions{}},
+		{"no dedupe saver", pushTestSaver{insertID: bigquery.NoDedupeID}, 0, PushOptions{}},
+	}
+	for _, tt := range tests {
+		if got := id(tt.v, tt.index, tt.opts); got == base || got == "" || got == bigquery.NoDedupeID {
+			t.Errorf("%v: insert ID = %q, want a new derived one", tt.name, got)
+		}
+	}
+
+	if got := id(pushTestSaver{insertID: "own"}, 3, PushOptions{InsertIDPrefix: "p"}); got != "own" {
+		t.Errorf("ValueSaver insert ID = %q, want own", got)
+	}
+	custom := PushOptions{InsertID: func(v interface{}) string { return "custom" }}
+	if got := id(row, 0, custom); got != "custom" {
+		t.Errorf("custom insert ID = %q, want custom", got)
+	}
+	if got := id(pushTestSaver{insertID: "own"}, 0, custom); got != "custom" {
+		t.Errorf("custom insert ID of a ValueSaver = %q, want custom", got)
+	}
+
+	r, _ := newPushRow(row, 7, PushOptions{})
+	if _, insertID, _ := r.saver.Save(); insertID != r.insertID {
+		t.Errorf("saver insert ID = %q, want %q", insertID, r.insertID)
+	}
+	if r.index != 7 || r.size == 0 {
+		t.Errorf("newPushRow() = index %v, size %v", r.index, r.size)
+	}
+
+	for _, v := range []interface{}{42, "row", map[string]int{"id": 1}} {
+		if _, err := newPushRow(v, 0, PushOptions{}); err == nil {
+			t.Errorf("newPushRow(%#v) accepted a non-struct", v)
+		}
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&googleapi.Error{Code: http.StatusServiceUnavailable}, true},
+		{&googleapi.Error{Code: http.StatusBadRequest, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, true},
+		{&googleapi.Error{Code: http.StatusBadRequest, Errors: []googleapi.ErrorItem{{Reason: "invalid"}}}, false},
+		{errors.New("boom"), false},
+	}
+
+	for _, tt := range tests {
+		if got := isTransient(tt.err); got != tt.want {
+			t.Errorf("isTransient(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRowErrorTransient(t *testing.T) {
+	tests := []struct {
+		errs bigquery.MultiError
+		want bool
+	}{
+		{bigquery.MultiError{&bigquery.Error{Reason: "stopped"}, &bigquery.Error{Reason: "backendError"}}, true},
+		{bigquery.MultiError{&bigquery.Error{Reason: "stopped"}, &bigquery.Error{Reason: "invalid"}}, false},
+		{bigquery.MultiError{errors.New("boom")}, false},
+	}
+
+	for _, tt := range tests {
+		if got := rowErrorTransient(tt.errs); got != tt.want {
+			t.Errorf("rowErrorTransient(%v) = %v, want %v", tt.errs, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package bqtools
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/net/context"
+	"google.golang.org/api/iterator"
+
+	bu "github.com/belboo/boo-go-tools/misc"
+)
+
+// QueryOptions tunes RunQuery
+type QueryOptions struct {
+	// DstDataset and DstTable set a destination table for the results, with the usual dispositions
+	// (WriteEmpty and CreateIfNeeded by default), partitioning and clustering for a created table
+	DstDataset        string
+	DstTable          string
+	WriteDisposition  bigquery.TableWriteDisposition
+	CreateDisposition bigquery.TableCreateDisposition
+	TimePartitioning  *bigquery.TimePartitioning
+	Clustering        *bigquery.Clustering
+
+	// DefaultDataset is used for unqualified table names in the query
+	DefaultDataset string
+
+	Labels         map[string]string
+	MaxBytesBilled int64
+	Priority       bigquery.QueryPriority // bigquery.InteractivePriority (default) or bigquery.BatchPriority
+	DisableCache   bool
+}
+
+// QueryResult describes a finished query job
+type QueryResult struct {
+	JobID     string
+	Schema    bigquery.Schema
+	TotalRows uint64
+	Stats     *bigquery.QueryStatistics // bytes processed and billed, cache hit, DML affected rows, ...
+}
+
+// QueryParameters converts params into query parameters: nil, a []bigquery.QueryParameter, a map of
+// names to values (named parameters, @name) or a []interface{} (positional parameters, ?). Values can
+// be anything bigquery.QueryParameter takes, slices for ARRAYs and structs for STRUCTs included.
+func QueryParameters(params interface{}) ([]bigquery.QueryParameter, error) {
+	switch p := params.(type) {
+	case nil:
+		return nil, nil
+	case []bigquery.QueryParameter:
+		return p, nil
+	case map[string]interface{}:
+		out := make([]bigquery.QueryParameter, 0, len(p))
+		for name, v := range p {
+			out = append(out, bigquery.QueryParameter{Name: name, Value: v})
+		}
+		// sorted so that the same parameters always make the same job configuration
+		sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+		return out, nil
+	case []interface{}:
+		out := make([]bigquery.QueryParameter, len(p))
+		for i, v := range p {
+			out[i] = bigquery.QueryParameter{Value: v}
+		}
+		return out, nil
+	}
+	return nil, bu.TError{
+		Msg:    fmt.Sprintf("unsupported query parameters type %T", params),
+		Origin: "QueryParameters",
+		Code:   bu.ErrConfigError,
+		Err:    nil,
+	}
+}
+
+// newQuery sets up a query with the options applied
+func newQuery(bqClient *bigquery.Client, sql string, params []bigquery.QueryParameter, opts QueryOptions) *bigquery.Query {
+	qry := bqClient.Query(sql)
+	qry.Parameters = params
+	qry.Labels = opts.Labels
+	qry.MaxBytesBilled = opts.MaxBytesBilled
+	qry.Priority = opts.Priority
+	qry.DisableQueryCache = opts.DisableCache
+	if opts.DefaultDataset != "" {
+		qry.DefaultProjectID = bqClient.Project()
+		qry.DefaultDatasetID = opts.DefaultDataset
+	}
+	if opts.DstTable != "" {
+		qry.Dst = bqClient.Dataset(opts.DstDataset).Table(opts.DstTable)
+		qry.WriteDisposition = opts.WriteDisposition
+		qry.CreateDisposition = opts.CreateDisposition
+		qry.TimePartitioning = opts.TimePartitioning
+		qry.Clustering = opts.Clustering
+	}
+	return qry
+}
+
+// RunQuery runs a (parameterized, see QueryParameters) query, waits for it and reads the results into dst:
+//   - nil to ignore the results (DDL, DML or a destination table)
+//   - a pointer to a slice of structs, struct pointers, map[string]bigquery.Value or []bigquery.Value
+//   - a channel of any of those, closed by RunQuery once all rows are sent (or on failure)
+func RunQuery(ctx context.Context, bqClient *bigquery.Client, sql string, params interface{}, dst interface{}, opts QueryOptions) (*QueryResult, error) {
+	var dstV reflect.Value
+	if dst != nil {
+		dstV = reflect.ValueOf(dst)
+		switch {
+		case dstV.Kind() == reflect.Chan && dstV.Type().ChanDir()&reflect.SendDir != 0:
+			defer dstV.Close()
+		case dstV.Kind() == reflect.Ptr && dstV.Elem().Kind() == reflect.Slice:
+		default:
+			return nil, bu.TError{
+				Msg:    fmt.Sprintf("query results cannot be read into %T", dst),
+				Origin: "RunQuery",
+				Code:   bu.ErrConfigError,
+				Err:    nil,
+			}
+		}
+	}
+
+	qParams, err := QueryParameters(params)
+	if err != nil {
+		return nil, err
+	}
+
+	job, err := runQuery(ctx, bqClient, newQuery(bqClient, sql, qParams, opts), "RunQuery")
+	if _, ok := err.(bu.TError); ok {
+		return nil, err
+	}
+	if err != nil {
+		return nil, bu.TError{
+			Msg:    "could not start query",
+			Origin: "RunQuery",
+			Code:   bu.ErrDataQuery,
+			Err:    err,
+		}
+	}
+	status, err := job.Wait(ctx)
+	if err == nil {
+		err = status.Err()
+	}
+	if err != nil {
+		return nil, bu.TError{
+			Msg:    fmt.Sprintf("query job %v failed", job.ID()),
+			Origin: "RunQuery",
+			Code:   bu.ErrDataQuery,
+			Err:    err,
+		}
+	}
+
+	res := &QueryResult{JobID: job.ID()}
+	if status.Statistics != nil {
+		res.Stats, _ = status.Statistics.Details.(*bigquery.QueryStatistics)
+	}
+
+	it, err := job.Read(ctx)
+	if err != nil {
+		return res, bu.TError{
+			Msg:    fmt.Sprintf("could not read results of query job %v", job.ID()),
+			Origin: "RunQuery",
+			Code:   bu.ErrDataQuery,
+			Err:    err,
+		}
+	}
+	res.TotalRows = it.TotalRows
+	res.Schema = it.Schema
+	if dst == nil {
+		return res, nil
+	}
+
+	if err := readRows(ctx, it, dstV); err != nil {
+		return res, bu.TError{
+			Msg:    fmt.Sprintf("failed to read results of query job %v", job.ID()),
+			Origin: "RunQuery",
+			Code:   bu.ErrDataQuery,
+			Err:    err,
+		}
+	}
+	res.Schema = it.Schema
+
+	return res, nil
+}
+
+// readRows reads all rows of it into a slice pointer or a channel
+func readRows(ctx context.Context, it *bigquery.RowIterator, dstV reflect.Value) error {
+	var elemT reflect.Type
+	if dstV.Kind() == reflect.Chan {
+		elemT = dstV.Type().Elem()
+	} else {
+		elemT = dstV.Elem().Type().Elem()
+	}
+	isPtr := elemT.Kind() == reflect.Ptr
+	if isPtr {
+		elemT = elemT.Elem()
+	}
+
+	for {
+		row := reflect.New(elemT)
+		err := it.Next(row.Interface())
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !isPtr {
+			row = row.Elem()
+		}
+
+		if dstV.Kind() == reflect.Chan {
+			chosen, _, _ := reflect.Select([]reflect.SelectCase{
+				{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+				{Dir: reflect.SelectSend, Chan: dstV, Send: row},
+			})
+			if chosen == 0 {
+				return ctx.Err()
+			}
+			continue
+		}
+		dstV.Elem().Set(reflect.Append(dstV.Elem(), row))
+	}
+}
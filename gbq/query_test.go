@@ -0,0 +1,41 @@
+package bqtools
+
+import (
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestQueryParameters(t *testing.T) {
+	given := []bigquery.QueryParameter{{Name: "x", Value: 1}}
+
+	tests := []struct {
+		name    string
+		params  interface{}
+		want    []bigquery.QueryParameter
+		wantErr bool
+	}{
+		{"nil", nil, nil, false},
+		{"parameters", given, given, false},
+		{"named", map[string]interface{}{"to": 2, "from": 1, "ids": []int64{1, 2}},
+			[]bigquery.QueryParameter{{Name: "from", Value: 1}, {Name: "ids", Value: []int64{1, 2}}, {Name: "to", Value: 2}}, false},
+		{"positional", []interface{}{"a", 1.5},
+			[]bigquery.QueryParameter{{Value: "a"}, {Value: 1.5}}, false},
+		{"empty positional", []interface{}{}, []bigquery.QueryParameter{}, false},
+		{"map of strings", map[string]string{"x": "a"}, nil, true},
+		{"single value", 42, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := QueryParameters(tt.params)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("QueryParameters() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("QueryParameters() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
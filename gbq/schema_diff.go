@@ -0,0 +1,347 @@
+package bqtools
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// FieldChangeKind is a FieldChange kind ENUM
+type FieldChangeKind string
+
+// FieldChangeKind ENUM values
+const (
+	FieldAdded              FieldChangeKind = "added"
+	FieldRemoved            FieldChangeKind = "removed"
+	FieldRetyped            FieldChangeKind = "retyped"
+	FieldModeChanged        FieldChangeKind = "mode changed"
+	FieldReordered          FieldChangeKind = "reordered"
+	FieldDescriptionChanged FieldChangeKind = "description changed"
+	FieldPolicyTagsChanged  FieldChangeKind = "policy tags changed"
+)
+
+// BigQuery schema update options a change can be applied with
+const (
+	AllowFieldAddition   = "ALLOW_FIELD_ADDITION"
+	AllowFieldRelaxation = "ALLOW_FIELD_RELAXATION"
+)
+
+// FieldChange is a single difference between two schemas
+type FieldChange struct {
+	Path string // dotted path of the field, e.g. "payload.items.id"
+	Kind FieldChangeKind
+	Old  *bigquery.FieldSchema // nil for added fields
+	New  *bigquery.FieldSchema // nil for removed fields
+
+	OldPosition int // position among its siblings, -1 if not present
+	NewPosition int
+
+	// Compatible is set if the change can be applied to an existing table without rewriting it
+	Compatible bool
+	// UpdateOption is the schema update option a load job needs to apply it ("" if none)
+	UpdateOption string
+	Detail       string
+}
+
+// String implemented for readable diffs
+func (c FieldChange) String() string {
+	verdict := "breaking"
+	if c.Compatible {
+		verdict = "compatible"
+	}
+	s := fmt.Sprintf("%v: %v (%v)", c.Path, c.Kind, verdict)
+	if c.Detail != "" {
+		s += " - " + c.Detail
+	}
+	return s
+}
+
+// SchemaChanges is the result of SchemaDiff
+type SchemaChanges []FieldChange
+
+// HasChanges tells if there are any differences at all
+func (sc SchemaChanges) HasChanges() bool {
+	return len(sc) > 0
+}
+
+// Compatible tells if all changes can be applied to an existing table
+func (sc SchemaChanges) Compatible() bool {
+	return len(sc.Breaking()) == 0
+}
+
+// Breaking returns the changes that cannot be applied to an existing table
+func (sc SchemaChanges) Breaking() SchemaChanges {
+	out := make(SchemaChanges, 0)
+	for _, c := range sc {
+		if !c.Compatible {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// OfKind returns the changes of given kinds
+func (sc SchemaChanges) OfKind(kinds ...FieldChangeKind) SchemaChanges {
+	out := make(SchemaChanges, 0)
+	for _, c := range sc {
+		for _, k := range kinds {
+			if c.Kind == k {
+				out = append(out, c)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// SchemaUpdateOptions returns the schema update options a load job needs to apply the changes
+func (sc SchemaChanges) SchemaUpdateOptions() []string {
+	seen := make(map[string]bool)
+	opts := make([]string, 0)
+	for _, c := range sc {
+		if c.UpdateOption != "" && !seen[c.UpdateOption] {
+			seen[c.UpdateOption] = true
+			opts = append(opts, c.UpdateOption)
+		}
+	}
+	sort.Strings(opts)
+	return opts
+}
+
+// String implemented for readable diffs
+func (sc SchemaChanges) String() string {
+	lines := make([]string, len(sc))
+	for i, c := range sc {
+		lines[i] = c.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// FieldMode returns the BigQuery mode of a field (NULLABLE, REQUIRED or REPEATED)
+func FieldMode(f *bigquery.FieldSchema) string {
+	switch {
+	case f.Repeated:
+		return "REPEATED"
+	case f.Required:
+		return "REQUIRED"
+	}
+	return "NULLABLE"
+}
+
+// SchemaDiff compares schema a (e.g. a live table) with schema b (e.g. the desired one) recursing into
+// RECORD fields. Field names are matched case-insensitively as BigQuery does.
+func SchemaDiff(a bigquery.Schema, b bigquery.Schema) SchemaChanges {
+	changes := make(SchemaChanges, 0)
+	diffFields(a, b, "", &changes)
+	return changes
+}
+
+// diffFields appends the differences between two sibling field lists to changes
+func diffFields(a bigquery.Schema, b bigquery.Schema, prefix string, changes *SchemaChanges) {
+	aIdx := schemaIndex(a)
+	bIdx := schemaIndex(b)
+
+	path := func(name string) string {
+		if prefix == "" {
+			return name
+		}
+		return prefix + "." + name
+	}
+
+	for i, fa := range a {
+		if _, ok := bIdx[strings.ToLower(fa.Name)]; !ok {
+			*changes = append(*changes, FieldChange{
+				Path:        path(fa.Name),
+				Kind:        FieldRemoved,
+				Old:         fa,
+				OldPosition: i,
+				NewPosition: -1,
+				Compatible:  false,
+				Detail:      "columns cannot be dropped in place",
+			})
+		}
+	}
+
+	for j, fb := range b {
+		i, ok := aIdx[strings.ToLower(fb.Name)]
+		if !ok {
+			change := FieldChange{
+				Path:        path(fb.Name),
+				Kind:        FieldAdded,
+				New:         fb,
+				OldPosition: -1,
+				NewPosition: j,
+				Compatible:  !fb.Required,
+			}
+			if change.Compatible {
+				change.UpdateOption = AllowFieldAddition
+			} else {
+				change.Detail = "REQUIRED columns cannot be added to an existing table"
+			}
+			*changes = append(*changes, change)
+			continue
+		}
+
+		fa := a[i]
+		p := path(fb.Name)
+
+		if fa.Type != fb.Type {
+			*changes = append(*changes, FieldChange{
+				Path:        p,
+				Kind:        FieldRetyped,
+				Old:         fa,
+				New:         fb,
+				OldPosition: i,
+				NewPosition: j,
+				Compatible:  false,
+				Detail:      fmt.Sprintf("%v -> %v", fa.Type, fb.Type),
+			})
+		}
+
+		if oldMode, newMode := FieldMode(fa), FieldMode(fb); oldMode != newMode {
+			change := FieldChange{
+				Path:        p,
+				Kind:        FieldModeChanged,
+				Old:         fa,
+				New:         fb,
+				OldPosition: i,
+				NewPosition: j,
+				Compatible:  oldMode == "REQUIRED" && newMode == "NULLABLE",
+				Detail:      fmt.Sprintf("%v -> %v", oldMode, newMode),
+			}
+			if change.Compatible {
+				change.UpdateOption = AllowFieldRelaxation
+			}
+			*changes = append(*changes, change)
+		}
+
+		if fa.Description != fb.Description {
+			*changes = append(*changes, FieldChange{
+				Path:        p,
+				Kind:        FieldDescriptionChanged,
+				Old:         fa,
+				New:         fb,
+				OldPosition: i,
+				NewPosition: j,
+				Compatible:  true,
+			})
+		}
+
+		if !samePolicyTags(fa.PolicyTags, fb.PolicyTags) {
+			*changes = append(*changes, FieldChange{
+				Path:        p,
+				Kind:        FieldPolicyTagsChanged,
+				Old:         fa,
+				New:         fb,
+				OldPosition: i,
+				NewPosition: j,
+				Compatible:  true,
+			})
+		}
+
+		if fa.Type == bigquery.RecordFieldType && fb.Type == bigquery.RecordFieldType {
+			diffFields(fa.Schema, fb.Schema, p, changes)
+		}
+	}
+
+	// Relative order of the fields present on both sides: the longest common subsequence keeps its
+	// order, only the fields outside it have moved
+	aCommon := make([]string, 0)
+	for _, fa := range a {
+		if _, ok := bIdx[strings.ToLower(fa.Name)]; ok {
+			aCommon = append(aCommon, strings.ToLower(fa.Name))
+		}
+	}
+	bCommon := make([]string, 0)
+	for _, fb := range b {
+		if _, ok := aIdx[strings.ToLower(fb.Name)]; ok {
+			bCommon = append(bCommon, strings.ToLower(fb.Name))
+		}
+	}
+	inOrder := longestCommonSubsequence(aCommon, bCommon)
+	for j, fb := range b {
+		i, ok := aIdx[strings.ToLower(fb.Name)]
+		if !ok || inOrder[strings.ToLower(fb.Name)] {
+			continue
+		}
+		*changes = append(*changes, FieldChange{
+			Path:        path(fb.Name),
+			Kind:        FieldReordered,
+			Old:         a[i],
+			New:         fb,
+			OldPosition: i,
+			NewPosition: j,
+			Compatible:  true,
+			Detail:      "column order only matters for positional formats such as CSV",
+		})
+	}
+}
+
+// longestCommonSubsequence returns the elements of a longest common subsequence of two lists of
+// distinct names
+func longestCommonSubsequence(a []string, b []string) map[string]bool {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	in := make(map[string]bool, lcs[0][0])
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] == b[j]:
+			in[a[i]] = true
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return in
+}
+
+// schemaIndex maps lower-cased field names to their positions
+func schemaIndex(s bigquery.Schema) map[string]int {
+	idx := make(map[string]int, len(s))
+	for i, f := range s {
+		idx[strings.ToLower(f.Name)] = i
+	}
+	return idx
+}
+
+// samePolicyTags compares policy tag lists ignoring order
+func samePolicyTags(a *bigquery.PolicyTagList, b *bigquery.PolicyTagList) bool {
+	var an, bn []string
+	if a != nil {
+		an = append(an, a.Names...)
+	}
+	if b != nil {
+		bn = append(bn, b.Names...)
+	}
+	if len(an) != len(bn) {
+		return false
+	}
+	sort.Strings(an)
+	sort.Strings(bn)
+	for i := range an {
+		if an[i] != bn[i] {
+			return false
+		}
+	}
+	return true
+}
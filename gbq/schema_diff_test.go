@@ -0,0 +1,179 @@
+package bqtools
+
+import (
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func field(name string, t bigquery.FieldType) *bigquery.FieldSchema {
+	return &bigquery.FieldSchema{Name: name, Type: t}
+}
+
+func fields(names ...string) bigquery.Schema {
+	s := make(bigquery.Schema, len(names))
+	for i, n := range names {
+		s[i] = field(n, bigquery.StringFieldType)
+	}
+	return s
+}
+
+func TestSchemaDiff(t *testing.T) {
+	required := field("id", bigquery.IntegerFieldType)
+	required.Required = true
+	repeated := field("tags", bigquery.StringFieldType)
+	repeated.Repeated = true
+	described := field("a", bigquery.StringFieldType)
+	described.Description = "the a column"
+
+	tests := []struct {
+		name       string
+		a, b       bigquery.Schema
+		want       []string // "path: kind" of every change, in order
+		compatible bool
+		options    []string
+	}{
+		{
+			name:       "identical",
+			a:          fields("a", "b"),
+			b:          fields("a", "b"),
+			want:       nil,
+			compatible: true,
+		},
+		{
+			name:       "names are case-insensitive",
+			a:          fields("a", "B"),
+			b:          fields("A", "b"),
+			want:       nil,
+			compatible: true,
+		},
+		{
+			name:       "nullable column added",
+			a:          fields("a"),
+			b:          fields("a", "b"),
+			want:       []string{"b: added"},
+			compatible: true,
+			options:    []string{AllowFieldAddition},
+		},
+		{
+			name:       "required column added",
+			a:          fields("a"),
+			b:          bigquery.Schema{field("a", bigquery.StringFieldType), required},
+			want:       []string{"id: added"},
+			compatible: false,
+		},
+		{
+			name:       "column removed",
+			a:          fields("a", "b"),
+			b:          fields("a"),
+			want:       []string{"b: removed"},
+			compatible: false,
+		},
+		{
+			name:       "column retyped",
+			a:          bigquery.Schema{field("a", bigquery.StringFieldType)},
+			b:          bigquery.Schema{field("a", bigquery.IntegerFieldType)},
+			want:       []string{"a: retyped"},
+			compatible: false,
+		},
+		{
+			name:       "required relaxed",
+			a:          bigquery.Schema{required},
+			b:          bigquery.Schema{field("id", bigquery.IntegerFieldType)},
+			want:       []string{"id: mode changed"},
+			compatible: true,
+			options:    []string{AllowFieldRelaxation},
+		},
+		{
+			name:       "nullable made repeated",
+			a:          bigquery.Schema{field("tags", bigquery.StringFieldType)},
+			b:          bigquery.Schema{repeated},
+			want:       []string{"tags: mode changed"},
+			compatible: false,
+		},
+		{
+			name:       "description changed",
+			a:          fields("a"),
+			b:          bigquery.Schema{described},
+			want:       []string{"a: description changed"},
+			compatible: true,
+		},
+		{
+			name: "nested field added",
+			a: bigquery.Schema{&bigquery.FieldSchema{Name: "r", Type: bigquery.RecordFieldType,
+				Schema: fields("x")}},
+			b: bigquery.Schema{&bigquery.FieldSchema{Name: "r", Type: bigquery.RecordFieldType,
+				Schema: fields("x", "y")}},
+			want:       []string{"r.y: added"},
+			compatible: true,
+			options:    []string{AllowFieldAddition},
+		},
+		{
+			name:       "one column moved to the end",
+			a:          fields("a", "b", "c", "d", "e"),
+			b:          fields("b", "c", "d", "e", "a"),
+			want:       []string{"a: reordered"},
+			compatible: true,
+		},
+		{
+			name:       "one column moved to the front",
+			a:          fields("a", "b", "c", "d"),
+			b:          fields("d", "a", "b", "c"),
+			want:       []string{"d: reordered"},
+			compatible: true,
+		},
+		{
+			name:       "order ignores added and removed columns",
+			a:          fields("a", "x", "b"),
+			b:          fields("a", "b", "y"),
+			want:       []string{"x: removed", "y: added"},
+			compatible: false,
+			options:    []string{AllowFieldAddition},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes := SchemaDiff(tt.a, tt.b)
+
+			got := make([]string, len(changes))
+			for i, c := range changes {
+				got[i] = c.Path + ": " + string(c.Kind)
+			}
+			if strings.Join(got, "; ") != strings.Join(tt.want, "; ") {
+				t.Errorf("changes = %v, want %v", got, tt.want)
+			}
+			if changes.Compatible() != tt.compatible {
+				t.Errorf("Compatible() = %v, want %v", changes.Compatible(), tt.compatible)
+			}
+			if opts := changes.SchemaUpdateOptions(); strings.Join(opts, ",") != strings.Join(tt.options, ",") {
+				t.Errorf("SchemaUpdateOptions() = %v, want %v", opts, tt.options)
+			}
+		})
+	}
+}
+
+func TestSchemasMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		s1, s2 bigquery.Schema
+		want   bool
+	}{
+		{"identical", fields("a", "b"), fields("a", "b"), true},
+		{"extra trailing fields", fields("a"), fields("a", "b"), true},
+		{"missing fields", fields("a", "b"), fields("a"), false},
+		{"empty second schema", fields("a"), nil, false},
+		{"different order", fields("a", "b"), fields("b", "a"), false},
+		{"different type", bigquery.Schema{field("a", bigquery.StringFieldType)},
+			bigquery.Schema{field("a", bigquery.IntegerFieldType)}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SchemasMatch(tt.s1, tt.s2); got != tt.want {
+				t.Errorf("SchemasMatch() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package bqtools
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+
+	bu "github.com/belboo/boo-go-tools/misc"
+)
+
+// SchemaMigration describes the schema changes planned for or applied to a table
+type SchemaMigration struct {
+	Dataset string
+	Table   string
+	ETag    string // etag of the table metadata the plan was made against
+
+	Changes  SchemaChanges // everything SchemaDiff found
+	Apply    SchemaChanges // safe changes applied by a metadata update
+	Skip     SchemaChanges // compatible changes not applied: column order, descriptions and policy tags unless opted in
+	Breaking SchemaChanges // changes needing a table rewrite, a migration with any of these is refused
+
+	Schema  bigquery.Schema // the schema after applying Apply to the live schema
+	Applied bool
+}
+
+// SchemaMigrationOptions selects the optional parts of a schema migration. Column descriptions and policy
+// tags are only reported by default: a desired schema inferred from a Go struct has neither, applying it
+// would wipe documentation and access control. Even when opted in, empty desired values keep the live ones.
+type SchemaMigrationOptions struct {
+	UpdateDescriptions bool
+	UpdatePolicyTags   bool
+}
+
+// NeedsUpdate tells if applying the migration would change the table
+func (m *SchemaMigration) NeedsUpdate() bool {
+	return len(m.Apply) > 0
+}
+
+// String implemented for readable plans
+func (m *SchemaMigration) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "schema migration of %v.%v:", m.Dataset, m.Table)
+	if !m.Changes.HasChanges() {
+		sb.WriteString(" up to date")
+		return sb.String()
+	}
+	for _, group := range []struct {
+		title   string
+		changes SchemaChanges
+	}{{"apply", m.Apply}, {"skip", m.Skip}, {"breaking", m.Breaking}} {
+		for _, c := range group.changes {
+			fmt.Fprintf(&sb, "\n  [%v] %v", group.title, c)
+		}
+	}
+	return sb.String()
+}
+
+// PlanTableSchemaMigration diffs the live schema of bqDataset.bqTable against desired without changing anything
+func PlanTableSchemaMigration(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string, desired bigquery.Schema) (*SchemaMigration, error) {
+	return PlanTableSchemaMigrationWithOptions(ctx, bqClient, bqDataset, bqTable, desired, SchemaMigrationOptions{})
+}
+
+// PlanTableSchemaMigrationWithOptions is PlanTableSchemaMigration with opted in description and policy tag updates
+func PlanTableSchemaMigrationWithOptions(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string,
+	desired bigquery.Schema, opts SchemaMigrationOptions) (*SchemaMigration, error) {
+
+	tMeta, err := getTableMeta(ctx, bqClient, bqDataset, bqTable, "PlanTableSchemaMigration")
+	if err != nil {
+		return nil, err
+	}
+
+	return planSchemaMigration(bqDataset, bqTable, tMeta, desired, opts), nil
+}
+
+// MigrateTableSchema brings the schema of an existing table in line with desired by adding NULLABLE
+// (or REPEATED) columns and relaxing REQUIRED columns, descriptions and policy tags are left alone.
+// Migrations with breaking changes are refused with ErrSchemaMismatch and nothing is changed.
+func MigrateTableSchema(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string, desired bigquery.Schema) (*SchemaMigration, error) {
+	return MigrateTableSchemaWithOptions(ctx, bqClient, bqDataset, bqTable, desired, SchemaMigrationOptions{})
+}
+
+// MigrateTableSchemaWithOptions is MigrateTableSchema also updating descriptions and policy tags if opted in
+func MigrateTableSchemaWithOptions(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string,
+	desired bigquery.Schema, opts SchemaMigrationOptions) (*SchemaMigration, error) {
+
+	m, err := PlanTableSchemaMigrationWithOptions(ctx, bqClient, bqDataset, bqTable, desired, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(m.Breaking) > 0 {
+		return m, bu.TError{
+			Msg:    fmt.Sprintf("refusing to migrate %v.%v, %v breaking changes:\n%v", bqDataset, bqTable, len(m.Breaking), m.Breaking),
+			Origin: "MigrateTableSchema",
+			Code:   bu.ErrSchemaMismatch,
+			Err:    nil,
+		}
+	}
+
+	if !m.NeedsUpdate() {
+		return m, nil
+	}
+
+	t := bqClient.Dataset(bqDataset).Table(bqTable)
+	if _, err := t.Update(ctx, bigquery.TableMetadataToUpdate{Schema: m.Schema}, m.ETag); err != nil {
+		if erg, ok := err.(*googleapi.Error); ok && erg.Code == http.StatusPreconditionFailed {
+			return m, bu.TError{
+				Msg:    fmt.Sprintf("%v.%v changed since the migration was planned, re-run to plan again", bqDataset, bqTable),
+				Origin: "MigrateTableSchema",
+				Code:   bu.ErrUpdateTable,
+				Err:    err,
+			}
+		}
+		return m, bu.TError{
+			Msg:    fmt.Sprintf("failed to update the schema of %v.%v", bqDataset, bqTable),
+			Origin: "MigrateTableSchema",
+			Code:   bu.ErrUpdateTable,
+			Err:    err,
+		}
+	}
+	m.Applied = true
+
+	return m, nil
+}
+
+// planSchemaMigration sorts the diff between the live and desired schemas into a migration plan
+func planSchemaMigration(bqDataset string, bqTable string, tMeta *bigquery.TableMetadata, desired bigquery.Schema, opts SchemaMigrationOptions) *SchemaMigration {
+	m := &SchemaMigration{
+		Dataset:  bqDataset,
+		Table:    bqTable,
+		ETag:     tMeta.ETag,
+		Changes:  SchemaDiff(tMeta.Schema, desired),
+		Apply:    make(SchemaChanges, 0),
+		Skip:     make(SchemaChanges, 0),
+		Breaking: make(SchemaChanges, 0),
+	}
+
+	for _, c := range m.Changes {
+		switch {
+		case !c.Compatible:
+			m.Breaking = append(m.Breaking, c)
+		case c.Kind == FieldReordered,
+			c.Kind == FieldDescriptionChanged && !(opts.UpdateDescriptions && c.New.Description != ""),
+			c.Kind == FieldPolicyTagsChanged && !(opts.UpdatePolicyTags && hasPolicyTags(c.New)):
+			m.Skip = append(m.Skip, c)
+		default:
+			m.Apply = append(m.Apply, c)
+		}
+	}
+
+	m.Schema = mergeSchema(tMeta.Schema, desired, opts)
+
+	return m
+}
+
+// mergeSchema applies the compatible parts of desired to live, keeping the live column order
+func mergeSchema(live bigquery.Schema, desired bigquery.Schema, opts SchemaMigrationOptions) bigquery.Schema {
+	desiredIdx := schemaIndex(desired)
+	liveIdx := schemaIndex(live)
+
+	merged := make(bigquery.Schema, 0, len(live)+len(desired))
+	for _, lf := range live {
+		f := *lf
+		if j, ok := desiredIdx[strings.ToLower(lf.Name)]; ok {
+			df := desired[j]
+			if f.Required && FieldMode(df) == "NULLABLE" {
+				f.Required = false
+			}
+			if opts.UpdateDescriptions && df.Description != "" {
+				f.Description = df.Description
+			}
+			if opts.UpdatePolicyTags && hasPolicyTags(df) {
+				f.PolicyTags = df.PolicyTags
+			}
+			if f.Type == bigquery.RecordFieldType && df.Type == bigquery.RecordFieldType {
+				f.Schema = mergeSchema(lf.Schema, df.Schema, opts)
+			}
+		}
+		merged = append(merged, &f)
+	}
+
+	for _, df := range desired {
+		if _, ok := liveIdx[strings.ToLower(df.Name)]; !ok && !df.Required {
+			f := *df
+			merged = append(merged, &f)
+		}
+	}
+
+	return merged
+}
+
+// hasPolicyTags tells if a field has any policy tags
+func hasPolicyTags(f *bigquery.FieldSchema) bool {
+	return f.PolicyTags != nil && len(f.PolicyTags.Names) > 0
+}
+
+// isNotFound checks if a BQ API error is a notFound one
+func isNotFound(err error) bool {
+	if erg, ok := err.(*googleapi.Error); ok {
+		return erg.Code == http.StatusNotFound && (len(erg.Errors) == 0 || erg.Errors[0].Reason == "notFound")
+	}
+	return false
+}
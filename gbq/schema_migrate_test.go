@@ -0,0 +1,191 @@
+package bqtools
+
+import (
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// withDocs returns a copy of f with a description and a policy tag
+func withDocs(f *bigquery.FieldSchema, desc string, tag string) *bigquery.FieldSchema {
+	c := *f
+	c.Description = desc
+	if tag != "" {
+		c.PolicyTags = &bigquery.PolicyTagList{Names: []string{tag}}
+	}
+	return &c
+}
+
+func TestMergeSchema(t *testing.T) {
+	required := field("id", bigquery.IntegerFieldType)
+	required.Required = true
+	nullable := field("id", bigquery.IntegerFieldType)
+	documented := withDocs(field("a", bigquery.StringFieldType), "live a", "tags/live")
+	record := field("r", bigquery.RecordFieldType)
+	record.Schema = bigquery.Schema{documented}
+	newRequired := field("n", bigquery.StringFieldType)
+	newRequired.Required = true
+
+	tests := []struct {
+		name    string
+		live    bigquery.Schema
+		desired bigquery.Schema
+		opts    SchemaMigrationOptions
+		want    bigquery.Schema
+	}{
+		{
+			name:    "nullable columns are added at the end",
+			live:    fields("a", "b"),
+			desired: fields("c", "b", "a"),
+			want:    fields("a", "b", "c"),
+		},
+		{
+			name:    "required columns are not added",
+			live:    fields("a"),
+			desired: bigquery.Schema{field("a", bigquery.StringFieldType), newRequired},
+			want:    fields("a"),
+		},
+		{
+			name:    "relaxed",
+			live:    bigquery.Schema{required},
+			desired: bigquery.Schema{nullable},
+			want:    bigquery.Schema{nullable},
+		},
+		{
+			name:    "never tightened",
+			live:    bigquery.Schema{nullable},
+			desired: bigquery.Schema{required},
+			want:    bigquery.Schema{nullable},
+		},
+		{
+			name:    "docs kept by default",
+			live:    bigquery.Schema{documented},
+			desired: bigquery.Schema{withDocs(field("a", bigquery.StringFieldType), "new a", "tags/new")},
+			want:    bigquery.Schema{documented},
+		},
+		{
+			name:    "docs kept when the desired ones are empty",
+			live:    bigquery.Schema{documented},
+			desired: fields("a"),
+			opts:    SchemaMigrationOptions{UpdateDescriptions: true, UpdatePolicyTags: true},
+			want:    bigquery.Schema{documented},
+		},
+		{
+			name:    "docs updated when opted in",
+			live:    bigquery.Schema{documented},
+			desired: bigquery.Schema{withDocs(field("a", bigquery.StringFieldType), "new a", "tags/new")},
+			opts:    SchemaMigrationOptions{UpdateDescriptions: true, UpdatePolicyTags: true},
+			want:    bigquery.Schema{withDocs(field("a", bigquery.StringFieldType), "new a", "tags/new")},
+		},
+		{
+			name:    "only descriptions opted in",
+			live:    bigquery.Schema{documented},
+			desired: bigquery.Schema{withDocs(field("a", bigquery.StringFieldType), "new a", "tags/new")},
+			opts:    SchemaMigrationOptions{UpdateDescriptions: true},
+			want:    bigquery.Schema{withDocs(field("a", bigquery.StringFieldType), "new a", "tags/live")},
+		},
+		{
+			name: "nested records are merged",
+			live: bigquery.Schema{record},
+			desired: bigquery.Schema{{Name: "r", Type: bigquery.RecordFieldType,
+				Schema: bigquery.Schema{field("a", bigquery.StringFieldType), field("b", bigquery.StringFieldType)}}},
+			want: bigquery.Schema{{Name: "r", Type: bigquery.RecordFieldType,
+				Schema: bigquery.Schema{documented, field("b", bigquery.StringFieldType)}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeSchema(tt.live, tt.desired, tt.opts)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeSchema() = %v, want %v", schemaString(got), schemaString(tt.want))
+			}
+		})
+	}
+
+	if live := (bigquery.Schema{documented}); mergeSchema(live, fields("a"), SchemaMigrationOptions{})[0] == documented {
+		t.Errorf("mergeSchema() returned a live field instead of a copy")
+	}
+}
+
+func TestPlanSchemaMigration(t *testing.T) {
+	live := bigquery.Schema{withDocs(field("a", bigquery.StringFieldType), "live a", ""), field("b", bigquery.StringFieldType)}
+	desired := bigquery.Schema{field("b", bigquery.StringFieldType), withDocs(field("a", bigquery.StringFieldType), "new a", ""),
+		field("c", bigquery.StringFieldType)}
+
+	tests := []struct {
+		name         string
+		opts         SchemaMigrationOptions
+		wantApply    []FieldChangeKind
+		wantSkip     []FieldChangeKind
+		wantBreaking int
+	}{
+		{"descriptions skipped", SchemaMigrationOptions{}, []FieldChangeKind{FieldAdded},
+			[]FieldChangeKind{FieldReordered, FieldDescriptionChanged}, 0},
+		{"descriptions applied", SchemaMigrationOptions{UpdateDescriptions: true}, []FieldChangeKind{FieldDescriptionChanged, FieldAdded},
+			[]FieldChangeKind{FieldReordered}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := planSchemaMigration("ds", "t", &bigquery.TableMetadata{Schema: live}, desired, tt.opts)
+			if got := changeKinds(m.Apply); !sameKinds(got, tt.wantApply) {
+				t.Errorf("Apply = %v, want %v", got, tt.wantApply)
+			}
+			if got := changeKinds(m.Skip); !sameKinds(got, tt.wantSkip) {
+				t.Errorf("Skip = %v, want %v", got, tt.wantSkip)
+			}
+			if len(m.Breaking) != tt.wantBreaking {
+				t.Errorf("Breaking = %v, want %v changes", m.Breaking, tt.wantBreaking)
+			}
+		})
+	}
+
+	m := planSchemaMigration("ds", "t", &bigquery.TableMetadata{Schema: live}, bigquery.Schema{field("a", bigquery.IntegerFieldType)}, SchemaMigrationOptions{})
+	if len(m.Breaking) == 0 {
+		t.Errorf("retyping a column is not breaking: %v", m)
+	}
+}
+
+func changeKinds(changes SchemaChanges) []FieldChangeKind {
+	kinds := make([]FieldChangeKind, len(changes))
+	for i, c := range changes {
+		kinds[i] = c.Kind
+	}
+	return kinds
+}
+
+// sameKinds compares kinds ignoring their order
+func sameKinds(a []FieldChangeKind, b []FieldChangeKind) bool {
+	count := make(map[FieldChangeKind]int)
+	for _, k := range a {
+		count[k]++
+	}
+	for _, k := range b {
+		count[k]--
+	}
+	for _, n := range count {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func schemaString(s bigquery.Schema) string {
+	out := "["
+	for i, f := range s {
+		if i > 0 {
+			out += " "
+		}
+		out += f.Name + ":" + string(f.Type) + ":" + FieldMode(f) + ":" + f.Description
+		if f.PolicyTags != nil {
+			out += ":" + f.PolicyTags.Names[0]
+		}
+		if len(f.Schema) > 0 {
+			out += schemaString(f.Schema)
+		}
+	}
+	return out + "]"
+}
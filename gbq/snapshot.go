@@ -0,0 +1,269 @@
+package bqtools
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/net/context"
+
+	bu "github.com/belboo/boo-go-tools/misc"
+)
+
+// SnapshotOptions tunes SnapshotTable
+type SnapshotOptions struct {
+	// Dataset and Table of the snapshot, default to the table's dataset and <table>_snapshot_<YYYYMMDDhhmmss>_<random hex>
+	// (snapshots taken within the same second do not collide)
+	Dataset string
+	Table   string
+	// Expiration of the snapshot from now, 0 never expires
+	Expiration time.Duration
+	// AsOf snapshots the table as it was at a time within the time travel window, zero for now
+	AsOf time.Time
+}
+
+// Snapshot identifies a table snapshot
+type Snapshot struct {
+	Dataset string
+	Table   string
+	Time    time.Time // state of the source table captured
+}
+
+// SnapshotTable creates a (read-only, cheap) BigQuery snapshot of bqDataset.bqTable
+func SnapshotTable(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string, opts SnapshotOptions) (*Snapshot, error) {
+	snap := &Snapshot{Dataset: opts.Dataset, Table: opts.Table, Time: opts.AsOf.UTC()}
+	if snap.Time.IsZero() {
+		snap.Time = time.Now().UTC()
+	}
+	if snap.Dataset == "" {
+		snap.Dataset = bqDataset
+	}
+	if snap.Table == "" {
+		snap.Table = snapshotName(bqTable, snap.Time)
+	}
+
+	sql := fmt.Sprintf("CREATE SNAPSHOT TABLE `%v`.`%v` CLONE `%v`.`%v`", snap.Dataset, snap.Table, bqDataset, bqTable)
+	params := make([]bigquery.QueryParameter, 0, 2)
+	if !opts.AsOf.IsZero() {
+		sql += " FOR SYSTEM_TIME AS OF @asof"
+		params = append(params, bigquery.QueryParameter{Name: "asof", Value: opts.AsOf.UTC()})
+	}
+	if opts.Expiration > 0 {
+		sql += " OPTIONS(expiration_timestamp = @expiration)"
+		params = append(params, bigquery.QueryParameter{Name: "expiration", Value: time.Now().Add(opts.Expiration).UTC()})
+	}
+
+	if _, err := RunQuery(ctx, bqClient, sql, params, nil, QueryOptions{}); err != nil {
+		return nil, bu.TError{
+			Msg:    fmt.Sprintf("failed to snapshot %v.%v into %v.%v", bqDataset, bqTable, snap.Dataset, snap.Table),
+			Origin: "SnapshotTable",
+			Code:   bu.ErrCreateTable,
+			Err:    err,
+		}
+	}
+
+	return snap, nil
+}
+
+// snapshotName is the default name of a snapshot of bqTable taken at t
+func snapshotName(bqTable string, t time.Time) string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%v_snapshot_%v_%v", bqTable, t.UTC().Format("20060102150405"), hex.EncodeToString(suffix))
+}
+
+// RestoreSource is what RestoreTable and RestorePartition restore from: a snapshot or, if Snapshot
+// is nil, the table itself as it was at AsOf (within the time travel window, 7 days by default)
+type RestoreSource struct {
+	Snapshot *Snapshot
+	AsOf     time.Time
+}
+
+// RestoreTable replaces the content of bqDataset.bqTable with a snapshot or with the table as it was at
+// src.AsOf, both with a restore copy job so that the table's schema (descriptions, policy tags), partitioning
+// and clustering stay. A time travel restore goes through a temporary snapshot of the table at src.AsOf.
+func RestoreTable(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string, src RestoreSource) error {
+	if err := checkRestoreSource(src, "RestoreTable"); err != nil {
+		return err
+	}
+	if err := autoSnapshot(ctx, bqClient, bqDataset, bqTable, "RestoreTable"); err != nil {
+		return err
+	}
+
+	snap := src.Snapshot
+	if snap == nil {
+		var err error
+		snap, err = SnapshotTable(ctx, bqClient, bqDataset, bqTable, SnapshotOptions{AsOf: src.AsOf, Expiration: 24 * time.Hour})
+		if err != nil {
+			return bu.TError{
+				Msg:    fmt.Sprintf("failed to snapshot %v.%v as of %v", bqDataset, bqTable, src.AsOf),
+				Origin: "RestoreTable",
+				Code:   bu.ErrCreateTable,
+				Err:    err,
+			}
+		}
+		defer bqClient.Dataset(snap.Dataset).Table(snap.Table).Delete(context.Background())
+	}
+
+	return restoreSnapshot(ctx, bqClient, bqDataset, bqTable, snap, "RestoreTable")
+}
+
+// restoreSnapshot overwrites bqDataset.bqTable with a snapshot using a restore copy job
+func restoreSnapshot(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string, snap *Snapshot, origin string) error {
+	snapT := bqClient.Dataset(snap.Dataset).Table(snap.Table)
+	copier := bqClient.Dataset(bqDataset).Table(bqTable).CopierFrom(snapT)
+	copier.OperationType = bigquery.RestoreOperation
+	copier.WriteDisposition = bigquery.WriteTruncate
+	copier.CreateDisposition = bigquery.CreateIfNeeded
+
+	job, err := copier.Run(ctx)
+	if err == nil {
+		var status *bigquery.JobStatus
+		if status, err = job.Wait(ctx); err == nil {
+			err = status.Err()
+		}
+	}
+	if err != nil {
+		return bu.TError{
+			Msg:    fmt.Sprintf("failed to restore %v.%v from snapshot %v.%v", bqDataset, bqTable, snap.Dataset, snap.Table),
+			Origin: origin,
+			Code:   bu.ErrAPI,
+			Err:    err,
+		}
+	}
+	return nil
+}
+
+// RestorePartition replaces a partition (anything PartitionFor accepts) of bqDataset.bqTable with the same
+// partition of a snapshot or of the table as it was at src.AsOf
+func RestorePartition(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string, partition interface{}, src RestoreSource) error {
+	if err := checkRestoreSource(src, "RestorePartition"); err != nil {
+		return err
+	}
+	tMeta, err := getTableMeta(ctx, bqClient, bqDataset, bqTable, "RestorePartition")
+	if err != nil {
+		return err
+	}
+	p, err := PartitionFor(tMeta, partition)
+	if err != nil {
+		return err
+	}
+	if p.IsSpecial() {
+		return bu.TError{
+			Msg:    fmt.Sprintf("partition %v of %v.%v cannot be restored", p, bqDataset, bqTable),
+			Origin: "RestorePartition",
+			Code:   bu.ErrConfigError,
+			Err:    nil,
+		}
+	}
+
+	cond, params, err := partitionSQL(tMeta, "t", p)
+	if err != nil {
+		return err
+	}
+	if err := autoSnapshot(ctx, bqClient, bqDataset, bqTable, "RestorePartition"); err != nil {
+		return err
+	}
+	return restoreQuery(ctx, bqClient, bqDataset, bqTable, p.Decorator(bqTable), src, "WHERE "+cond, params, "RestorePartition")
+}
+
+// checkRestoreSource makes sure a restore source is set
+func checkRestoreSource(src RestoreSource, origin string) error {
+	if src.Snapshot == nil && src.AsOf.IsZero() {
+		return bu.TError{
+			Msg:    "neither a snapshot nor a time to restore from",
+			Origin: origin,
+			Code:   bu.ErrConfigError,
+			Err:    nil,
+		}
+	}
+	return nil
+}
+
+// restoreQuery overwrites dst (bqTable, possibly decorated) with the rows of the restore source matching where
+func restoreQuery(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string, dst string,
+	src RestoreSource, where string, params []bigquery.QueryParameter, origin string) error {
+
+	var from string
+	if src.Snapshot != nil {
+		from = fmt.Sprintf("`%v`.`%v` AS t", src.Snapshot.Dataset, src.Snapshot.Table)
+	} else {
+		from = fmt.Sprintf("`%v`.`%v` FOR SYSTEM_TIME AS OF @asof AS t", bqDataset, bqTable)
+		params = append(append([]bigquery.QueryParameter{}, params...), bigquery.QueryParameter{Name: "asof", Value: src.AsOf.UTC()})
+	}
+
+	_, err := RunQuery(ctx, bqClient, fmt.Sprintf("SELECT t.* FROM %v %v", from, where), params, nil, QueryOptions{
+		DstDataset:        bqDataset,
+		DstTable:          dst,
+		WriteDisposition:  bigquery.WriteTruncate,
+		CreateDisposition: bigquery.CreateNever,
+		Labels:            map[string]string{"bqtools": "restore"},
+	})
+	if err != nil {
+		return bu.TError{
+			Msg:    fmt.Sprintf("failed to restore %v.%v", bqDataset, dst),
+			Origin: origin,
+			Code:   bu.ErrAPI,
+			Err:    err,
+		}
+	}
+	return nil
+}
+
+// AutoSnapshotPolicy makes destructive bqtools calls (partition drops and replaces, truncating loads, Dedup,
+// SyncPartitions overwriting stale partitions and restores) snapshot the affected table first
+type AutoSnapshotPolicy struct {
+	Dataset    string        // where snapshots go, defaults to the table's dataset
+	Expiration time.Duration // defaults to 7 days
+}
+
+var (
+	autoSnapshotMu       sync.RWMutex
+	autoSnapshotPolicies = make(map[*bigquery.Client]*AutoSnapshotPolicy)
+)
+
+// SetAutoSnapshot turns automatic snapshots before destructive calls with a client on, nil turns them off
+func SetAutoSnapshot(bqClient *bigquery.Client, policy *AutoSnapshotPolicy) {
+	autoSnapshotMu.Lock()
+	defer autoSnapshotMu.Unlock()
+	if policy == nil {
+		delete(autoSnapshotPolicies, bqClient)
+		return
+	}
+	p := *policy
+	if p.Expiration <= 0 {
+		p.Expiration = 7 * 24 * time.Hour
+	}
+	autoSnapshotPolicies[bqClient] = &p
+}
+
+// autoSnapshot snapshots a table (bqTable may be partition decorated) about to be modified if the client has
+// an AutoSnapshotPolicy, a failed snapshot stops the destructive call. Missing tables have nothing to keep.
+func autoSnapshot(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string, origin string) error {
+	autoSnapshotMu.RLock()
+	policy := autoSnapshotPolicies[bqClient]
+	autoSnapshotMu.RUnlock()
+	if policy == nil {
+		return nil
+	}
+
+	bqTable = strings.SplitN(bqTable, "$", 2)[0]
+	if _, err := bqClient.Dataset(bqDataset).Table(bqTable).Metadata(ctx); isNotFound(err) {
+		return nil
+	}
+
+	_, err := SnapshotTable(ctx, bqClient, bqDataset, bqTable, SnapshotOptions{Dataset: policy.Dataset, Expiration: policy.Expiration})
+	if err != nil {
+		return bu.TError{
+			Msg:    fmt.Sprintf("automatic snapshot of %v.%v failed, nothing changed", bqDataset, bqTable),
+			Origin: origin,
+			Code:   bu.ErrCreateTable,
+			Err:    err,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package bqtools
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/net/context"
+)
+
+func TestSnapshotName(t *testing.T) {
+	at := time.Date(2019, 5, 28, 14, 30, 5, 0, time.FixedZone("CEST", 2*60*60))
+	format := regexp.MustCompile(`^events_snapshot_20190528123005_[0-9a-f]{8}$`)
+
+	a, b := snapshotName("events", at), snapshotName("events", at)
+	if !format.MatchString(a) {
+		t.Errorf("snapshotName() = %v, want events_snapshot_<UTC time>_<8 hex>", a)
+	}
+	if a == b {
+		t.Errorf("snapshotName() = %v twice for the same second", a)
+	}
+}
+
+func TestCheckRestoreSource(t *testing.T) {
+	tests := []struct {
+		src     RestoreSource
+		wantErr bool
+	}{
+		{RestoreSource{}, true},
+		{RestoreSource{Snapshot: &Snapshot{Dataset: "ds", Table: "s"}}, false},
+		{RestoreSource{AsOf: time.Now().Add(-time.Hour)}, false},
+	}
+
+	for _, tt := range tests {
+		if err := checkRestoreSource(tt.src, "test"); (err != nil) != tt.wantErr {
+			t.Errorf("checkRestoreSource(%+v) error = %v, wantErr %v", tt.src, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSetAutoSnapshot(t *testing.T) {
+	client := &bigquery.Client{}
+	policy := func() *AutoSnapshotPolicy {
+		autoSnapshotMu.RLock()
+		defer autoSnapshotMu.RUnlock()
+		return autoSnapshotPolicies[client]
+	}
+
+	given := &AutoSnapshotPolicy{Dataset: "snapshots"}
+	SetAutoSnapshot(client, given)
+	got := policy()
+	if got == nil || got == given || got.Dataset != "snapshots" || got.Expiration != 7*24*time.Hour {
+		t.Errorf("SetAutoSnapshot() stored %+v, want a copy expiring in 7 days", got)
+	}
+	given.Dataset = "changed"
+	if policy().Dataset != "snapshots" {
+		t.Errorf("SetAutoSnapshot() policy changes with the caller's")
+	}
+
+	SetAutoSnapshot(client, &AutoSnapshotPolicy{Expiration: time.Hour})
+	if got := policy(); got.Expiration != time.Hour || got.Dataset != "" {
+		t.Errorf("SetAutoSnapshot() stored %+v, want the given expiration", got)
+	}
+
+	SetAutoSnapshot(client, nil)
+	if got := policy(); got != nil {
+		t.Errorf("SetAutoSnapshot(nil) left %+v", got)
+	}
+	// without a policy nothing is looked up, which would fail with this client
+	if err := autoSnapshot(context.Background(), client, "ds", "t$20190528", "test"); err != nil {
+		t.Errorf("autoSnapshot() without a policy error = %v", err)
+	}
+}
@@ -0,0 +1,385 @@
+package bqtools
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/net/context"
+
+	bu "github.com/belboo/boo-go-tools/misc"
+)
+
+// PartitionType is a TableSpec partitioning ENUM
+type PartitionType string
+
+// PartitionType ENUM values
+const (
+	PartitionNone         PartitionType = ""
+	PartitionHour         PartitionType = "HOUR"
+	PartitionDay          PartitionType = "DAY"
+	PartitionMonth        PartitionType = "MONTH"
+	PartitionYear         PartitionType = "YEAR"
+	PartitionIntegerRange PartitionType = "RANGE"
+)
+
+// TableSpec is a declarative description of a BQ table
+type TableSpec struct {
+	Schema bigquery.Schema
+	// Description of the table, left alone on existing tables when empty unless ClearDescription is set
+	Description      string
+	ClearDescription bool
+	Labels           map[string]string
+
+	// PartitionType selects time (HOUR/DAY/MONTH/YEAR) or integer range partitioning
+	PartitionType PartitionType
+	// PartitionField is the partitioning column, empty means ingestion time for time partitioning
+	PartitionField string
+	// RangeStart, RangeEnd and RangeInterval define integer range partitions
+	RangeStart    int64
+	RangeEnd      int64
+	RangeInterval int64
+	// PartitionExpiration drops time partitions older than this, 0 keeps them forever
+	PartitionExpiration time.Duration
+	// RequirePartitionFilter rejects queries not filtering on the partitioning column
+	RequirePartitionFilter bool
+
+	// TableExpiration deletes the table this long after it was created, 0 never
+	TableExpiration time.Duration
+
+	ClusteringFields []string
+	// KMSKeyName is an optional Cloud KMS key the table is encrypted with
+	KMSKeyName string
+
+	// SchemaOptions opts in to column description and policy tag updates of existing tables
+	SchemaOptions SchemaMigrationOptions
+}
+
+// Validate checks the spec for inconsistent settings
+func (spec TableSpec) Validate() error {
+	var problem string
+
+	switch spec.PartitionType {
+	case PartitionNone:
+		if spec.PartitionField != "" || spec.PartitionExpiration != 0 || spec.RequirePartitionFilter {
+			problem = "partitioning options given for an unpartitioned table"
+		}
+	case PartitionHour, PartitionDay, PartitionMonth, PartitionYear:
+	case PartitionIntegerRange:
+		switch {
+		case spec.PartitionField == "":
+			problem = "integer range partitioning needs a partition field"
+		case spec.RangeInterval <= 0 || spec.RangeEnd <= spec.RangeStart:
+			problem = fmt.Sprintf("invalid integer range [%v, %v) / %v", spec.RangeStart, spec.RangeEnd, spec.RangeInterval)
+		case spec.PartitionExpiration != 0:
+			problem = "partition expiration is not supported for integer range partitioning"
+		}
+	default:
+		problem = fmt.Sprintf("unknown partition type %v", spec.PartitionType)
+	}
+
+	if problem == "" && spec.ClearDescription && spec.Description != "" {
+		problem = "a description is given while clearing it"
+	}
+	if problem == "" && len(spec.ClusteringFields) > 4 {
+		problem = "at most 4 clustering fields are allowed"
+	}
+	if problem == "" && spec.PartitionField != "" && len(spec.Schema) > 0 && !HasField(&spec.Schema, spec.PartitionField) {
+		problem = fmt.Sprintf("partition field %v is not in the schema", spec.PartitionField)
+	}
+	for _, f := range spec.ClusteringFields {
+		if problem == "" && len(spec.Schema) > 0 && !HasField(&spec.Schema, f) {
+			problem = fmt.Sprintf("clustering field %v is not in the schema", f)
+		}
+	}
+
+	if problem != "" {
+		return bu.TError{
+			Msg:    problem,
+			Origin: "TableSpec.Validate",
+			Code:   bu.ErrConfigError,
+			Err:    nil,
+		}
+	}
+	return nil
+}
+
+// timePartitioning returns the spec's time partitioning or nil
+func (spec TableSpec) timePartitioning() *bigquery.TimePartitioning {
+	switch spec.PartitionType {
+	case PartitionHour, PartitionDay, PartitionMonth, PartitionYear:
+		return &bigquery.TimePartitioning{
+			Type:       bigquery.TimePartitioningType(spec.PartitionType),
+			Field:      spec.PartitionField,
+			Expiration: spec.PartitionExpiration,
+		}
+	}
+	return nil
+}
+
+// rangePartitioning returns the spec's integer range partitioning or nil
+func (spec TableSpec) rangePartitioning() *bigquery.RangePartitioning {
+	if spec.PartitionType != PartitionIntegerRange {
+		return nil
+	}
+	return &bigquery.RangePartitioning{
+		Field: spec.PartitionField,
+		Range: &bigquery.RangePartitioningRange{
+			Start:    spec.RangeStart,
+			End:      spec.RangeEnd,
+			Interval: spec.RangeInterval,
+		},
+	}
+}
+
+// clustering returns the spec's clustering or nil
+func (spec TableSpec) clustering() *bigquery.Clustering {
+	if len(spec.ClusteringFields) == 0 {
+		return nil
+	}
+	return &bigquery.Clustering{Fields: spec.ClusteringFields}
+}
+
+// expirationTime returns the absolute table expiration or the zero time
+func (spec TableSpec) expirationTime() time.Time {
+	if spec.TableExpiration <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(spec.TableExpiration)
+}
+
+// TableMetadata builds the metadata a table matching the spec is created with
+func (spec TableSpec) TableMetadata(bqTable string) (*bigquery.TableMetadata, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+
+	tMeta := &bigquery.TableMetadata{
+		Name:                   bqTable,
+		Schema:                 spec.Schema,
+		Description:            spec.Description,
+		Labels:                 spec.Labels,
+		TimePartitioning:       spec.timePartitioning(),
+		RangePartitioning:      spec.rangePartitioning(),
+		RequirePartitionFilter: spec.RequirePartitionFilter,
+		Clustering:             spec.clustering(),
+		ExpirationTime:         spec.expirationTime(),
+	}
+	if spec.KMSKeyName != "" {
+		tMeta.EncryptionConfig = &bigquery.EncryptionConfig{KMSKeyName: spec.KMSKeyName}
+	}
+
+	return tMeta, nil
+}
+
+// CreateTable creates bqDataset.bqTable according to spec, an existing table is an ErrCreateTable error
+func CreateTable(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string, spec TableSpec) error {
+	tMeta, err := spec.TableMetadata(bqTable)
+	if err != nil {
+		return err
+	}
+
+	if err := bqClient.Dataset(bqDataset).Table(bqTable).Create(ctx, tMeta); err != nil {
+		return bu.TError{
+			Msg:    fmt.Sprintf("failed to create bqTable %v.%v", bqDataset, bqTable),
+			Origin: "CreateTable",
+			Code:   bu.ErrCreateTable,
+			Err:    err,
+		}
+	}
+	return nil
+}
+
+// TableReconciliation is the outcome of CreateOrUpdateTable
+type TableReconciliation struct {
+	Created bool
+	Updated []string // names of the table properties updated
+	Schema  *SchemaMigration
+}
+
+// CreateOrUpdateTable creates bqDataset.bqTable from spec or reconciles an existing table with it.
+// Description, labels, expirations, clustering, partition filter requirement, KMS key and compatible schema
+// changes are updated in place, different partitioning or breaking schema changes are refused.
+func CreateOrUpdateTable(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string, spec TableSpec) (*TableReconciliation, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+
+	t := bqClient.Dataset(bqDataset).Table(bqTable)
+	tMeta, err := t.Metadata(ctx)
+	if err != nil {
+		if !isNotFound(err) {
+			return nil, bu.TError{
+				Msg:    fmt.Sprintf("failed to fetch metadata for %v.%v", bqDataset, bqTable),
+				Origin: "CreateOrUpdateTable",
+				Code:   bu.ErrGetTableMeta,
+				Err:    err,
+			}
+		}
+		if err := CreateTable(ctx, bqClient, bqDataset, bqTable, spec); err != nil {
+			return nil, err
+		}
+		return &TableReconciliation{Created: true}, nil
+	}
+
+	if err := checkPartitioningMatches(tMeta, spec); err != nil {
+		return nil, bu.TError{
+			Msg:    fmt.Sprintf("cannot reconcile %v.%v with the spec", bqDataset, bqTable),
+			Origin: "CreateOrUpdateTable",
+			Code:   bu.ErrMetaMismatch,
+			Err:    err,
+		}
+	}
+
+	res := &TableReconciliation{Updated: make([]string, 0)}
+	update := bigquery.TableMetadataToUpdate{}
+
+	if len(spec.Schema) > 0 {
+		res.Schema = planSchemaMigration(bqDataset, bqTable, tMeta, spec.Schema, spec.SchemaOptions)
+		if len(res.Schema.Breaking) > 0 {
+			return res, bu.TError{
+				Msg:    fmt.Sprintf("refusing to reconcile %v.%v, %v breaking schema changes:\n%v", bqDataset, bqTable, len(res.Schema.Breaking), res.Schema.Breaking),
+				Origin: "CreateOrUpdateTable",
+				Code:   bu.ErrSchemaMismatch,
+				Err:    nil,
+			}
+		}
+		if res.Schema.NeedsUpdate() {
+			update.Schema = res.Schema.Schema
+			res.Updated = append(res.Updated, "schema")
+		}
+	}
+
+	if (spec.Description != "" || spec.ClearDescription) && tMeta.Description != spec.Description {
+		update.Description = spec.Description
+		res.Updated = append(res.Updated, "description")
+	}
+
+	if !reflect.DeepEqual(labelList(tMeta.Labels), labelList(spec.Labels)) {
+		for k, v := range spec.Labels {
+			update.SetLabel(k, v)
+		}
+		for k := range tMeta.Labels {
+			if _, ok := spec.Labels[k]; !ok {
+				update.DeleteLabel(k)
+			}
+		}
+		res.Updated = append(res.Updated, "labels")
+	}
+
+	if tp := spec.timePartitioning(); tp != nil && tMeta.TimePartitioning != nil && tMeta.TimePartitioning.Expiration != tp.Expiration {
+		// The whole partitioning spec is sent, only the expiration may change. The filter requirement
+		// ends up as the spec's, same as the table level one below.
+		update.TimePartitioning = &bigquery.TimePartitioning{
+			Type:                   tMeta.TimePartitioning.Type,
+			Field:                  tMeta.TimePartitioning.Field,
+			Expiration:             tp.Expiration,
+			RequirePartitionFilter: spec.RequirePartitionFilter,
+		}
+		res.Updated = append(res.Updated, "partition expiration")
+	}
+
+	if tMeta.RequirePartitionFilter != spec.RequirePartitionFilter {
+		update.RequirePartitionFilter = spec.RequirePartitionFilter
+		res.Updated = append(res.Updated, "require partition filter")
+	}
+
+	var currentClustering []string
+	if tMeta.Clustering != nil {
+		currentClustering = tMeta.Clustering.Fields
+	}
+	if strings.Join(currentClustering, ",") != strings.Join(spec.ClusteringFields, ",") {
+		// An empty field list removes clustering
+		update.Clustering = &bigquery.Clustering{Fields: spec.ClusteringFields}
+		res.Updated = append(res.Updated, "clustering")
+	}
+
+	var currentKMS string
+	if tMeta.EncryptionConfig != nil {
+		currentKMS = tMeta.EncryptionConfig.KMSKeyName
+	}
+	if spec.KMSKeyName != "" && currentKMS != spec.KMSKeyName {
+		update.EncryptionConfig = &bigquery.EncryptionConfig{KMSKeyName: spec.KMSKeyName}
+		res.Updated = append(res.Updated, "kms key")
+	}
+
+	if spec.TableExpiration > 0 {
+		expiration := tMeta.CreationTime.Add(spec.TableExpiration)
+		if d := tMeta.ExpirationTime.Sub(expiration); tMeta.ExpirationTime.IsZero() || d > time.Minute || d < -time.Minute {
+			if expiration.Before(time.Now()) {
+				return res, bu.TError{
+					Msg:    fmt.Sprintf("%v.%v was created on %v, a %v expiration would delete it now", bqDataset, bqTable, tMeta.CreationTime, spec.TableExpiration),
+					Origin: "CreateOrUpdateTable",
+					Code:   bu.ErrConfigError,
+					Err:    nil,
+				}
+			}
+			update.ExpirationTime = expiration
+			res.Updated = append(res.Updated, "expiration")
+		}
+	} else if !tMeta.ExpirationTime.IsZero() {
+		update.ExpirationTime = bigquery.NeverExpire
+		res.Updated = append(res.Updated, "expiration")
+	}
+
+	if len(res.Updated) == 0 {
+		return res, nil
+	}
+
+	if _, err := t.Update(ctx, update, tMeta.ETag); err != nil {
+		return res, bu.TError{
+			Msg:    fmt.Sprintf("failed to update %v of %v.%v", strings.Join(res.Updated, ", "), bqDataset, bqTable),
+			Origin: "CreateOrUpdateTable",
+			Code:   bu.ErrUpdateTable,
+			Err:    err,
+		}
+	}
+	if res.Schema != nil && res.Schema.NeedsUpdate() {
+		res.Schema.Applied = true
+	}
+
+	return res, nil
+}
+
+// checkPartitioningMatches returns an error describing how the table partitioning differs from the spec
+func checkPartitioningMatches(tMeta *bigquery.TableMetadata, spec TableSpec) error {
+	current := PartitionNone
+	field := ""
+	switch {
+	case tMeta.TimePartitioning != nil:
+		current = PartitionType(tMeta.TimePartitioning.Type)
+		if current == "" {
+			current = PartitionDay
+		}
+		field = tMeta.TimePartitioning.Field
+	case tMeta.RangePartitioning != nil:
+		current = PartitionIntegerRange
+		field = tMeta.RangePartitioning.Field
+	}
+
+	if current != spec.PartitionType || !strings.EqualFold(field, spec.PartitionField) {
+		return fmt.Errorf("table is partitioned by %q on %q, spec asks for %q on %q", current, field, spec.PartitionType, spec.PartitionField)
+	}
+
+	if rp := tMeta.RangePartitioning; rp != nil && rp.Range != nil {
+		if rp.Range.Start != spec.RangeStart || rp.Range.End != spec.RangeEnd || rp.Range.Interval != spec.RangeInterval {
+			return fmt.Errorf("table range [%v, %v) / %v differs from spec range [%v, %v) / %v",
+				rp.Range.Start, rp.Range.End, rp.Range.Interval, spec.RangeStart, spec.RangeEnd, spec.RangeInterval)
+		}
+	}
+
+	return nil
+}
+
+// labelList turns a label map into a sorted list for comparison
+func labelList(labels map[string]string) []string {
+	out := make([]string, 0, len(labels))
+	for k, v := range labels {
+		out = append(out, k+"="+v)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,49 @@
+package bqtools
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestTableSpecValidate(t *testing.T) {
+	schema := bigquery.Schema{field("day", bigquery.DateFieldType), field("id", bigquery.IntegerFieldType),
+		field("a", bigquery.StringFieldType), field("b", bigquery.StringFieldType), field("c", bigquery.StringFieldType),
+		field("d", bigquery.StringFieldType)}
+
+	tests := []struct {
+		name    string
+		spec    TableSpec
+		wantErr bool
+	}{
+		{"empty", TableSpec{}, false},
+		{"ingestion time", TableSpec{PartitionType: PartitionDay, PartitionExpiration: time.Hour}, false},
+		{"column partitioned", TableSpec{Schema: schema, PartitionType: PartitionMonth, PartitionField: "day", RequirePartitionFilter: true}, false},
+		{"partition field without a schema", TableSpec{PartitionType: PartitionDay, PartitionField: "anything"}, false},
+		{"partition field not in the schema", TableSpec{Schema: schema, PartitionType: PartitionDay, PartitionField: "missing"}, true},
+		{"partition options without partitioning", TableSpec{PartitionField: "day"}, true},
+		{"filter without partitioning", TableSpec{RequirePartitionFilter: true}, true},
+		{"expiration without partitioning", TableSpec{PartitionExpiration: time.Hour}, true},
+		{"unknown type", TableSpec{PartitionType: "WEEK"}, true},
+		{"range", TableSpec{Schema: schema, PartitionType: PartitionIntegerRange, PartitionField: "id", RangeEnd: 100, RangeInterval: 10}, false},
+		{"range without a field", TableSpec{PartitionType: PartitionIntegerRange, RangeEnd: 100, RangeInterval: 10}, true},
+		{"empty range", TableSpec{PartitionType: PartitionIntegerRange, PartitionField: "id", RangeStart: 10, RangeEnd: 10, RangeInterval: 1}, true},
+		{"range without an interval", TableSpec{PartitionType: PartitionIntegerRange, PartitionField: "id", RangeEnd: 10}, true},
+		{"range with expiration", TableSpec{PartitionType: PartitionIntegerRange, PartitionField: "id", RangeEnd: 10, RangeInterval: 1,
+			PartitionExpiration: time.Hour}, true},
+		{"clustering", TableSpec{Schema: schema, ClusteringFields: []string{"a", "b", "c", "d"}}, false},
+		{"too many clustering fields", TableSpec{ClusteringFields: []string{"a", "b", "c", "d", "id"}}, true},
+		{"clustering field not in the schema", TableSpec{Schema: schema, ClusteringFields: []string{"a", "missing"}}, true},
+		{"clearing the description", TableSpec{ClearDescription: true}, false},
+		{"clearing a given description", TableSpec{Description: "d", ClearDescription: true}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.spec.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
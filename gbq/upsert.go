@@ -0,0 +1,347 @@
+package bqtools
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/net/context"
+
+	bu "github.com/belboo/boo-go-tools/misc"
+)
+
+// UpsertOptions tunes UpsertFromGCS and UpsertRows
+type UpsertOptions struct {
+	// Keys are the columns identifying a row, rows with NULL keys never match and are always inserted
+	Keys []string
+	// UpdatedAt is an optional column deciding between versions of a row: the newest staged one is merged
+	// and an existing row is only updated by a newer one
+	UpdatedAt string
+	// StagingTTL is the expiration of the staging table in case it cannot be dropped, defaults to a day
+	StagingTTL time.Duration
+	// On partitioned tables keys are only matched within the partitions the staged rows fall into, so a row
+	// whose partitioning column changed is inserted into its new partition next to its old version.
+	// MatchAcrossPartitions matches keys in the whole table instead, at the cost of scanning all of it.
+	MatchAcrossPartitions bool
+}
+
+// UpsertResult is the result of UpsertFromGCS and UpsertRows
+type UpsertResult struct {
+	Staged   int64 // rows loaded into the staging table
+	Inserted int64
+	Updated  int64
+	JobID    string // of the MERGE
+}
+
+// UpsertFromGCS loads GCS objects described by spec (destination dispositions and partitioning are ignored)
+// into a staging table with the schema of bqDataset.bqTable and merges them into it by opts.Keys
+func UpsertFromGCS(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string, spec LoadSpec, opts UpsertOptions) (*UpsertResult, error) {
+	spec.WriteDisposition = bigquery.WriteTruncate
+	spec.CreateDisposition = bigquery.CreateNever
+	spec.Schema = nil
+	spec.AutoDetect = false
+	spec.SchemaUpdateOptions = nil
+	spec.TimePartitioning, spec.RangePartitioning, spec.Clustering = nil, nil, nil
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+
+	return upsert(ctx, bqClient, bqDataset, bqTable, opts, "UpsertFromGCS", func(staging string) (*bigquery.LoadStatistics, error) {
+		return loadFromGCS(ctx, bqClient, bqDataset, staging, spec)
+	})
+}
+
+// UpsertRows merges a slice of structs (or pointers to them) or bigquery.ValueSavers into bqDataset.bqTable
+// by opts.Keys, the rows go through a staging table filled with a load job (not streamed)
+func UpsertRows(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string, rows interface{}, opts UpsertOptions) (*UpsertResult, error) {
+	rv := reflect.ValueOf(rows)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, bu.TError{
+			Msg:    fmt.Sprintf("rows must be a slice, got %T", rows),
+			Origin: "UpsertRows",
+			Code:   bu.ErrConfigError,
+			Err:    nil,
+		}
+	}
+
+	return upsert(ctx, bqClient, bqDataset, bqTable, opts, "UpsertRows", func(staging string) (*bigquery.LoadStatistics, error) {
+		stagingT := bqClient.Dataset(bqDataset).Table(staging)
+		tMeta, err := stagingT.Metadata(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for i := 0; i < rv.Len(); i++ {
+			v := rv.Index(i).Interface()
+			vs, ok := v.(bigquery.ValueSaver)
+			if !ok {
+				vs = &bigquery.StructSaver{Struct: v, Schema: tMeta.Schema}
+			}
+			row, _, err := vs.Save()
+			if err != nil {
+				return nil, fmt.Errorf("row %v: %v", i, err)
+			}
+			if err := enc.Encode(jsonValue(row)); err != nil {
+				return nil, fmt.Errorf("row %v: %v", i, err)
+			}
+		}
+
+		src := bigquery.NewReaderSource(&buf)
+		src.SourceFormat = bigquery.JSON
+		loader := stagingT.LoaderFrom(src)
+		loader.WriteDisposition = bigquery.WriteTruncate
+		loader.CreateDisposition = bigquery.CreateNever
+
+		job, err := loader.Run(ctx)
+		if err != nil {
+			return nil, err
+		}
+		status, err := job.Wait(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if status.Err() != nil {
+			return nil, newLoadError(job, status, bqDataset, staging, []string{"rows"})
+		}
+		var stats *bigquery.LoadStatistics
+		if status.Statistics != nil {
+			stats, _ = status.Statistics.Details.(*bigquery.LoadStatistics)
+		}
+		return stats, nil
+	})
+}
+
+// jsonValue converts row values to what BigQuery accepts in newline delimited JSON
+func jsonValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]bigquery.Value:
+		out := make(map[string]interface{}, len(val))
+		for k, e := range val {
+			out[k] = jsonValue(e)
+		}
+		return out
+	case []bigquery.Value:
+		out := make([]interface{}, len(val))
+		for i, e := range val {
+			out[i] = jsonValue(e)
+		}
+		return out
+	case *big.Rat:
+		if val == nil {
+			return nil
+		}
+		return strings.TrimSuffix(strings.TrimRight(val.FloatString(38), "0"), ".")
+	}
+	return v
+}
+
+// upsert creates the staging table, fills it with stage, merges it into the target and drops it
+func upsert(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string, opts UpsertOptions, origin string,
+	stage func(staging string) (*bigquery.LoadStatistics, error)) (*UpsertResult, error) {
+
+	tMeta, err := getTableMeta(ctx, bqClient, bqDataset, bqTable, origin)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkUpsertOptions(tMeta, opts, origin); err != nil {
+		return nil, err
+	}
+
+	ttl := opts.StagingTTL
+	if ttl <= 0 {
+		ttl = 24 * time.Hour
+	}
+	suffix := make([]byte, 6)
+	rand.Read(suffix)
+	staging := fmt.Sprintf("%v_staging_%v", bqTable, hex.EncodeToString(suffix))
+	stagingT := bqClient.Dataset(bqDataset).Table(staging)
+
+	err = stagingT.Create(ctx, &bigquery.TableMetadata{
+		Schema:         tMeta.Schema,
+		ExpirationTime: time.Now().Add(ttl),
+		Labels:         map[string]string{"bqtools": "upsert-staging"},
+	})
+	if err != nil {
+		return nil, bu.TError{
+			Msg:    fmt.Sprintf("failed to create staging table %v.%v", bqDataset, staging),
+			Origin: origin,
+			Code:   bu.ErrCreateTable,
+			Err:    err,
+		}
+	}
+	defer stagingT.Delete(context.Background())
+
+	stats, err := stage(staging)
+	if err != nil {
+		if _, ok := err.(*LoadError); ok {
+			return nil, err
+		}
+		return nil, bu.TError{
+			Msg:    fmt.Sprintf("failed to stage rows into %v.%v", bqDataset, staging),
+			Origin: origin,
+			Code:   bu.ErrLoadGCS,
+			Err:    err,
+		}
+	}
+
+	res := &UpsertResult{}
+	if stats != nil {
+		res.Staged = stats.OutputRows
+	}
+	if res.Staged == 0 && stats != nil {
+		return res, nil
+	}
+
+	sql, params, err := mergeSQL(ctx, bqClient, bqDataset, bqTable, staging, tMeta, opts, origin)
+	if err != nil || sql == "" {
+		return res, err
+	}
+
+	qr, err := RunQuery(ctx, bqClient, sql, params, nil, QueryOptions{Labels: map[string]string{"bqtools": "upsert"}})
+	if err != nil {
+		return res, err
+	}
+	res.JobID = qr.JobID
+	if qr.Stats != nil && qr.Stats.DMLStats != nil {
+		res.Inserted = qr.Stats.DMLStats.InsertedRowCount
+		res.Updated = qr.Stats.DMLStats.UpdatedRowCount
+	}
+
+	return res, nil
+}
+
+// checkUpsertOptions checks the keys and updated at columns exist
+func checkUpsertOptions(tMeta *bigquery.TableMetadata, opts UpsertOptions, origin string) error {
+	fail := func(format string, args ...interface{}) error {
+		return bu.TError{
+			Msg:    fmt.Sprintf(format, args...),
+			Origin: origin,
+			Code:   bu.ErrConfigError,
+			Err:    nil,
+		}
+	}
+
+	if len(opts.Keys) == 0 {
+		return fail("no key columns to merge on")
+	}
+	for _, c := range append(append([]string{}, opts.Keys...), opts.UpdatedAt) {
+		if c == "" {
+			continue
+		}
+		if f, repeated := LookupField(tMeta.Schema, c); f == nil || repeated || f.Type == bigquery.RecordFieldType {
+			return fail("%v is not a scalar column of %v", c, tMeta.Name)
+		}
+	}
+	if pt, field := TablePartitioning(tMeta); pt != PartitionNone && field == "" {
+		return fail("%v is partitioned by ingestion time, upserts need a partitioning column", tMeta.Name)
+	}
+	return nil
+}
+
+// stagedBounds are the partitioning column values of the staged rows
+type stagedBounds struct {
+	lo, hi bigquery.Value // nil without non-NULL values
+	nulls  int64
+}
+
+// mergeSQL generates the MERGE of the staging table into the target, restricted to the partitions
+// the staged rows fall into so that the target is pruned. It is empty if there is nothing to merge.
+func mergeSQL(ctx context.Context, bqClient *bigquery.Client, bqDataset string, bqTable string, staging string,
+	tMeta *bigquery.TableMetadata, opts UpsertOptions, origin string) (string, []bigquery.QueryParameter, error) {
+
+	var bounds *stagedBounds
+	if pt, field := TablePartitioning(tMeta); pt != PartitionNone && !opts.MatchAcrossPartitions {
+		row, err := readStatsRow(ctx, bqClient,
+			fmt.Sprintf("SELECT MIN(%[1]v) AS lo, MAX(%[1]v) AS hi, COUNTIF(%[1]v IS NULL) AS nulls FROM `%[2]v`.`%[3]v`",
+				quoteColumn(field), bqDataset, staging),
+			nil, 0, origin)
+		if err != nil {
+			return "", nil, err
+		}
+		bounds = &stagedBounds{lo: row["lo"], hi: row["hi"]}
+		bounds.nulls, _ = row["nulls"].(int64)
+		if bounds.lo == nil && bounds.nulls == 0 {
+			return "", nil, nil
+		}
+	}
+
+	sql, params := buildMergeSQL(bqDataset, bqTable, staging, tMeta, opts, bounds)
+	return sql, params, nil
+}
+
+// quoteColumn quotes a (dotted) column path
+func quoteColumn(c string) string {
+	return "`" + strings.Join(strings.Split(c, "."), "`.`") + "`"
+}
+
+// buildMergeSQL is the MERGE of mergeSQL, restricted to the staged bounds of the partitioning column if given
+func buildMergeSQL(bqDataset string, bqTable string, staging string, tMeta *bigquery.TableMetadata, opts UpsertOptions,
+	bounds *stagedBounds) (string, []bigquery.QueryParameter) {
+
+	on := make([]string, 0, len(opts.Keys)+1)
+	keys := make([]string, 0, len(opts.Keys))
+	nullKeys := make([]string, 0, len(opts.Keys))
+	isKey := make(map[string]bool)
+	for _, k := range opts.Keys {
+		on = append(on, fmt.Sprintf("T.%[1]v = S.%[1]v", quoteColumn(k)))
+		keys = append(keys, quoteColumn(k))
+		nullKeys = append(nullKeys, quoteColumn(k)+" IS NULL")
+		isKey[strings.ToLower(k)] = true
+	}
+
+	var params []bigquery.QueryParameter
+	if _, field := TablePartitioning(tMeta); bounds != nil && field != "" {
+		conds := make([]string, 0, 2)
+		if bounds.lo != nil {
+			conds = append(conds, fmt.Sprintf("T.%v BETWEEN @plo AND @phi", quoteColumn(field)))
+			params = []bigquery.QueryParameter{{Name: "plo", Value: bounds.lo}, {Name: "phi", Value: bounds.hi}}
+		}
+		if bounds.nulls > 0 {
+			// rows without a partition value live in the __NULL__ partition
+			conds = append(conds, fmt.Sprintf("T.%v IS NULL", quoteColumn(field)))
+		}
+		if len(conds) > 0 {
+			on = append(on, "("+strings.Join(conds, " OR ")+")")
+		}
+	}
+
+	order := ""
+	matched := "WHEN MATCHED"
+	if opts.UpdatedAt != "" {
+		order = " ORDER BY " + quoteColumn(opts.UpdatedAt) + " DESC"
+		matched = fmt.Sprintf("WHEN MATCHED AND (T.%[1]v IS NULL OR S.%[1]v > T.%[1]v)", quoteColumn(opts.UpdatedAt))
+	}
+
+	set := make([]string, 0, len(tMeta.Schema))
+	for _, f := range tMeta.Schema {
+		if !isKey[strings.ToLower(f.Name)] {
+			set = append(set, fmt.Sprintf("%[1]v = S.%[1]v", quoteColumn(f.Name)))
+		}
+	}
+
+	// rows with a NULL key never match and are all inserted, they are not duplicates of one another
+	sql := fmt.Sprintf("MERGE `%v`.`%v` AS T\n"+
+		"USING (\n"+
+		"  SELECT * EXCEPT(_bqtools_rn) FROM (\n"+
+		"    SELECT *, ROW_NUMBER() OVER (PARTITION BY %v%v) AS _bqtools_rn FROM `%v`.`%v`\n"+
+		"  ) WHERE _bqtools_rn = 1 OR %v\n"+
+		") AS S\n"+
+		"ON %v\n",
+		bqDataset, bqTable, strings.Join(keys, ", "), order, bqDataset, staging, strings.Join(nullKeys, " OR "),
+		strings.Join(on, " AND "))
+	if len(set) > 0 {
+		sql += fmt.Sprintf("%v THEN UPDATE SET %v\n", matched, strings.Join(set, ", "))
+	}
+	sql += "WHEN NOT MATCHED THEN INSERT ROW"
+
+	return sql, params
+}
@@ -0,0 +1,85 @@
+package bqtools
+
+import (
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestBuildMergeSQL(t *testing.T) {
+	schema := bigquery.Schema{field("id", bigquery.IntegerFieldType), field("day", bigquery.DateFieldType),
+		field("v", bigquery.StringFieldType), field("ts", bigquery.TimestampFieldType)}
+	plain := &bigquery.TableMetadata{Name: "t", Schema: schema}
+	daily := &bigquery.TableMetadata{Name: "t", Schema: schema, TimePartitioning: &bigquery.TimePartitioning{Field: "day"}}
+	using := func(order string) string {
+		return "MERGE `ds`.`t` AS T\n" +
+			"USING (\n" +
+			"  SELECT * EXCEPT(_bqtools_rn) FROM (\n" +
+			"    SELECT *, ROW_NUMBER() OVER (PARTITION BY `id`" + order + ") AS _bqtools_rn FROM `ds`.`t_staging`\n" +
+			"  ) WHERE _bqtools_rn = 1 OR `id` IS NULL\n" +
+			") AS S\n"
+	}
+	const update = "WHEN MATCHED THEN UPDATE SET `day` = S.`day`, `v` = S.`v`, `ts` = S.`ts`\n" +
+		"WHEN NOT MATCHED THEN INSERT ROW"
+
+	tests := []struct {
+		name       string
+		tMeta      *bigquery.TableMetadata
+		opts       UpsertOptions
+		bounds     *stagedBounds
+		want       string
+		wantParams []bigquery.QueryParameter
+	}{
+		{"unpartitioned", plain, UpsertOptions{Keys: []string{"id"}}, nil,
+			using("") + "ON T.`id` = S.`id`\n" + update, nil},
+		{"newest version", plain, UpsertOptions{Keys: []string{"id"}, UpdatedAt: "ts"}, nil,
+			using(" ORDER BY `ts` DESC") + "ON T.`id` = S.`id`\n" +
+				"WHEN MATCHED AND (T.`ts` IS NULL OR S.`ts` > T.`ts`) THEN UPDATE SET `day` = S.`day`, `v` = S.`v`, `ts` = S.`ts`\n" +
+				"WHEN NOT MATCHED THEN INSERT ROW", nil},
+		{"staged range", daily, UpsertOptions{Keys: []string{"id"}}, &stagedBounds{lo: "2019-05-01", hi: "2019-05-03"},
+			using("") + "ON T.`id` = S.`id` AND (T.`day` BETWEEN @plo AND @phi)\n" + update,
+			[]bigquery.QueryParameter{{Name: "plo", Value: "2019-05-01"}, {Name: "phi", Value: "2019-05-03"}}},
+		{"staged range and NULLs", daily, UpsertOptions{Keys: []string{"id"}}, &stagedBounds{lo: "2019-05-01", hi: "2019-05-01", nulls: 2},
+			using("") + "ON T.`id` = S.`id` AND (T.`day` BETWEEN @plo AND @phi OR T.`day` IS NULL)\n" + update,
+			[]bigquery.QueryParameter{{Name: "plo", Value: "2019-05-01"}, {Name: "phi", Value: "2019-05-01"}}},
+		{"staged NULLs only", daily, UpsertOptions{Keys: []string{"id"}}, &stagedBounds{nulls: 1},
+			using("") + "ON T.`id` = S.`id` AND (T.`day` IS NULL)\n" + update, nil},
+		{"nothing staged", daily, UpsertOptions{Keys: []string{"id"}}, &stagedBounds{},
+			using("") + "ON T.`id` = S.`id`\n" + update, nil},
+		{"across partitions", daily, UpsertOptions{Keys: []string{"id"}, MatchAcrossPartitions: true}, nil,
+			using("") + "ON T.`id` = S.`id`\n" + update, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, params := buildMergeSQL("ds", "t", "t_staging", tt.tMeta, tt.opts, tt.bounds)
+			if got != tt.want {
+				t.Errorf("buildMergeSQL() =\n%v\nwant\n%v", got, tt.want)
+			}
+			if !reflect.DeepEqual(params, tt.wantParams) {
+				t.Errorf("buildMergeSQL() params = %v, want %v", params, tt.wantParams)
+			}
+		})
+	}
+
+	keysOnly := &bigquery.TableMetadata{Name: "t", Schema: bigquery.Schema{field("a", bigquery.StringFieldType), field("b", bigquery.StringFieldType)}}
+	got, _ := buildMergeSQL("ds", "t", "s", keysOnly, UpsertOptions{Keys: []string{"a", "B"}}, nil)
+	want := "MERGE `ds`.`t` AS T\n" +
+		"USING (\n" +
+		"  SELECT * EXCEPT(_bqtools_rn) FROM (\n" +
+		"    SELECT *, ROW_NUMBER() OVER (PARTITION BY `a`, `B`) AS _bqtools_rn FROM `ds`.`s`\n" +
+		"  ) WHERE _bqtools_rn = 1 OR `a` IS NULL OR `B` IS NULL\n" +
+		") AS S\n" +
+		"ON T.`a` = S.`a` AND T.`B` = S.`B`\n" +
+		"WHEN NOT MATCHED THEN INSERT ROW"
+	if got != want {
+		t.Errorf("buildMergeSQL() with only keys =\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestQuoteColumn(t *testing.T) {
+	if got, want := quoteColumn("a.b"), "`a`.`b`"; got != want {
+		t.Errorf("quoteColumn() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,226 @@
+package gcstools
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+
+	"github.com/xitongsys/parquet-go/ParquetFile"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+
+	bu "github.com/belboo/boo-go-tools/misc"
+)
+
+// EncryptionKeySize is the length of a customer-supplied encryption key (AES-256)
+const EncryptionKeySize = 32
+
+// DecodeEncryptionKey decodes a base64 encoded customer-supplied encryption key
+func DecodeEncryptionKey(b64 string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, bu.TError{
+			Msg:    "encryption key is not valid base64",
+			Origin: "DecodeEncryptionKey",
+			Code:   bu.ErrConfigError,
+			Err:    err,
+		}
+	}
+	if err := checkEncryptionKey(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// checkEncryptionKey validates an optional key, nil means Google-managed encryption
+func checkEncryptionKey(key []byte) error {
+	if key != nil && len(key) != EncryptionKeySize {
+		return bu.TError{
+			Msg:    fmt.Sprintf("encryption key must be %v bytes long, got %v", EncryptionKeySize, len(key)),
+			Origin: "checkEncryptionKey",
+			Code:   bu.ErrConfigError,
+			Err:    nil,
+		}
+	}
+	return nil
+}
+
+// withKey applies a customer-supplied key to an object handle if there is one
+func withKey(h *storage.ObjectHandle, key []byte) *storage.ObjectHandle {
+	if key == nil {
+		return h
+	}
+	return h.Key(key)
+}
+
+// RotateObjectKey rewrites an object in place under a new customer-supplied key.
+// A nil oldKey rotates a Google-managed object to CSEK, a nil newKey the other way round.
+func RotateObjectKey(ctx context.Context, bucket string, object string, oldKey []byte, newKey []byte) error {
+	if err := CopyObject(ctx, bucket, object, bucket, object, oldKey, newKey); err != nil {
+		return bu.TError{
+			Msg:    fmt.Sprintf("failed to rotate the encryption key of %v/%v", bucket, object),
+			Origin: "RotateObjectKey",
+			Code:   bu.ErrGCS,
+			Err:    err,
+		}
+	}
+	return nil
+}
+
+// gcsParquetFile is a ParquetFile on a GCS object honouring a customer-supplied key,
+// the stock GCS ParquetFile owns its client and cannot be given one
+type gcsParquetFile struct {
+	ctx    context.Context
+	client *storage.Client
+	owner  bool // closes the client on Close
+	bucket string
+	object string
+	key    []byte
+
+	w *storage.Writer
+
+	size   int64
+	offset int64
+}
+
+// openGCSParquetFile opens a GCS object as a ParquetFile for reading
+func openGCSParquetFile(ctx context.Context, project string, bucket string, object string, key []byte) (ParquetFile.ParquetFile, error) {
+	if key == nil {
+		return ParquetFile.NewGcsFileReader(ctx, project, bucket, object)
+	}
+	if err := checkEncryptionKey(key); err != nil {
+		return nil, err
+	}
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &gcsParquetFile{ctx: ctx, client: client, bucket: bucket, key: key}
+	pf, err := f.Open(object)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	pf.(*gcsParquetFile).owner = true
+	return pf, nil
+}
+
+// createGCSParquetFile opens a GCS object as a ParquetFile for writing
+func createGCSParquetFile(ctx context.Context, project string, bucket string, object string, key []byte) (ParquetFile.ParquetFile, error) {
+	if key == nil {
+		return ParquetFile.NewGcsFileWriter(ctx, project, bucket, object)
+	}
+	if err := checkEncryptionKey(key); err != nil {
+		return nil, err
+	}
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &gcsParquetFile{ctx: ctx, client: client, bucket: bucket, key: key}
+	pf, err := f.Create(object)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	pf.(*gcsParquetFile).owner = true
+	return pf, nil
+}
+
+// Open returns a reader on name (or the current object for "") sharing the client
+func (f *gcsParquetFile) Open(name string) (ParquetFile.ParquetFile, error) {
+	if name == "" {
+		name = f.object
+	}
+
+	attrs, err := withKey(f.client.Bucket(f.bucket).Object(name), f.key).Attrs(f.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gcsParquetFile{
+		ctx:    f.ctx,
+		client: f.client,
+		bucket: f.bucket,
+		object: name,
+		key:    f.key,
+		size:   attrs.Size,
+	}, nil
+}
+
+// Create returns a writer on name (or the current object for "") sharing the client
+func (f *gcsParquetFile) Create(name string) (ParquetFile.ParquetFile, error) {
+	if name == "" {
+		name = f.object
+	}
+
+	return &gcsParquetFile{
+		ctx:    f.ctx,
+		client: f.client,
+		bucket: f.bucket,
+		object: name,
+		key:    f.key,
+		w:      withKey(f.client.Bucket(f.bucket).Object(name), f.key).NewWriter(f.ctx),
+	}, nil
+}
+
+func (f *gcsParquetFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, fmt.Errorf("invalid whence %v", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset %v", offset)
+	}
+	f.offset = offset
+	return f.offset, nil
+}
+
+func (f *gcsParquetFile) Read(p []byte) (int, error) {
+	if f.offset >= f.size {
+		return 0, io.EOF
+	}
+
+	r, err := withKey(f.client.Bucket(f.bucket).Object(f.object), f.key).NewRangeReader(f.ctx, f.offset, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	n, err := io.ReadFull(r, p)
+	f.offset += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *gcsParquetFile) Write(p []byte) (int, error) {
+	if f.w == nil {
+		return 0, fmt.Errorf("%v/%v is not open for writing", f.bucket, f.object)
+	}
+	return f.w.Write(p)
+}
+
+func (f *gcsParquetFile) Close() error {
+	var err error
+	if f.w != nil {
+		err = f.w.Close()
+		f.w = nil
+	}
+	if f.owner {
+		f.client.Close()
+		f.owner = false
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+package gcstools
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"testing"
+)
+
+func TestCheckEncryptionKey(t *testing.T) {
+	tests := []struct {
+		key     []byte
+		wantErr bool
+	}{
+		{nil, false},
+		{make([]byte, EncryptionKeySize), false},
+		{[]byte{}, true},
+		{make([]byte, 16), true},
+		{make([]byte, EncryptionKeySize+1), true},
+	}
+
+	for _, tt := range tests {
+		if err := checkEncryptionKey(tt.key); (err != nil) != tt.wantErr {
+			t.Errorf("checkEncryptionKey(%v bytes) error = %v, wantErr %v", len(tt.key), err, tt.wantErr)
+		}
+	}
+}
+
+func TestDecodeEncryptionKey(t *testing.T) {
+	// encodes to "+/+/...", which differs between the standard and URL alphabets
+	key := bytes.Repeat([]byte{0xfb, 0xff, 0xbf}, 11)[:EncryptionKeySize]
+
+	tests := []struct {
+		name    string
+		b64     string
+		want    []byte
+		wantErr bool
+	}{
+		{"valid", base64.StdEncoding.EncodeToString(key), key, false},
+		{"not base64", "not base64!", nil, true},
+		{"url encoding", base64.URLEncoding.EncodeToString(key), nil, true},
+		{"too short", base64.StdEncoding.EncodeToString(key[:16]), nil, true},
+		{"empty", "", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeEncryptionKey(tt.b64)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DecodeEncryptionKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("DecodeEncryptionKey() = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGCSParquetFileSeek(t *testing.T) {
+	f := &gcsParquetFile{size: 100}
+
+	tests := []struct {
+		offset  int64
+		whence  int
+		want    int64
+		wantErr bool
+	}{
+		{10, io.SeekStart, 10, false},
+		{5, io.SeekCurrent, 15, false},
+		{-8, io.SeekEnd, 92, false},
+		{-200, io.SeekCurrent, 92, true},
+		{0, 42, 92, true},
+	}
+
+	for _, tt := range tests {
+		got, err := f.Seek(tt.offset, tt.whence)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Seek(%v, %v) error = %v, wantErr %v", tt.offset, tt.whence, err, tt.wantErr)
+		}
+		if f.offset != tt.want || (!tt.wantErr && got != tt.want) {
+			t.Errorf("Seek(%v, %v) = %v, offset %v, want %v", tt.offset, tt.whence, got, f.offset, tt.want)
+		}
+	}
+}
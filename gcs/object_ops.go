@@ -11,7 +11,16 @@ import (
 
 // RmObject is a thin envelope for GCS remove
 func RmObject(ctx context.Context, bucket string, object string) error {
-	
+	return RmObjectWithKey(ctx, bucket, object, nil)
+}
+
+// RmObjectWithKey removes an object encrypted with a customer-supplied key
+func RmObjectWithKey(ctx context.Context, bucket string, object string, key []byte) error {
+
+	if err := checkEncryptionKey(key); err != nil {
+		return err
+	}
+
 	gcsClient, err := storage.NewClient(ctx)
 	if err != nil {
 		return bu.TError{
@@ -23,7 +32,7 @@ func RmObject(ctx context.Context, bucket string, object string) error {
 	}
 	defer gcsClient.Close()
 
-	if err := gcsClient.Bucket(bucket).Object(object).Delete(ctx); err != nil {
+	if err := withKey(gcsClient.Bucket(bucket).Object(object), key).Delete(ctx); err != nil {
         return bu.TError{
 			Msg:    fmt.Sprintf("failed to delete %v/%v", bucket, object),
 			Origin: "gcs.RmObject",
@@ -33,4 +42,40 @@ func RmObject(ctx context.Context, bucket string, object string) error {
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+// CopyObject copies (rewrites) an object, srcKey and dstKey are optional customer-supplied keys
+func CopyObject(ctx context.Context, srcBucket string, srcObject string, dstBucket string, dstObject string, srcKey []byte, dstKey []byte) error {
+
+	if err := checkEncryptionKey(srcKey); err != nil {
+		return err
+	}
+	if err := checkEncryptionKey(dstKey); err != nil {
+		return err
+	}
+
+	gcsClient, err := storage.NewClient(ctx)
+	if err != nil {
+		return bu.TError{
+			Msg:    "could not instantiate a GCS client",
+			Origin: "gcs.CopyObject",
+			Code:   bu.ErrGCS,
+			Err:    err,
+		}
+	}
+	defer gcsClient.Close()
+
+	src := withKey(gcsClient.Bucket(srcBucket).Object(srcObject), srcKey)
+	dst := withKey(gcsClient.Bucket(dstBucket).Object(dstObject), dstKey)
+
+	if _, err := dst.CopierFrom(src).Run(ctx); err != nil {
+		return bu.TError{
+			Msg:    fmt.Sprintf("failed to copy %v/%v to %v/%v", srcBucket, srcObject, dstBucket, dstObject),
+			Origin: "gcs.CopyObject",
+			Code:   bu.ErrGCS,
+			Err:    err,
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,620 @@
+package gcstools
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xitongsys/parquet-go/ParquetFile"
+	"github.com/xitongsys/parquet-go/ParquetReader"
+	"github.com/xitongsys/parquet-go/parquet"
+
+	"golang.org/x/net/context"
+
+	bu "github.com/belboo/boo-go-tools/misc"
+)
+
+// ConvertFormat is an output format of ConvertParquet
+type ConvertFormat string
+
+// ConvertFormat values
+const (
+	FormatCSV    ConvertFormat = "csv"
+	FormatNDJSON ConvertFormat = "ndjson"
+)
+
+// ConvertOptions tunes ConvertParquet
+type ConvertOptions struct {
+	Format  ConvertFormat // defaults to CSV
+	Project string        // GCP project used for GCS access
+
+	// Columns selects and orders output columns by their flattened names, a nested
+	// record name selects all its leaves. Empty outputs every column.
+	Columns []string
+	// Flatten turns nested records into "parent.child" columns in NDJSON (CSV is always flat)
+	Flatten   bool
+	Separator string // separator of flattened names, defaults to "."
+
+	Delimiter rune   // CSV delimiter, defaults to ','
+	NoHeader  bool   // skip the CSV header line
+	NullValue string // CSV rendering of nulls, defaults to ""
+	// TimeFormat is the layout of time.Time values and of DATE and TIMESTAMP columns, defaults to
+	// time.RFC3339Nano. DECIMAL columns are rendered as exact decimal numbers.
+	TimeFormat string
+	// Formatters override the rendering of individual (flattened) columns, they get the value as read
+	Formatters map[string]func(interface{}) interface{}
+
+	// Template is an optional pointer to a parquet-go tagged struct to read rows into,
+	// without it rows are read into types derived from the file schema
+	Template  interface{}
+	BatchSize int // rows read at once, defaults to 10000
+
+	EncryptionKey    []byte // optional customer-supplied key of a GCS source
+	DstEncryptionKey []byte // optional customer-supplied key of a GCS destination
+}
+
+// ConvertStats is returned by ConvertParquet
+type ConvertStats struct {
+	Rows    int64
+	Columns []string
+}
+
+// ConvertParquet reads a Parquet file from src and writes it as CSV or NDJSON to dst.
+// src is a local path or a gs://bucket/object URI, dst additionally accepts "-" for stdout.
+func ConvertParquet(ctx context.Context, src string, dst string, opts ConvertOptions) (*ConvertStats, error) {
+
+	if opts.Format == "" {
+		opts.Format = FormatCSV
+	}
+	if opts.Format != FormatCSV && opts.Format != FormatNDJSON {
+		return nil, bu.TError{
+			Msg:    fmt.Sprintf("unsupported output format %v", opts.Format),
+			Origin: "ConvertParquet",
+			Code:   bu.ErrConfigError,
+			Err:    nil,
+		}
+	}
+	if opts.Separator == "" {
+		opts.Separator = "."
+	}
+	if opts.TimeFormat == "" {
+		opts.TimeFormat = time.RFC3339Nano
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 10000
+	}
+
+	pr, closeSrc, err := openParquetSource(ctx, opts.Project, src, opts.Template, opts.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	defer closeSrc()
+
+	out, err := OpenWriterWithKey(ctx, dst, opts.DstEncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	stats, err := convertRows(pr, out, opts)
+	if err != nil {
+		abortWriter(out)
+		return stats, bu.TError{
+			Msg:    fmt.Sprintf("conversion %v -> %v failed", src, dst),
+			Origin: "ConvertParquet",
+			Code:   bu.ErrGCS,
+			Err:    err,
+		}
+	}
+
+	if err := out.Close(); err != nil {
+		return stats, bu.TError{
+			Msg:    fmt.Sprintf("could not close %v, data might be corrupted", dst),
+			Origin: "ConvertParquet",
+			Code:   bu.ErrGCS,
+			Err:    err,
+		}
+	}
+
+	return stats, nil
+}
+
+// ParseGCSURI splits gs://bucket/object into its parts, ok is false for anything else
+func ParseGCSURI(uri string) (bucket string, object string, ok bool) {
+	if !strings.HasPrefix(uri, "gs://") {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(uri, "gs://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// openParquetSource opens a local or GCS Parquet file, the returned func releases it
+func openParquetSource(ctx context.Context, project string, src string, obj interface{}, key []byte) (*ParquetReader.ParquetReader, func(), error) {
+	var fr ParquetFile.ParquetFile
+	var err error
+
+	if bucket, object, ok := ParseGCSURI(src); ok {
+		fr, err = openGCSParquetFile(ctx, project, bucket, object, key)
+	} else {
+		fr, err = ParquetFile.NewLocalFileReader(src)
+	}
+	if err != nil {
+		return nil, nil, bu.TError{
+			Msg:    fmt.Sprintf("could not open %v for reading", src),
+			Origin: "ConvertParquet",
+			Code:   bu.ErrGCS,
+			Err:    err,
+		}
+	}
+
+	pr, err := ParquetReader.NewParquetReader(fr, obj, 4)
+	if err != nil {
+		fr.Close()
+		return nil, nil, bu.TError{
+			Msg:    fmt.Sprintf("could not instantiate a Parquet Reader for %v", src),
+			Origin: "ConvertParquet",
+			Code:   bu.ErrGCS,
+			Err:    err,
+		}
+	}
+
+	return pr, func() {
+		pr.ReadStop()
+		fr.Close()
+	}, nil
+}
+
+// OpenWriter opens a local file, a gs://bucket/object URI or stdout ("-") for writing.
+// Closing a GCS writer commits the object.
+func OpenWriter(ctx context.Context, dst string) (io.WriteCloser, error) {
+	return OpenWriterWithKey(ctx, dst, nil)
+}
+
+// OpenWriterWithKey is OpenWriter encrypting GCS objects with a customer-supplied key
+func OpenWriterWithKey(ctx context.Context, dst string, key []byte) (io.WriteCloser, error) {
+	if err := checkEncryptionKey(key); err != nil {
+		return nil, err
+	}
+
+	if dst == "-" || dst == "" {
+		return nopCloser{os.Stdout}, nil
+	}
+
+	bucket, object, ok := ParseGCSURI(dst)
+	if !ok {
+		f, err := os.Create(dst)
+		if err != nil {
+			return nil, bu.TError{
+				Msg:    fmt.Sprintf("could not open %v for writing", dst),
+				Origin: "OpenWriter",
+				Code:   bu.ErrGCS,
+				Err:    err,
+			}
+		}
+		return f, nil
+	}
+
+	return newGCSObjectWriter(ctx, bucket, object, key, "OpenWriter")
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// abortWriter releases a writer returned by OpenWriter after a failure, GCS objects are not committed
+func abortWriter(w io.WriteCloser) {
+	if a, ok := w.(*gcsObjectWriter); ok {
+		a.Abort()
+		return
+	}
+	w.Close()
+}
+
+// flatField is a single (possibly flattened) column value of a row
+type flatField struct {
+	name  string
+	value interface{}
+}
+
+// convertRows streams rows from pr into out in the requested format
+func convertRows(pr *ParquetReader.ParquetReader, out io.Writer, opts ConvertOptions) (*ConvertStats, error) {
+	stats := &ConvertStats{}
+	bw := bufio.NewWriter(out)
+
+	var cw *csv.Writer
+	if opts.Format == FormatCSV {
+		cw = csv.NewWriter(bw)
+		if opts.Delimiter != 0 {
+			cw.Comma = opts.Delimiter
+		}
+	}
+	enc := json.NewEncoder(bw)
+	types := leafTypes(pr, opts)
+
+	total := pr.GetNumRows()
+	for read := int64(0); read < total; {
+		n := int64(opts.BatchSize)
+		if n > total-read {
+			n = total - read
+		}
+
+		rows, err := readParquetBatch(pr, opts.Template, int(n))
+		if err != nil {
+			return stats, err
+		}
+		if len(rows) == 0 {
+			break
+		}
+		read += int64(len(rows))
+
+		for _, row := range rows {
+			rv := reflect.ValueOf(row)
+
+			if stats.Columns == nil {
+				leaves := make([]string, 0)
+				typeColumns(rv.Type(), "", opts, &leaves)
+				if stats.Columns, err = selectColumns(leaves, opts); err != nil {
+					return stats, err
+				}
+				if cw != nil && !opts.NoHeader {
+					if err := cw.Write(stats.Columns); err != nil {
+						return stats, err
+					}
+				}
+			}
+
+			if opts.Format == FormatNDJSON && !opts.Flatten {
+				rec := nestRow(rv, "", types, opts)
+				if err := enc.Encode(rec); err != nil {
+					return stats, err
+				}
+				stats.Rows++
+				continue
+			}
+
+			fields := make([]flatField, 0)
+			flattenRow(rv, "", opts, &fields)
+
+			values := make(map[string]interface{}, len(fields))
+			for _, f := range fields {
+				values[f.name] = formatValue(f.name, f.value, types[strings.ToLower(f.name)], opts)
+			}
+
+			if cw != nil {
+				record := make([]string, len(stats.Columns))
+				for i, col := range stats.Columns {
+					record[i] = csvValue(values[col], opts)
+				}
+				if err := cw.Write(record); err != nil {
+					return stats, err
+				}
+			} else {
+				// Ordered by column, which a map would not keep
+				var sb strings.Builder
+				sb.WriteString("{")
+				for i, col := range stats.Columns {
+					if i > 0 {
+						sb.WriteString(",")
+					}
+					k, _ := json.Marshal(col)
+					v, err := json.Marshal(values[col])
+					if err != nil {
+						return stats, err
+					}
+					sb.Write(k)
+					sb.WriteString(":")
+					sb.Write(v)
+				}
+				sb.WriteString("}\n")
+				if _, err := bw.WriteString(sb.String()); err != nil {
+					return stats, err
+				}
+			}
+			stats.Rows++
+		}
+	}
+
+	if cw != nil {
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return stats, err
+		}
+	}
+	return stats, bw.Flush()
+}
+
+// readParquetBatch reads up to n rows, into the template type if there is one
+func readParquetBatch(pr *ParquetReader.ParquetReader, template interface{}, n int) ([]interface{}, error) {
+	if template == nil {
+		return pr.ReadByNumber(n)
+	}
+
+	rowType := reflect.TypeOf(template).Elem()
+	rows := reflect.New(reflect.SliceOf(rowType))
+	rows.Elem().Set(reflect.MakeSlice(reflect.SliceOf(rowType), n, n))
+	if err := pr.Read(rows.Interface()); err != nil {
+		return nil, err
+	}
+
+	out := make([]interface{}, rows.Elem().Len())
+	for i := range out {
+		out[i] = rows.Elem().Index(i).Interface()
+	}
+	return out, nil
+}
+
+// parquetFieldName is the external name of a struct field, from its parquet or json tag
+func parquetFieldName(f reflect.StructField) string {
+	for _, part := range strings.Split(f.Tag.Get("parquet"), ",") {
+		part = strings.TrimSpace(part)
+		if strings.HasPrefix(strings.ToLower(part), "name=") {
+			return part[len("name="):]
+		}
+	}
+	if name := strings.Split(f.Tag.Get("json"), ",")[0]; name != "" && name != "-" {
+		return name
+	}
+	return f.Name
+}
+
+// isRecord reports whether v is a nested record to descend into
+func isRecord(v reflect.Value) bool {
+	return v.Kind() == reflect.Struct && v.Type() != reflect.TypeOf(time.Time{})
+}
+
+// flattenRow appends the leaves of a row to fields as prefix.name entries
+func flattenRow(v reflect.Value, prefix string, opts ConvertOptions, fields *[]flatField) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			*fields = append(*fields, flatField{name: prefix, value: nil})
+			return
+		}
+		v = v.Elem()
+	}
+
+	if !isRecord(v) {
+		*fields = append(*fields, flatField{name: prefix, value: v.Interface()})
+		return
+	}
+
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := parquetFieldName(f)
+		if prefix != "" {
+			name = prefix + opts.Separator + name
+		}
+		flattenRow(v.Field(i), name, opts, fields)
+	}
+}
+
+// typeColumns appends the flattened leaf column names of a row type, nested records are expanded
+// whether or not a given row holds them
+func typeColumns(t reflect.Type, prefix string, opts ConvertOptions, columns *[]string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || t == reflect.TypeOf(time.Time{}) {
+		*columns = append(*columns, prefix)
+		return
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := parquetFieldName(f)
+		if prefix != "" {
+			name = prefix + opts.Separator + name
+		}
+		typeColumns(f.Type, name, opts, columns)
+	}
+}
+
+// nestRow turns a row into nested maps keeping only the selected columns
+func nestRow(v reflect.Value, prefix string, types map[string]*parquet.SchemaElement, opts ConvertOptions) interface{} {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+
+	if !isRecord(v) {
+		return formatValue(prefix, v.Interface(), types[strings.ToLower(prefix)], opts)
+	}
+
+	rec := make(map[string]interface{})
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := parquetFieldName(f)
+		path := name
+		if prefix != "" {
+			path = prefix + opts.Separator + name
+		}
+		if !columnSelected(path, opts) {
+			continue
+		}
+		rec[name] = nestRow(v.Field(i), path, types, opts)
+	}
+	return rec
+}
+
+// columnSelected checks a (partial) flattened path against opts.Columns
+func columnSelected(path string, opts ConvertOptions) bool {
+	if len(opts.Columns) == 0 {
+		return true
+	}
+	for _, c := range opts.Columns {
+		if c == path || strings.HasPrefix(path, c+opts.Separator) || strings.HasPrefix(c, path+opts.Separator) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectColumns returns the output column order out of the leaf columns of the row type,
+// a selected column matching none of them is an error
+func selectColumns(leaves []string, opts ConvertOptions) ([]string, error) {
+	if len(opts.Columns) == 0 {
+		return leaves, nil
+	}
+
+	columns := make([]string, 0, len(leaves))
+	for _, c := range opts.Columns {
+		found := false
+		for _, l := range leaves {
+			if l == c || strings.HasPrefix(l, c+opts.Separator) {
+				columns = append(columns, l)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("column %v not found", c)
+		}
+	}
+	return columns, nil
+}
+
+// leafTypes maps the lower cased flattened names of the file's leaf columns to their schema elements
+func leafTypes(pr *ParquetReader.ParquetReader, opts ConvertOptions) map[string]*parquet.SchemaElement {
+	types := make(map[string]*parquet.SchemaElement)
+	if pr.SchemaHandler == nil {
+		return types
+	}
+	for _, leaf := range schemaLeaves(pr.SchemaHandler.SchemaElements) {
+		types[strings.ToLower(strings.Join(leaf.path, opts.Separator))] = leaf.el
+	}
+	return types
+}
+
+// formatValue applies per-column formatters, the column's converted type and the time layout
+func formatValue(name string, v interface{}, el *parquet.SchemaElement, opts ConvertOptions) interface{} {
+	if fn, ok := opts.Formatters[name]; ok {
+		return fn(v)
+	}
+	v = convertedValue(v, el)
+	if t, ok := v.(time.Time); ok {
+		return t.Format(opts.TimeFormat)
+	}
+	if vs, ok := v.([]interface{}); ok {
+		for i, e := range vs {
+			if t, ok := e.(time.Time); ok {
+				vs[i] = t.Format(opts.TimeFormat)
+			}
+		}
+	}
+	return v
+}
+
+// convertedValue turns the physical value of a DATE, TIMESTAMP or DECIMAL column (as read without a
+// template) into a time.Time or an exact json.Number, other values are returned as they are
+func convertedValue(v interface{}, el *parquet.SchemaElement) interface{} {
+	if v == nil || el == nil || el.ConvertedType == nil {
+		return v
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() != reflect.Uint8 {
+		out := make([]interface{}, rv.Len())
+		for i := range out {
+			out[i] = convertedValue(rv.Index(i).Interface(), el)
+		}
+		return out
+	}
+
+	switch *el.ConvertedType {
+	case parquet.ConvertedType_DATE:
+		if d, ok := v.(int32); ok {
+			return time.Unix(int64(d)*86400, 0).UTC()
+		}
+	case parquet.ConvertedType_TIMESTAMP_MILLIS:
+		if ms, ok := v.(int64); ok {
+			return time.Unix(ms/1e3, (ms%1e3)*1e6).UTC()
+		}
+	case parquet.ConvertedType_TIMESTAMP_MICROS:
+		if us, ok := v.(int64); ok {
+			return time.Unix(us/1e6, (us%1e6)*1e3).UTC()
+		}
+	case parquet.ConvertedType_DECIMAL:
+		scale := 0
+		if el.Scale != nil {
+			scale = int(*el.Scale)
+		}
+		switch x := v.(type) {
+		case int32:
+			return decimalNumber(big.NewInt(int64(x)), scale)
+		case int64:
+			return decimalNumber(big.NewInt(x), scale)
+		case string:
+			// big-endian two's complement
+			u := new(big.Int).SetBytes([]byte(x))
+			if len(x) > 0 && x[0]&0x80 != 0 {
+				u.Sub(u, new(big.Int).Lsh(big.NewInt(1), uint(len(x)*8)))
+			}
+			return decimalNumber(u, scale)
+		}
+	}
+	return v
+}
+
+// decimalNumber renders an unscaled decimal value
+func decimalNumber(unscaled *big.Int, scale int) json.Number {
+	sign := ""
+	if unscaled.Sign() < 0 {
+		sign = "-"
+	}
+	digits := new(big.Int).Abs(unscaled).String()
+	if scale <= 0 {
+		return json.Number(sign + digits + strings.Repeat("0", -scale))
+	}
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+	return json.Number(sign + digits[:len(digits)-scale] + "." + digits[len(digits)-scale:])
+}
+
+// csvValue renders a formatted value as a CSV cell, repeated fields become JSON arrays
+func csvValue(v interface{}, opts ConvertOptions) string {
+	if v == nil {
+		return opts.NullValue
+	}
+
+	switch x := v.(type) {
+	case string:
+		return x
+	case float32:
+		return strconv.FormatFloat(float64(x), 'g', -1, 32)
+	case float64:
+		return strconv.FormatFloat(x, 'g', -1, 64)
+	case fmt.Stringer:
+		return x.String()
+	}
+
+	switch reflect.ValueOf(v).Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map, reflect.Struct:
+		b, err := json.Marshal(v)
+		if err == nil {
+			return string(b)
+		}
+	}
+	return fmt.Sprintf("%v", v)
+}
@@ -0,0 +1,151 @@
+package gcstools
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xitongsys/parquet-go/parquet"
+)
+
+type convertAddress struct {
+	City string  `parquet:"name=city, type=UTF8"`
+	Zip  *string `parquet:"name=zip, type=UTF8"`
+}
+
+type convertRow struct {
+	ID      int64           `parquet:"name=id, type=INT64"`
+	Name    *string         `parquet:"name=name, type=UTF8"`
+	Address *convertAddress `parquet:"name=address"`
+	Tags    []string        `parquet:"name=tags, type=LIST"`
+	hidden  int
+}
+
+func TestFlattenRow(t *testing.T) {
+	name, zip := "ann", "1000"
+	opts := ConvertOptions{Separator: "."}
+
+	tests := []struct {
+		name string
+		row  convertRow
+		want []flatField
+	}{
+		{"full", convertRow{ID: 1, Name: &name, Address: &convertAddress{City: "Sofia", Zip: &zip}, Tags: []string{"a"}},
+			[]flatField{{"id", int64(1)}, {"name", "ann"}, {"address.city", "Sofia"}, {"address.zip", "1000"}, {"tags", []string{"a"}}}},
+		{"nulls", convertRow{ID: 2},
+			[]flatField{{"id", int64(2)}, {"name", nil}, {"address", nil}, {"tags", []string(nil)}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make([]flatField, 0)
+			flattenRow(reflect.ValueOf(tt.row), "", opts, &got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("flattenRow() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	columns := make([]string, 0)
+	typeColumns(reflect.TypeOf(convertRow{}), "", ConvertOptions{Separator: "_"}, &columns)
+	if want := []string{"id", "name", "address_city", "address_zip", "tags"}; !reflect.DeepEqual(columns, want) {
+		t.Errorf("typeColumns() = %v, want %v", columns, want)
+	}
+}
+
+func TestSelectColumns(t *testing.T) {
+	leaves := []string{"id", "name", "address.city", "address.zip", "tags"}
+
+	tests := []struct {
+		columns []string
+		want    []string
+		wantErr bool
+	}{
+		{nil, leaves, false},
+		{[]string{"name", "id"}, []string{"name", "id"}, false},
+		{[]string{"address"}, []string{"address.city", "address.zip"}, false},
+		{[]string{"address.zip", "id"}, []string{"address.zip", "id"}, false},
+		{[]string{"addr"}, nil, true},
+		{[]string{"id", "missing"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := selectColumns(leaves, ConvertOptions{Columns: tt.columns, Separator: "."})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("selectColumns(%v) error = %v, wantErr %v", tt.columns, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("selectColumns(%v) = %v, want %v", tt.columns, got, tt.want)
+		}
+	}
+}
+
+func TestCSVValue(t *testing.T) {
+	opts := ConvertOptions{NullValue: "NULL"}
+
+	tests := []struct {
+		v    interface{}
+		want string
+	}{
+		{nil, "NULL"},
+		{"text", "text"},
+		{float32(0.1), "0.1"},
+		{1e21, "1e+21"},
+		{int32(-7), "-7"},
+		{true, "true"},
+		{json.Number("12.50"), "12.50"},
+		{time.Duration(90) * time.Second, "1m30s"},
+		{[]string{"a", "b"}, `["a","b"]`},
+		{map[string]int{"a": 1}, `{"a":1}`},
+	}
+
+	for _, tt := range tests {
+		if got := csvValue(tt.v, opts); got != tt.want {
+			t.Errorf("csvValue(%#v) = %q, want %q", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	date, millis, micros, decimal := parquet.ConvertedType_DATE, parquet.ConvertedType_TIMESTAMP_MILLIS,
+		parquet.ConvertedType_TIMESTAMP_MICROS, parquet.ConvertedType_DECIMAL
+	scale2 := int32(2)
+	el := func(conv *parquet.ConvertedType) *parquet.SchemaElement {
+		return &parquet.SchemaElement{ConvertedType: conv, Scale: &scale2}
+	}
+	opts := ConvertOptions{TimeFormat: "2006-01-02 15:04:05.000"}
+
+	tests := []struct {
+		name string
+		v    interface{}
+		el   *parquet.SchemaElement
+		want interface{}
+	}{
+		{"no type", int32(18044), nil, int32(18044)},
+		{"date", int32(18044), el(&date), "2019-05-28 00:00:00.000"},
+		{"date before epoch", int32(-1), el(&date), "1969-12-31 00:00:00.000"},
+		{"timestamp millis", int64(1559053800123), el(&millis), "2019-05-28 14:30:00.123"},
+		{"timestamp micros", int64(1559053800123456), el(&micros), "2019-05-28 14:30:00.123"},
+		{"repeated dates", []int32{0, 1}, el(&date), []interface{}{"1970-01-01 00:00:00.000", "1970-01-02 00:00:00.000"}},
+		{"decimal int32", int32(1250), el(&decimal), json.Number("12.50")},
+		{"decimal int64 negative", int64(-5), el(&decimal), json.Number("-0.05")},
+		{"decimal bytes", string([]byte{0x04, 0xe2}), el(&decimal), json.Number("12.50")},
+		{"decimal negative bytes", string([]byte{0xff, 0x9c}), el(&decimal), json.Number("-1.00")},
+		{"time value", time.Date(2019, 5, 28, 1, 2, 3, 0, time.UTC), nil, "2019-05-28 01:02:03.000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatValue("c", tt.v, tt.el, opts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("formatValue() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+
+	opts.Formatters = map[string]func(interface{}) interface{}{"c": func(v interface{}) interface{} { return "x" }}
+	if got := formatValue("c", int32(1), el(&date), opts); got != "x" {
+		t.Errorf("formatValue() with a formatter = %v, want x", got)
+	}
+}
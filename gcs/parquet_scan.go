@@ -0,0 +1,539 @@
+package gcstools
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gammazero/workerpool"
+
+	"github.com/xitongsys/parquet-go/ParquetReader"
+	"github.com/xitongsys/parquet-go/parquet"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	"google.golang.org/api/iterator"
+
+	bu "github.com/belboo/boo-go-tools/misc"
+)
+
+// ColumnRange is an inclusive [Min, Max] bound on a column used to skip files and row groups
+// by their footer statistics. Bounds may be ints, floats, strings or time.Time (for DATE and
+// TIMESTAMP columns), a nil bound is open.
+type ColumnRange struct {
+	Column string // dotted path in the Parquet schema, matched case-insensitively
+	Min    interface{}
+	Max    interface{}
+}
+
+// DateRange is a shorthand for a ColumnRange covering whole days from..to
+func DateRange(column string, from time.Time, to time.Time) ColumnRange {
+	return ColumnRange{
+		Column: column,
+		Min:    from.UTC().Truncate(24 * time.Hour),
+		Max:    to.UTC().Truncate(24 * time.Hour).Add(24*time.Hour - time.Nanosecond),
+	}
+}
+
+// ParquetScan describes a read over all Parquet objects under a GCS prefix
+type ParquetScan struct {
+	Project string
+	Bucket  string
+	Prefix  string
+	Pattern string // regexp object names have to match, defaults to `\.parquet$`
+
+	// Ranges are used to skip files and row groups, all of them have to overlap for data to be read
+	Ranges []ColumnRange
+	// Predicate is applied to every row read (a value of the template struct type), nil keeps all rows.
+	// It is called concurrently when several files are read in parallel.
+	Predicate func(row interface{}) bool
+
+	Concurrency int   // files read in parallel, defaults to 4
+	BatchSize   int64 // rows read at once, defaults to 10000
+
+	EncryptionKey []byte // optional customer-supplied encryption key of the objects
+}
+
+// ParquetScanStats summarises what a scan had to read
+type ParquetScanStats struct {
+	FilesScanned     int
+	FilesSkipped     int
+	RowGroupsRead    int
+	RowGroupsSkipped int
+	RowsRead         int64
+	RowsMatched      int64
+}
+
+// ScanParquet reads the rows of all objects matched by scan into values of obj's type and passes
+// the ones satisfying scan.Predicate to fn. obj is a pointer to a parquet-go tagged struct.
+// fn is never called concurrently, returning an error from it stops the scan.
+func ScanParquet(ctx context.Context, scan ParquetScan, obj interface{}, fn func(row interface{}) error) (*ParquetScanStats, error) {
+
+	rowType := reflect.TypeOf(obj)
+	if rowType == nil || rowType.Kind() != reflect.Ptr || rowType.Elem().Kind() != reflect.Struct {
+		return nil, bu.TError{
+			Msg:    "obj has to be a pointer to a struct",
+			Origin: "ScanParquet",
+			Code:   bu.ErrGeneric,
+			Err:    nil,
+		}
+	}
+	rowType = rowType.Elem()
+
+	objects, err := listParquetObjects(ctx, scan)
+	if err != nil {
+		return nil, err
+	}
+
+	concurrency := scan.Concurrency
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stats := &ParquetScanStats{}
+	var mu, fnMu sync.Mutex
+	var scanErr error
+
+	wp := workerpool.New(concurrency)
+	for _, object := range objects {
+		object := object
+		wp.Submit(func() {
+			if ctx.Err() != nil {
+				return
+			}
+
+			err := scanParquetObject(ctx, scan, object, obj, rowType, stats, &mu, &fnMu, fn)
+			if err != nil {
+				mu.Lock()
+				if scanErr == nil {
+					scanErr = err
+				}
+				mu.Unlock()
+				cancel()
+			}
+		})
+	}
+	wp.StopWait()
+
+	return stats, scanErr
+}
+
+// ReadParquetScan runs ScanParquet collecting matching rows into dst, a pointer to a slice of structs
+func ReadParquetScan(ctx context.Context, scan ParquetScan, dst interface{}) (*ParquetScanStats, error) {
+	dstVal := reflect.ValueOf(dst)
+	if dstVal.Kind() != reflect.Ptr || dstVal.Elem().Kind() != reflect.Slice || dstVal.Elem().Type().Elem().Kind() != reflect.Struct {
+		return nil, bu.TError{
+			Msg:    "dst has to be a pointer to a slice of structs",
+			Origin: "ReadParquetScan",
+			Code:   bu.ErrGeneric,
+			Err:    nil,
+		}
+	}
+	out := dstVal.Elem()
+
+	return ScanParquet(ctx, scan, reflect.New(out.Type().Elem()).Interface(), func(row interface{}) error {
+		out.Set(reflect.Append(out, reflect.ValueOf(row)))
+		return nil
+	})
+}
+
+// listParquetObjects lists object names under scan.Prefix matching scan.Pattern
+func listParquetObjects(ctx context.Context, scan ParquetScan) ([]string, error) {
+	pattern := scan.Pattern
+	if pattern == "" {
+		pattern = `\.parquet$`
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, bu.TError{
+			Msg:    fmt.Sprintf("invalid object pattern %q", pattern),
+			Origin: "ScanParquet",
+			Code:   bu.ErrConfigError,
+			Err:    err,
+		}
+	}
+
+	gcsClient, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, bu.TError{
+			Msg:    "could not instantiate a GCS client",
+			Origin: "ScanParquet",
+			Code:   bu.ErrGCS,
+			Err:    err,
+		}
+	}
+	defer gcsClient.Close()
+
+	objects := make([]string, 0)
+	it := gcsClient.Bucket(scan.Bucket).Objects(ctx, &storage.Query{Prefix: scan.Prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, bu.TError{
+				Msg:    fmt.Sprintf("failed to list %v/%v", scan.Bucket, scan.Prefix),
+				Origin: "ScanParquet",
+				Code:   bu.ErrGCS,
+				Err:    err,
+			}
+		}
+		if re.MatchString(attrs.Name) {
+			objects = append(objects, attrs.Name)
+		}
+	}
+
+	return objects, nil
+}
+
+// scanParquetObject reads the row groups of a single object that may hold matching rows, mu guards
+// stats and fnMu serialises the calls to fn
+func scanParquetObject(ctx context.Context, scan ParquetScan, object string, obj interface{}, rowType reflect.Type,
+	stats *ParquetScanStats, mu *sync.Mutex, fnMu *sync.Mutex, fn func(row interface{}) error) error {
+
+	fr, err := openGCSParquetFile(ctx, scan.Project, scan.Bucket, object, scan.EncryptionKey)
+	if err != nil {
+		return bu.TError{
+			Msg:    fmt.Sprintf("could not instantiate a GCS File Reader for %v/%v", scan.Bucket, object),
+			Origin: "ScanParquet",
+			Code:   bu.ErrGCS,
+			Err:    err,
+		}
+	}
+	defer fr.Close()
+
+	pr, err := ParquetReader.NewParquetReader(fr, obj, 4)
+	if err != nil {
+		return bu.TError{
+			Msg:    fmt.Sprintf("could not instantiate a Parquet Reader for %v/%v", scan.Bucket, object),
+			Origin: "ScanParquet",
+			Code:   bu.ErrGCS,
+			Err:    err,
+		}
+	}
+	defer pr.ReadStop()
+
+	kept := make([]*parquet.RowGroup, 0, len(pr.Footer.RowGroups))
+	keptIdx := make([]int, 0, len(pr.Footer.RowGroups))
+	for i, rg := range pr.Footer.RowGroups {
+		if rowGroupMayMatch(pr.Footer, rg, scan.Ranges) {
+			kept = append(kept, rg)
+			keptIdx = append(keptIdx, i)
+		}
+	}
+	skipped := len(pr.Footer.RowGroups) - len(kept)
+
+	mu.Lock()
+	stats.FilesScanned++
+	stats.RowGroupsSkipped += skipped
+	if len(kept) == 0 {
+		stats.FilesSkipped++
+	}
+	mu.Unlock()
+
+	if len(kept) == 0 {
+		return nil
+	}
+	if skipped > 0 {
+		if err := seekRowGroups(pr, kept); err != nil {
+			return bu.TError{
+				Msg:    fmt.Sprintf("failed to seek to the row groups to read in %v/%v", scan.Bucket, object),
+				Origin: "ScanParquet",
+				Code:   bu.ErrGCS,
+				Err:    err,
+			}
+		}
+	}
+
+	batchSize := scan.BatchSize
+	if batchSize <= 0 {
+		batchSize = 10000
+	}
+
+	for k, rg := range kept {
+		for left := rg.NumRows; left > 0; {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			n := batchSize
+			if n > left {
+				n = left
+			}
+			left -= n
+
+			rows := reflect.New(reflect.SliceOf(rowType))
+			rows.Elem().Set(reflect.MakeSlice(reflect.SliceOf(rowType), int(n), int(n)))
+			if err := pr.Read(rows.Interface()); err != nil {
+				return bu.TError{
+					Msg:    fmt.Sprintf("failed to read row group %v of %v/%v", keptIdx[k], scan.Bucket, object),
+					Origin: "ScanParquet",
+					Code:   bu.ErrGCS,
+					Err:    err,
+				}
+			}
+
+			matched := make([]interface{}, 0, rows.Elem().Len())
+			for j := 0; j < rows.Elem().Len(); j++ {
+				row := rows.Elem().Index(j).Interface()
+				if scan.Predicate == nil || scan.Predicate(row) {
+					matched = append(matched, row)
+				}
+			}
+
+			mu.Lock()
+			stats.RowsRead += n
+			stats.RowsMatched += int64(len(matched))
+			mu.Unlock()
+
+			fnMu.Lock()
+			for _, row := range matched {
+				if err := fn(row); err != nil {
+					fnMu.Unlock()
+					return err
+				}
+			}
+			fnMu.Unlock()
+		}
+
+		mu.Lock()
+		stats.RowGroupsRead++
+		mu.Unlock()
+	}
+
+	return nil
+}
+
+// seekRowGroups restricts a fresh reader to the kept row groups: the column readers are repositioned at the
+// offsets of the first kept column chunks and move on through the kept ones only, the pages of the
+// others are never fetched
+func seekRowGroups(pr *ParquetReader.ParquetReader, kept []*parquet.RowGroup) error {
+	pr.Footer.RowGroups = kept
+	for _, cb := range pr.ColumnBuffers {
+		cb.Footer = pr.Footer
+		cb.RowGroupIndex = 0
+		if err := cb.NextRowGroup(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rowGroupMayMatch checks whether the row group statistics overlap all ranges,
+// columns without usable statistics never exclude a row group
+func rowGroupMayMatch(footer *parquet.FileMetaData, rg *parquet.RowGroup, ranges []ColumnRange) bool {
+	for _, cr := range ranges {
+		for _, col := range rg.Columns {
+			if col.MetaData == nil || !strings.EqualFold(strings.Join(col.MetaData.PathInSchema, "."), cr.Column) {
+				continue
+			}
+			md := col.MetaData
+			if md.Statistics == nil {
+				break
+			}
+
+			conv := columnConvertedType(footer, md.PathInSchema)
+			minStat, maxStat := md.Statistics.MinValue, md.Statistics.MaxValue
+			// the deprecated Min/Max are signed byte-wise comparisons, only usable for numbers
+			if (minStat == nil || maxStat == nil) && md.Type != parquet.Type_BYTE_ARRAY && md.Type != parquet.Type_FIXED_LEN_BYTE_ARRAY {
+				minStat, maxStat = md.Statistics.Min, md.Statistics.Max
+			}
+			statMin, ok1 := decodeParquetStat(md.Type, minStat)
+			statMax, ok2 := decodeParquetStat(md.Type, maxStat)
+			if !ok1 || !ok2 {
+				break
+			}
+
+			if cr.Max != nil {
+				if bound, ok := normaliseBound(cr.Max, conv); ok {
+					if c, ok := compareStat(statMin, bound); ok && c > 0 {
+						return false
+					}
+				}
+			}
+			if cr.Min != nil {
+				if bound, ok := normaliseBound(cr.Min, conv); ok {
+					if c, ok := compareStat(statMax, bound); ok && c < 0 {
+						return false
+					}
+				}
+			}
+			break
+		}
+	}
+	return true
+}
+
+// columnConvertedType looks up the converted (logical) type of the leaf column at path, -1 if it has none
+func columnConvertedType(footer *parquet.FileMetaData, path []string) parquet.ConvertedType {
+	want := strings.Join(path, ".")
+	for _, leaf := range schemaLeaves(footer.Schema) {
+		if !strings.EqualFold(strings.Join(leaf.path, "."), want) {
+			continue
+		}
+		if leaf.el.ConvertedType != nil {
+			return *leaf.el.ConvertedType
+		}
+		return -1
+	}
+	return -1
+}
+
+// schemaLeaf is a leaf column of a Parquet schema with its full path
+type schemaLeaf struct {
+	path []string
+	el   *parquet.SchemaElement
+}
+
+// schemaLeaves walks a depth first flattened schema, the root (schema[0]) is not part of the paths
+func schemaLeaves(schema []*parquet.SchemaElement) []schemaLeaf {
+	leaves := make([]schemaLeaf, 0)
+	if len(schema) == 0 {
+		return leaves
+	}
+
+	type level struct {
+		name string
+		left int32
+	}
+	stack := make([]level, 0)
+	for _, el := range schema[1:] {
+		for len(stack) > 0 && stack[len(stack)-1].left == 0 {
+			stack = stack[:len(stack)-1]
+		}
+		path := make([]string, 0, len(stack)+1)
+		for _, l := range stack {
+			path = append(path, l.name)
+		}
+		path = append(path, el.Name)
+		if len(stack) > 0 {
+			stack[len(stack)-1].left--
+		}
+
+		if el.NumChildren != nil && *el.NumChildren > 0 {
+			stack = append(stack, level{name: el.Name, left: *el.NumChildren})
+			continue
+		}
+		leaves = append(leaves, schemaLeaf{path: path, el: el})
+	}
+	return leaves
+}
+
+// decodeParquetStat decodes a plain encoded statistic into int64, float64 or string, a missing one is not ok
+func decodeParquetStat(t parquet.Type, b []byte) (interface{}, bool) {
+	if b == nil {
+		return nil, false
+	}
+	switch t {
+	case parquet.Type_INT32:
+		if len(b) != 4 {
+			return nil, false
+		}
+		return int64(int32(binary.LittleEndian.Uint32(b))), true
+	case parquet.Type_INT64:
+		if len(b) != 8 {
+			return nil, false
+		}
+		return int64(binary.LittleEndian.Uint64(b)), true
+	case parquet.Type_FLOAT:
+		if len(b) != 4 {
+			return nil, false
+		}
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), true
+	case parquet.Type_DOUBLE:
+		if len(b) != 8 {
+			return nil, false
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), true
+	case parquet.Type_BYTE_ARRAY, parquet.Type_FIXED_LEN_BYTE_ARRAY:
+		return string(b), true
+	}
+	return nil, false
+}
+
+// normaliseBound converts a range bound into the representation decodeParquetStat returns
+func normaliseBound(v interface{}, conv parquet.ConvertedType) (interface{}, bool) {
+	switch b := v.(type) {
+	case time.Time:
+		switch conv {
+		case parquet.ConvertedType_DATE:
+			return int64(math.Floor(float64(b.Unix()) / 86400)), true
+		case parquet.ConvertedType_TIMESTAMP_MILLIS:
+			return b.UnixNano() / int64(time.Millisecond), true
+		case parquet.ConvertedType_TIMESTAMP_MICROS:
+			return b.UnixNano() / int64(time.Microsecond), true
+		}
+		return nil, false
+	case string:
+		return b, true
+	case []byte:
+		return string(b), true
+	case float32:
+		return float64(b), true
+	case float64:
+		return b, true
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint()), true
+	}
+	return nil, false
+}
+
+// compareStat compares two normalised values, ok is false if they are not comparable
+func compareStat(a interface{}, b interface{}) (int, bool) {
+	switch av := a.(type) {
+	case int64:
+		switch bv := b.(type) {
+		case int64:
+			return cmpInt64(av, bv), true
+		case float64:
+			return cmpFloat64(float64(av), bv), true
+		}
+	case float64:
+		switch bv := b.(type) {
+		case int64:
+			return cmpFloat64(av, float64(bv)), true
+		case float64:
+			return cmpFloat64(av, bv), true
+		}
+	case string:
+		if bv, ok := b.(string); ok {
+			return strings.Compare(av, bv), true
+		}
+	}
+	return 0, false
+}
+
+func cmpInt64(a int64, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func cmpFloat64(a float64, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
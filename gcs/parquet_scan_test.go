@@ -0,0 +1,117 @@
+package gcstools
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/xitongsys/parquet-go/parquet"
+)
+
+func TestNormaliseBound(t *testing.T) {
+	day := time.Date(2019, 5, 28, 0, 0, 0, 0, time.UTC)
+	ts := time.Date(2019, 5, 28, 14, 30, 0, 123456789, time.UTC)
+	before := time.Date(1969, 12, 31, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		v      interface{}
+		conv   parquet.ConvertedType
+		want   interface{}
+		wantOK bool
+	}{
+		{"date", day, parquet.ConvertedType_DATE, int64(18044), true},
+		{"date before epoch", before, parquet.ConvertedType_DATE, int64(-1), true},
+		{"timestamp millis", ts, parquet.ConvertedType_TIMESTAMP_MILLIS, ts.UnixNano() / 1e6, true},
+		{"timestamp micros", ts, parquet.ConvertedType_TIMESTAMP_MICROS, ts.UnixNano() / 1e3, true},
+		{"time without a time type", ts, -1, nil, false},
+		{"string", "abc", -1, "abc", true},
+		{"bytes", []byte("abc"), -1, "abc", true},
+		{"float32", float32(1.5), -1, float64(1.5), true},
+		{"int", 7, -1, int64(7), true},
+		{"uint16", uint16(7), -1, int64(7), true},
+		{"bool", true, -1, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := normaliseBound(tt.v, tt.conv)
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("normaliseBound(%v, %v) = %v, %v, want %v, %v", tt.v, tt.conv, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+// statsColumn builds a column chunk with plain encoded statistics, deprecated ones if old is set
+func statsColumn(path []string, typ parquet.Type, min []byte, max []byte, old bool) *parquet.ColumnChunk {
+	st := &parquet.Statistics{MinValue: min, MaxValue: max}
+	if old {
+		st = &parquet.Statistics{Min: min, Max: max}
+	}
+	return &parquet.ColumnChunk{MetaData: &parquet.ColumnMetaData{Type: typ, PathInSchema: path, Statistics: st}}
+}
+
+func int32Stat(v int32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(v))
+	return b
+}
+
+func doubleStat(v float64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, math.Float64bits(v))
+	return b
+}
+
+func TestRowGroupMayMatch(t *testing.T) {
+	int32Type, doubleType, byteArrayType := parquet.Type_INT32, parquet.Type_DOUBLE, parquet.Type_BYTE_ARRAY
+	date := parquet.ConvertedType_DATE
+	two := int32(2)
+	footer := &parquet.FileMetaData{Schema: []*parquet.SchemaElement{
+		{Name: "schema", NumChildren: &two},
+		{Name: "day", Type: &int32Type, ConvertedType: &date},
+		{Name: "nested", NumChildren: &two},
+		{Name: "score", Type: &doubleType},
+		{Name: "name", Type: &byteArrayType},
+	}}
+
+	// days 18044..18046 are 2019-05-28..30
+	rg := &parquet.RowGroup{Columns: []*parquet.ColumnChunk{
+		statsColumn([]string{"day"}, parquet.Type_INT32, int32Stat(18044), int32Stat(18046), false),
+		statsColumn([]string{"nested", "score"}, parquet.Type_DOUBLE, doubleStat(0.5), doubleStat(1.5), true),
+		statsColumn([]string{"nested", "name"}, parquet.Type_BYTE_ARRAY, []byte("b"), []byte("d"), false),
+	}}
+	oldStrings := &parquet.RowGroup{Columns: []*parquet.ColumnChunk{
+		statsColumn([]string{"nested", "name"}, parquet.Type_BYTE_ARRAY, []byte("b"), []byte("d"), true),
+	}}
+
+	tests := []struct {
+		name   string
+		rg     *parquet.RowGroup
+		ranges []ColumnRange
+		want   bool
+	}{
+		{"no ranges", rg, nil, true},
+		{"date inside", rg, []ColumnRange{DateRange("day", time.Date(2019, 5, 29, 0, 0, 0, 0, time.UTC), time.Date(2019, 5, 29, 0, 0, 0, 0, time.UTC))}, true},
+		{"date after", rg, []ColumnRange{DateRange("DAY", time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC), time.Date(2019, 6, 2, 0, 0, 0, 0, time.UTC))}, false},
+		{"date before, open min", rg, []ColumnRange{{Column: "day", Max: time.Date(2019, 5, 27, 0, 0, 0, 0, time.UTC)}}, false},
+		{"deprecated number stats", rg, []ColumnRange{{Column: "nested.score", Min: 2}}, false},
+		{"number overlapping", rg, []ColumnRange{{Column: "nested.score", Min: 1, Max: 3}}, true},
+		{"string after", rg, []ColumnRange{{Column: "nested.name", Min: "e"}}, false},
+		{"string overlapping", rg, []ColumnRange{{Column: "nested.name", Min: "a", Max: "c"}}, true},
+		{"one range excluding", rg, []ColumnRange{{Column: "nested.name", Min: "a"}, {Column: "nested.score", Max: 0}}, false},
+		{"deprecated string stats ignored", oldStrings, []ColumnRange{{Column: "nested.name", Min: "e"}}, true},
+		{"unknown column", rg, []ColumnRange{{Column: "missing", Min: 1}}, true},
+		{"incomparable bound", rg, []ColumnRange{{Column: "nested.name", Min: 5}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rowGroupMayMatch(footer, tt.rg, tt.ranges); got != tt.want {
+				t.Errorf("rowGroupMayMatch() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,8 +2,6 @@ package gcstools
 
 import (
 	"fmt"
-	"io"
-	"os"
 	"time"
 	"reflect"
 	
@@ -13,7 +11,6 @@ import (
 	"github.com/xitongsys/parquet-go/ParquetWriter"
 	"github.com/xitongsys/parquet-go/parquet"
 
-	"cloud.google.com/go/storage"
 	"golang.org/x/net/context"
 	
 	bu "github.com/belboo/boo-go-tools/misc"
@@ -36,8 +33,26 @@ func WriteParquetGCSPar() error {
 	return nil
 }
 
+// ParquetWriteOptions tunes WriteParquetToGCSWithOptions
+type ParquetWriteOptions struct {
+	Schema          string                   // optional JSON schema for the Parquet Writer
+	EncryptionKey   []byte                   // optional customer-supplied encryption key
+	RowGroupSize    int64                    // defaults to 128M
+	CompressionType *parquet.CompressionCodec // nil means SNAPPY
+}
+
 // WriteParquetToGCS writes a slice of data to a GCS object 
 func WriteParquetToGCS(ctx context.Context, data interface{}, project string, bucket string, object string, bydate bool) error {
+	return WriteParquetToGCSWithOptions(ctx, data, project, bucket, object, ParquetWriteOptions{})
+}
+
+// WriteParquetWithSchemaToGCS writes a slice of data to a GCS object 
+func WriteParquetWithSchemaToGCS(ctx context.Context, data interface{}, project string, bucket string, object string, schema string) error {
+	return WriteParquetToGCSWithOptions(ctx, data, project, bucket, object, ParquetWriteOptions{Schema: schema})
+}
+
+// WriteParquetToGCSWithOptions writes a slice of data to a GCS object with an optional schema and encryption key
+func WriteParquetToGCSWithOptions(ctx context.Context, data interface{}, project string, bucket string, object string, opts ParquetWriteOptions) error {
 
 	typedData := reflect.ValueOf(data)
 
@@ -45,117 +60,70 @@ func WriteParquetToGCS(ctx context.Context, data interface{}, project string, bu
 		return nil
 	}
 
-	fw, err := ParquetFile.NewGcsFileWriter(ctx, project, bucket, object)
-	if err != nil {
-		return bu.TError{
-			Msg:    fmt.Sprintf("could not instantiate a GCS File Writer for %v/%v", bucket, object),
-			Origin: "WriteParquetToGCS",
-			Code:   bu.ErrGCS,
-			Err:    err,
-		}
-	}
+	// Cancelling the writer context before closing discards a partially written object
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	pw, err := ParquetWriter.NewParquetWriter(fw, reflect.New(typedData.Index(0).Type()).Interface(), 4)
+	fw, err := createGCSParquetFile(wctx, project, bucket, object, opts.EncryptionKey)
 	if err != nil {
 		return bu.TError{
-			Msg:    fmt.Sprintf("could not instantiate a Parquet Writer for %v/%v", bucket, object),
+			Msg:    fmt.Sprintf("could not instantiate a GCS File Writer for %v/%v", bucket, object),
 			Origin: "WriteParquetToGCS",
 			Code:   bu.ErrGCS,
 			Err:    err,
 		}
 	}
 
-	pw.RowGroupSize = 128 * 1024 * 1024 //128M
-	pw.CompressionType = parquet.CompressionCodec_SNAPPY
-
-	for i := 0; i < typedData.Len(); i++ {
-		if err = pw.Write(typedData.Index(i).Interface()); err != nil {
-			return bu.TError{
-				Msg:    fmt.Sprintf("failed while writing data[%v] to %v/%v", i, bucket, object),
-				Origin: "WriteParquetToGCS",
-				Code:   bu.ErrGCS,
-				Err:    err,
-			}
-		}
-	}
-
-	if err = pw.WriteStop(); err != nil {
+	fail := func(msg string, err error) error {
+		cancel()
+		fw.Close()
 		return bu.TError{
-			Msg:    fmt.Sprintf("could not commit written data to %v/%v, data might be corrupted", bucket, object),
+			Msg:    msg,
 			Origin: "WriteParquetToGCS",
 			Code:   bu.ErrGCS,
 			Err:    err,
 		}
 	}
 
-	fw.Close()
-
-	return nil
-}
-
-// WriteParquetWithSchemaToGCS writes a slice of data to a GCS object 
-func WriteParquetWithSchemaToGCS(ctx context.Context, data interface{}, project string, bucket string, object string, schema string) error {
-
-	typedData := reflect.ValueOf(data)
-
-	if typedData.Kind() != reflect.Slice || typedData.Len() == 0 {
-		return nil
-	}
-
-	fw, err := ParquetFile.NewGcsFileWriter(ctx, project, bucket, object)
-	if err != nil {
-		return bu.TError{
-			Msg:    fmt.Sprintf("could not instantiate a GCS File Writer for %v/%v", bucket, object),
-			Origin: "WriteParquetWithSchemaToGCS",
-			Code:   bu.ErrGCS,
-			Err:    err,
-		}
-	}
-
 	pw, err := ParquetWriter.NewParquetWriter(fw, reflect.New(typedData.Index(0).Type()).Interface(), 4)
 	if err != nil {
-		return bu.TError{
-			Msg:    fmt.Sprintf("could not instantiate a Parquet Writer for %v/%v", bucket, object),
-			Origin: "WriteParquetWithSchemaToGCS",
-			Code:   bu.ErrGCS,
-			Err:    err,
-		}
+		return fail(fmt.Sprintf("could not instantiate a Parquet Writer for %v/%v", bucket, object), err)
 	}
-	
-	if err = pw.SetSchemaHandlerFromJSON(schema); err != nil {
-		return bu.TError{
-			Msg:    fmt.Sprintf("could not set schema from JSON for the Parquet Writer for %v/%v", bucket, object),
-			Origin: "WriteParquetWithSchemaToGCS",
-			Code:   bu.ErrGCS,
-			Err:    err,
+
+	if opts.Schema != "" {
+		if err = pw.SetSchemaHandlerFromJSON(opts.Schema); err != nil {
+			return fail(fmt.Sprintf("could not set schema from JSON for the Parquet Writer for %v/%v", bucket, object), err)
 		}
 	}
 
 	pw.RowGroupSize = 128 * 1024 * 1024 //128M
+	if opts.RowGroupSize > 0 {
+		pw.RowGroupSize = opts.RowGroupSize
+	}
 	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	if opts.CompressionType != nil {
+		pw.CompressionType = *opts.CompressionType
+	}
 
 	for i := 0; i < typedData.Len(); i++ {
 		if err = pw.Write(typedData.Index(i).Interface()); err != nil {
-			return bu.TError{
-				Msg:    fmt.Sprintf("failed while writing data[%v] to %v/%v", i, bucket, object),
-				Origin: "WriteParquetWithSchemaToGCS",
-				Code:   bu.ErrGCS,
-				Err:    err,
-			}
+			return fail(fmt.Sprintf("failed while writing data[%v] to %v/%v", i, bucket, object), err)
 		}
 	}
 
 	if err = pw.WriteStop(); err != nil {
+		return fail(fmt.Sprintf("could not commit written data to %v/%v, data might be corrupted", bucket, object), err)
+	}
+
+	if err = fw.Close(); err != nil {
 		return bu.TError{
-			Msg:    fmt.Sprintf("could not commit written data to %v/%v, data might be corrupted", bucket, object),
-			Origin: "WriteParquetWithSchemaToGCS",
+			Msg:    fmt.Sprintf("could not close %v/%v, data might be corrupted", bucket, object),
+			Origin: "WriteParquetToGCS",
 			Code:   bu.ErrGCS,
 			Err:    err,
 		}
 	}
 
-	fw.Close()
-
 	return nil
 }
 
@@ -227,46 +195,5 @@ func WriteParquetWithSchemaToLocal(ctx context.Context, data interface{}, projec
 
 // UploadToGCS is a thin envelope for GCS upload
 func UploadToGCS(ctx context.Context, file string, bucket string, object string) error {
-	
-	f, err := os.Open(file)
-	if err != nil {
-		return bu.TError{
-			Msg:    fmt.Sprintf("could not open %v for reading", file),
-			Origin: "UploadToGCS",
-			Code:   bu.ErrGCS,
-			Err:    err,
-		}
-	}
-	defer f.Close()
-
-	gcsClient, err := storage.NewClient(ctx)
-	if err != nil {
-		return bu.TError{
-			Msg:    fmt.Sprintf("could not instantiate a GCS client while uploading %v to %v/%v", file, bucket, object),
-			Origin: "UploadToGCS",
-			Code:   bu.ErrGCS,
-			Err:    err,
-		}
-	}
-	defer gcsClient.Close()
-
-	wc := gcsClient.Bucket(bucket).Object(object).NewWriter(ctx)
-	
-	if _, err = io.Copy(wc, f); err != nil {
-		return bu.TError{
-			Msg:    fmt.Sprintf("upload failed: %v -> %v/%v", file, bucket, object),
-			Origin: "UploadToGCS",
-			Code:   bu.ErrGCS,
-			Err:    err,
-		}
-	}
-	if err := wc.Close(); err != nil {
-		return bu.TError{
-			Msg:    fmt.Sprintf("could not close %v/%v, data might be corrupted", bucket, object),
-			Origin: "UploadToGCS",
-			Code:   bu.ErrGCS,
-			Err:    err,
-		}
-	}
-	return nil
+	return UploadToGCSWithOptions(ctx, file, bucket, object, nil)
 }
\ No newline at end of file
@@ -0,0 +1,346 @@
+package gcstools
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gammazero/workerpool"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	"google.golang.org/api/iterator"
+
+	bu "github.com/belboo/boo-go-tools/misc"
+)
+
+// RetentionRule describes which objects under a prefix may be deleted.
+// When both MaxAge and KeepLastN are set an object has to qualify under both to be deleted.
+type RetentionRule struct {
+	Prefix string // e.g. "staging/", required
+	// Pattern is an optional regexp an object name (relative to Prefix) has to match to be considered
+	Pattern string
+	// MaxAge deletes objects created more than MaxAge ago (0 disables the age check)
+	MaxAge time.Duration
+	// KeepLastN keeps the N most recent subfolders directly under Prefix (0 disables the check)
+	KeepLastN int
+	// FolderLayout is a time layout the subfolder names are parsed with when ordering them,
+	// folders not matching it are never touched. Empty orders folders by name.
+	FolderLayout string
+	// MinKeep is a safeguard, at least MinKeep matching objects are always left under Prefix
+	MinKeep int
+}
+
+// RetentionOptions tunes ApplyRetention
+type RetentionOptions struct {
+	DryRun      bool // only report what would be deleted
+	Concurrency int  // parallel deletions, defaults to 8
+	Logger      *bu.TLogger
+}
+
+// RetentionObject is an object selected for deletion
+type RetentionObject struct {
+	Name    string
+	Size    int64
+	Created time.Time
+	Reason  string
+}
+
+// RetentionResult is the outcome of a single rule
+type RetentionResult struct {
+	Rule         RetentionRule
+	Scanned      int
+	Kept         int
+	Spared       int // candidates kept because of MinKeep
+	Candidates   []RetentionObject
+	Deleted      int
+	DeletedBytes int64
+	Errors       []error
+}
+
+// RetentionReport is returned by ApplyRetention, with DryRun set nothing in it has been deleted
+type RetentionReport struct {
+	Bucket  string
+	DryRun  bool
+	Results []RetentionResult
+}
+
+// String renders the report in a human readable form
+func (r *RetentionReport) String() string {
+	var sb strings.Builder
+	for _, res := range r.Results {
+		fmt.Fprintf(&sb, "gs://%v/%v: scanned %v, ", r.Bucket, res.Rule.Prefix, res.Scanned)
+		if r.DryRun {
+			var size int64
+			for _, o := range res.Candidates {
+				size += o.Size
+			}
+			fmt.Fprintf(&sb, "would delete %v objects (%v)", len(res.Candidates), bu.FormatBytes(size))
+		} else {
+			fmt.Fprintf(&sb, "deleted %v of %v objects (%v)", res.Deleted, len(res.Candidates), bu.FormatBytes(res.DeletedBytes))
+		}
+		fmt.Fprintf(&sb, ", kept %v, spared by min-keep %v", res.Kept, res.Spared)
+		if len(res.Errors) > 0 {
+			fmt.Fprintf(&sb, ", %v errors", len(res.Errors))
+		}
+		sb.WriteString("\n")
+		if r.DryRun {
+			for _, o := range res.Candidates {
+				fmt.Fprintf(&sb, "  %v (%v, %v)\n", o.Name, o.Created.Format(time.RFC3339), o.Reason)
+			}
+		}
+	}
+	return sb.String()
+}
+
+// ApplyRetention deletes (or with opts.DryRun only reports) objects in a bucket according to rules
+func ApplyRetention(ctx context.Context, bucket string, rules []RetentionRule, opts RetentionOptions) (*RetentionReport, error) {
+
+	report := &RetentionReport{Bucket: bucket, DryRun: opts.DryRun}
+
+	gcsClient, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, bu.TError{
+			Msg:    "could not instantiate a GCS client",
+			Origin: "ApplyRetention",
+			Code:   bu.ErrGCS,
+			Err:    err,
+		}
+	}
+	defer gcsClient.Close()
+
+	bkt := gcsClient.Bucket(bucket)
+	now := time.Now()
+	failed := 0
+
+	for _, rule := range rules {
+		res, err := planRetention(ctx, bkt, rule, now)
+		if err != nil {
+			return report, err
+		}
+
+		if !opts.DryRun && len(res.Candidates) > 0 {
+			deleteRetained(ctx, bkt, &res, opts)
+			failed += len(res.Errors)
+		}
+
+		if opts.Logger != nil {
+			opts.Logger.Logf("retention gs://%v/%v: %v candidates, %v deleted, %v errors\n",
+				bucket, rule.Prefix, len(res.Candidates), res.Deleted, len(res.Errors))
+		}
+
+		report.Results = append(report.Results, res)
+	}
+
+	if failed > 0 {
+		return report, bu.TError{
+			Msg:    fmt.Sprintf("%v objects in %v could not be deleted", failed, bucket),
+			Origin: "ApplyRetention",
+			Code:   bu.ErrGCS,
+			Err:    nil,
+		}
+	}
+
+	return report, nil
+}
+
+// planRetention lists the objects under the rule prefix and selects the ones to delete
+func planRetention(ctx context.Context, bkt *storage.BucketHandle, rule RetentionRule, now time.Time) (RetentionResult, error) {
+	res := RetentionResult{Rule: rule}
+
+	if rule.Prefix == "" || (rule.MaxAge <= 0 && rule.KeepLastN <= 0) {
+		return res, bu.TError{
+			Msg:    fmt.Sprintf("retention rule %+v needs a prefix and either MaxAge or KeepLastN", rule),
+			Origin: "ApplyRetention",
+			Code:   bu.ErrConfigError,
+			Err:    nil,
+		}
+	}
+
+	var pattern *regexp.Regexp
+	if rule.Pattern != "" {
+		var err error
+		if pattern, err = regexp.Compile(rule.Pattern); err != nil {
+			return res, bu.TError{
+				Msg:    fmt.Sprintf("invalid retention pattern %q", rule.Pattern),
+				Origin: "ApplyRetention",
+				Code:   bu.ErrConfigError,
+				Err:    err,
+			}
+		}
+	}
+
+	var objects []*storage.ObjectAttrs
+	it := bkt.Objects(ctx, &storage.Query{Prefix: rule.Prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return res, bu.TError{
+				Msg:    fmt.Sprintf("failed to list objects under %v", rule.Prefix),
+				Origin: "ApplyRetention",
+				Code:   bu.ErrGCS,
+				Err:    err,
+			}
+		}
+		objects = append(objects, attrs)
+	}
+
+	return selectRetained(objects, rule, pattern, now), nil
+}
+
+// selectRetained picks the objects of a rule to delete out of the ones listed under its prefix
+func selectRetained(objects []*storage.ObjectAttrs, rule RetentionRule, pattern *regexp.Regexp, now time.Time) RetentionResult {
+	res := RetentionResult{Rule: rule}
+
+	if pattern != nil {
+		matching := make([]*storage.ObjectAttrs, 0, len(objects))
+		for _, o := range objects {
+			if pattern.MatchString(strings.TrimPrefix(o.Name, rule.Prefix)) {
+				matching = append(matching, o)
+			}
+		}
+		objects = matching
+	}
+	res.Scanned = len(objects)
+
+	// Folders outside the last N (only the ones we can order are eligible)
+	var oldFolders map[string]bool
+	if rule.KeepLastN > 0 {
+		oldFolders = retentionOldFolders(objects, rule)
+	}
+
+	for _, o := range objects {
+		var reasons []string
+
+		if rule.MaxAge > 0 {
+			if now.Sub(o.Created) <= rule.MaxAge {
+				continue
+			}
+			reasons = append(reasons, fmt.Sprintf("older than %v", rule.MaxAge))
+		}
+
+		if rule.KeepLastN > 0 {
+			folder := retentionFolder(o.Name, rule.Prefix)
+			if !oldFolders[folder] {
+				continue
+			}
+			reasons = append(reasons, fmt.Sprintf("folder %v not among last %v", folder, rule.KeepLastN))
+		}
+
+		res.Candidates = append(res.Candidates, RetentionObject{
+			Name:    o.Name,
+			Size:    o.Size,
+			Created: o.Created,
+			Reason:  strings.Join(reasons, ", "),
+		})
+	}
+
+	// Spare the newest candidates if deleting all of them would leave less than MinKeep objects
+	if spare := rule.MinKeep - (len(objects) - len(res.Candidates)); spare > 0 {
+		sort.SliceStable(res.Candidates, func(i, j int) bool {
+			return res.Candidates[i].Created.After(res.Candidates[j].Created)
+		})
+		if spare > len(res.Candidates) {
+			spare = len(res.Candidates)
+		}
+		res.Spared = spare
+		res.Candidates = res.Candidates[spare:]
+	}
+
+	sort.Slice(res.Candidates, func(i, j int) bool {
+		return res.Candidates[i].Name < res.Candidates[j].Name
+	})
+	res.Kept = len(objects) - len(res.Candidates)
+
+	return res
+}
+
+// retentionFolder returns the first path element below prefix or "" for objects directly in it
+func retentionFolder(name string, prefix string) string {
+	rel := strings.TrimPrefix(name, prefix)
+	if i := strings.Index(rel, "/"); i >= 0 {
+		return rel[:i]
+	}
+	return ""
+}
+
+// retentionOldFolders returns the set of subfolders falling outside the rule's KeepLastN
+func retentionOldFolders(objects []*storage.ObjectAttrs, rule RetentionRule) map[string]bool {
+	type folder struct {
+		name string
+		date time.Time
+	}
+
+	seen := make(map[string]bool)
+	folders := make([]folder, 0)
+	for _, o := range objects {
+		name := retentionFolder(o.Name, rule.Prefix)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		f := folder{name: name}
+		if rule.FolderLayout != "" {
+			d, err := time.Parse(rule.FolderLayout, name)
+			if err != nil {
+				continue
+			}
+			f.date = d
+		}
+		folders = append(folders, f)
+	}
+
+	sort.Slice(folders, func(i, j int) bool {
+		if !folders[i].date.Equal(folders[j].date) {
+			return folders[i].date.Before(folders[j].date)
+		}
+		return folders[i].name < folders[j].name
+	})
+
+	old := make(map[string]bool)
+	for i := 0; i < len(folders)-rule.KeepLastN; i++ {
+		old[folders[i].name] = true
+	}
+	return old
+}
+
+// deleteRetained removes the rule's candidates concurrently, recording the outcome in res
+func deleteRetained(ctx context.Context, bkt *storage.BucketHandle, res *RetentionResult, opts RetentionOptions) {
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = 8
+	}
+
+	var mu sync.Mutex
+	wp := workerpool.New(concurrency)
+
+	for _, o := range res.Candidates {
+		o := o
+		wp.Submit(func() {
+			err := bkt.Object(o.Name).Delete(ctx)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil && err != storage.ErrObjectNotExist {
+				res.Errors = append(res.Errors, bu.TError{
+					Msg:    fmt.Sprintf("failed to delete %v", o.Name),
+					Origin: "ApplyRetention",
+					Code:   bu.ErrGCS,
+					Err:    err,
+				})
+				return
+			}
+			res.Deleted++
+			res.DeletedBytes += o.Size
+		})
+	}
+
+	wp.StopWait()
+}
@@ -0,0 +1,115 @@
+package gcstools
+
+import (
+	"errors"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestRetentionFolder(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		want   string
+	}{
+		{"staging/20190528/part-0.csv", "staging/", "20190528"},
+		{"staging/20190528/sub/part-0.csv", "staging/", "20190528"},
+		{"staging/part-0.csv", "staging/", ""},
+		{"staging/", "staging/", ""},
+	}
+
+	for _, tt := range tests {
+		if got := retentionFolder(tt.name, tt.prefix); got != tt.want {
+			t.Errorf("retentionFolder(%q, %q) = %q, want %q", tt.name, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestSelectRetained(t *testing.T) {
+	now := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	obj := func(name string, age time.Duration) *storage.ObjectAttrs {
+		return &storage.ObjectAttrs{Name: name, Size: 10, Created: now.Add(-age)}
+	}
+	day := 24 * time.Hour
+	objects := []*storage.ObjectAttrs{
+		obj("s/20190501/a.csv", 31*day),
+		obj("s/20190501/b.json", 30*day),
+		obj("s/20190515/a.csv", 17*day),
+		obj("s/20190530/a.csv", 2*day),
+		obj("s/latest/a.csv", 40*day),
+		obj("s/top.csv", 40*day),
+	}
+
+	tests := []struct {
+		name        string
+		rule        RetentionRule
+		pattern     string
+		want        []string
+		wantScanned int
+		wantSpared  int
+	}{
+		{"max age", RetentionRule{Prefix: "s/", MaxAge: 20 * day}, "",
+			[]string{"s/20190501/a.csv", "s/20190501/b.json", "s/latest/a.csv", "s/top.csv"}, 6, 0},
+		{"pattern", RetentionRule{Prefix: "s/", MaxAge: 20 * day}, `\.csv$`,
+			[]string{"s/20190501/a.csv", "s/latest/a.csv", "s/top.csv"}, 5, 0},
+		{"keep last by name", RetentionRule{Prefix: "s/", KeepLastN: 2}, "",
+			[]string{"s/20190501/a.csv", "s/20190501/b.json", "s/20190515/a.csv"}, 6, 0},
+		{"keep last by layout", RetentionRule{Prefix: "s/", KeepLastN: 2, FolderLayout: "20060102"}, "",
+			[]string{"s/20190501/a.csv", "s/20190501/b.json"}, 6, 0},
+		{"age and folder", RetentionRule{Prefix: "s/", KeepLastN: 1, FolderLayout: "20060102", MaxAge: 20 * day}, "",
+			[]string{"s/20190501/a.csv", "s/20190501/b.json"}, 6, 0},
+		{"min keep spares the newest", RetentionRule{Prefix: "s/", MaxAge: day, MinKeep: 3}, "",
+			[]string{"s/20190501/a.csv", "s/latest/a.csv", "s/top.csv"}, 6, 3},
+		{"min keep already met", RetentionRule{Prefix: "s/", MaxAge: 20 * day, MinKeep: 2}, "",
+			[]string{"s/20190501/a.csv", "s/20190501/b.json", "s/latest/a.csv", "s/top.csv"}, 6, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var pattern *regexp.Regexp
+			if tt.pattern != "" {
+				pattern = regexp.MustCompile(tt.pattern)
+			}
+			res := selectRetained(objects, tt.rule, pattern, now)
+
+			got := make([]string, 0, len(res.Candidates))
+			for _, o := range res.Candidates {
+				got = append(got, o.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("candidates = %v, want %v", got, tt.want)
+			}
+			if res.Scanned != tt.wantScanned || res.Spared != tt.wantSpared || res.Kept != tt.wantScanned-len(tt.want) {
+				t.Errorf("scanned %v, kept %v, spared %v, want %v, %v, %v",
+					res.Scanned, res.Kept, res.Spared, tt.wantScanned, tt.wantScanned-len(tt.want), tt.wantSpared)
+			}
+		})
+	}
+}
+
+func TestRetentionReportString(t *testing.T) {
+	res := RetentionResult{
+		Rule:         RetentionRule{Prefix: "s/"},
+		Scanned:      3,
+		Kept:         1,
+		Candidates:   []RetentionObject{{Name: "s/a", Size: 1024}, {Name: "s/b", Size: 1024}},
+		Deleted:      1,
+		DeletedBytes: 1024,
+		Errors:       []error{errors.New("boom")},
+	}
+
+	got := (&RetentionReport{Bucket: "b", Results: []RetentionResult{res}}).String()
+	if want := "gs://b/s/: scanned 3, deleted 1 of 2 objects (1.0 KiB), kept 1, spared by min-keep 0, 1 errors\n"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+
+	got = (&RetentionReport{Bucket: "b", DryRun: true, Results: []RetentionResult{res}}).String()
+	if !strings.HasPrefix(got, "gs://b/s/: scanned 3, would delete 2 objects (2.0 KiB)") || !strings.Contains(got, "  s/b (") {
+		t.Errorf("dry run String() = %q", got)
+	}
+}
@@ -0,0 +1,389 @@
+package gcstools
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+
+	bu "github.com/belboo/boo-go-tools/misc"
+)
+
+// TransferProgress is a snapshot of a running upload or download
+type TransferProgress struct {
+	Bucket     string
+	Object     string
+	BytesDone  int64
+	BytesTotal int64         // -1 if unknown
+	Rate       float64       // bytes per second since the transfer started
+	ETA        time.Duration // -1 if unknown
+	Elapsed    time.Duration
+	Done       bool
+}
+
+// Percent returns the completed share of the transfer in percent or -1 if the total is unknown
+func (p TransferProgress) Percent() float64 {
+	if p.BytesTotal <= 0 {
+		return -1
+	}
+	return 100 * float64(p.BytesDone) / float64(p.BytesTotal)
+}
+
+// ProgressFunc is called periodically during a transfer and once more when it completes
+type ProgressFunc func(TransferProgress)
+
+// TransferOptions tunes UploadToGCSWithOptions and DownloadFromGCS
+type TransferOptions struct {
+	// Progress is called at most once per ProgressInterval and once at the end
+	Progress         ProgressFunc
+	ProgressInterval time.Duration // defaults to 1s
+	// Limiter caps the bandwidth, share one between transfers to cap them together
+	Limiter *BandwidthLimiter
+	// ChunkSize is passed to the storage.Writer on upload (0 keeps the library default)
+	ChunkSize int
+	// EncryptionKey is an optional customer-supplied encryption key of the object
+	EncryptionKey []byte
+}
+
+// TLoggerProgress returns a ProgressFunc that reports transfer progress through a TLogger
+func TLoggerProgress(tl *bu.TLogger) ProgressFunc {
+	return func(p TransferProgress) {
+		if tl == nil || tl.LogLevel == bu.LogNone {
+			return
+		}
+
+		eta := "?"
+		if p.ETA >= 0 {
+			eta = p.ETA.Truncate(time.Second).String()
+		}
+
+		line := fmt.Sprintf("%v/%v: %v", p.Bucket, p.Object, bu.FormatBytes(p.BytesDone))
+		if p.BytesTotal >= 0 {
+			line += fmt.Sprintf(" / %v (%.1f%%)", bu.FormatBytes(p.BytesTotal), p.Percent())
+		}
+		line += fmt.Sprintf(" at %v/s", bu.FormatBytes(int64(p.Rate)))
+		if p.Done {
+			line += fmt.Sprintf(", done in %v", p.Elapsed.Truncate(time.Millisecond))
+		} else {
+			line += fmt.Sprintf(", ETA %v", eta)
+		}
+
+		tl.Log(line)
+	}
+}
+
+// BandwidthLimiter is a token bucket limiting the throughput of the transfers sharing it
+type BandwidthLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+// NewBandwidthLimiter creates a limiter allowing bytesPerSec on average and bursts of up to burst bytes
+// (burst <= 0 defaults to a quarter of a second worth of traffic)
+func NewBandwidthLimiter(bytesPerSec int64, burst int) *BandwidthLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = int(bytesPerSec / 4)
+		if burst < 32*1024 {
+			burst = 32 * 1024
+		}
+	}
+	return &BandwidthLimiter{
+		rate:   float64(bytesPerSec),
+		burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes n tokens from the bucket and returns how long the caller has to wait for them
+func (l *BandwidthLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > float64(l.burst) {
+		l.tokens = float64(l.burst)
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// WaitN blocks until n bytes may be transferred or ctx is done
+func (l *BandwidthLimiter) WaitN(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	for n > 0 {
+		take := n
+		if take > l.burst {
+			take = l.burst
+		}
+		if wait := l.reserve(take); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+		n -= take
+	}
+	return nil
+}
+
+// transferMeter is an io.Reader wrapper doing the throttling and progress accounting
+type transferMeter struct {
+	ctx      context.Context
+	r        io.Reader
+	opts     *TransferOptions
+	progress TransferProgress
+	started  time.Time
+	reported time.Time
+}
+
+func newTransferMeter(ctx context.Context, r io.Reader, opts *TransferOptions, bucket string, object string, total int64) *transferMeter {
+	if opts == nil {
+		opts = &TransferOptions{}
+	}
+	now := time.Now()
+	return &transferMeter{
+		ctx:      ctx,
+		r:        r,
+		opts:     opts,
+		progress: TransferProgress{Bucket: bucket, Object: object, BytesTotal: total, ETA: -1},
+		started:  now,
+		reported: now,
+	}
+}
+
+func (m *transferMeter) Read(p []byte) (int, error) {
+	if m.opts.Limiter != nil && len(p) > m.opts.Limiter.burst {
+		p = p[:m.opts.Limiter.burst]
+	}
+
+	n, err := m.r.Read(p)
+	if n > 0 {
+		if werr := m.opts.Limiter.WaitN(m.ctx, n); werr != nil {
+			return n, werr
+		}
+		m.progress.BytesDone += int64(n)
+
+		interval := m.opts.ProgressInterval
+		if interval <= 0 {
+			interval = time.Second
+		}
+		if time.Since(m.reported) >= interval {
+			m.report(false)
+		}
+	}
+	return n, err
+}
+
+func (m *transferMeter) report(done bool) {
+	if m.opts.Progress == nil {
+		return
+	}
+
+	now := time.Now()
+	m.reported = now
+	m.progress.Elapsed = now.Sub(m.started)
+	m.progress.Done = done
+	if secs := m.progress.Elapsed.Seconds(); secs > 0 {
+		m.progress.Rate = float64(m.progress.BytesDone) / secs
+	}
+	m.progress.ETA = -1
+	if done {
+		m.progress.ETA = 0
+	} else if m.progress.BytesTotal >= 0 && m.progress.Rate > 0 {
+		left := m.progress.BytesTotal - m.progress.BytesDone
+		m.progress.ETA = time.Duration(float64(left) / m.progress.Rate * float64(time.Second))
+	}
+
+	m.opts.Progress(m.progress)
+}
+
+// UploadToGCSWithOptions uploads a local file to GCS reporting progress and honouring the bandwidth limit in opts
+func UploadToGCSWithOptions(ctx context.Context, file string, bucket string, object string, opts *TransferOptions) error {
+
+	var key []byte
+	if opts != nil {
+		key = opts.EncryptionKey
+	}
+	if err := checkEncryptionKey(key); err != nil {
+		return err
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return bu.TError{
+			Msg:    fmt.Sprintf("could not open %v for reading", file),
+			Origin: "UploadToGCS",
+			Code:   bu.ErrGCS,
+			Err:    err,
+		}
+	}
+	defer f.Close()
+
+	total := int64(-1)
+	if fi, err := f.Stat(); err == nil {
+		total = fi.Size()
+	}
+
+	wc, err := newGCSObjectWriter(ctx, bucket, object, key, "UploadToGCS")
+	if err != nil {
+		return err
+	}
+	if opts != nil && opts.ChunkSize > 0 {
+		wc.ChunkSize = opts.ChunkSize
+	}
+
+	meter := newTransferMeter(ctx, f, opts, bucket, object, total)
+
+	if _, err = io.Copy(wc, meter); err != nil {
+		wc.Abort()
+		return bu.TError{
+			Msg:    fmt.Sprintf("upload failed: %v -> %v/%v", file, bucket, object),
+			Origin: "UploadToGCS",
+			Code:   bu.ErrGCS,
+			Err:    err,
+		}
+	}
+	if err := wc.Close(); err != nil {
+		return bu.TError{
+			Msg:    fmt.Sprintf("could not close %v/%v, data might be corrupted", bucket, object),
+			Origin: "UploadToGCS",
+			Code:   bu.ErrGCS,
+			Err:    err,
+		}
+	}
+	meter.report(true)
+
+	return nil
+}
+
+// DownloadFromGCS downloads a GCS object into a local file reporting progress and honouring the bandwidth limit in opts
+func DownloadFromGCS(ctx context.Context, bucket string, object string, file string, opts *TransferOptions) error {
+
+	var key []byte
+	if opts != nil {
+		key = opts.EncryptionKey
+	}
+	if err := checkEncryptionKey(key); err != nil {
+		return err
+	}
+
+	gcsClient, err := storage.NewClient(ctx)
+	if err != nil {
+		return bu.TError{
+			Msg:    fmt.Sprintf("could not instantiate a GCS client while downloading %v/%v to %v", bucket, object, file),
+			Origin: "DownloadFromGCS",
+			Code:   bu.ErrGCS,
+			Err:    err,
+		}
+	}
+	defer gcsClient.Close()
+
+	rc, err := withKey(gcsClient.Bucket(bucket).Object(object), key).NewReader(ctx)
+	if err != nil {
+		return bu.TError{
+			Msg:    fmt.Sprintf("could not open %v/%v for reading", bucket, object),
+			Origin: "DownloadFromGCS",
+			Code:   bu.ErrGCS,
+			Err:    err,
+		}
+	}
+	defer rc.Close()
+
+	f, err := os.Create(file)
+	if err != nil {
+		return bu.TError{
+			Msg:    fmt.Sprintf("could not open %v for writing", file),
+			Origin: "DownloadFromGCS",
+			Code:   bu.ErrGCS,
+			Err:    err,
+		}
+	}
+
+	meter := newTransferMeter(ctx, rc, opts, bucket, object, rc.Attrs.Size)
+
+	if _, err = io.Copy(f, meter); err != nil {
+		f.Close()
+		return bu.TError{
+			Msg:    fmt.Sprintf("download failed: %v/%v -> %v", bucket, object, file),
+			Origin: "DownloadFromGCS",
+			Code:   bu.ErrGCS,
+			Err:    err,
+		}
+	}
+	if err := f.Close(); err != nil {
+		return bu.TError{
+			Msg:    fmt.Sprintf("could not close %v, data might be corrupted", file),
+			Origin: "DownloadFromGCS",
+			Code:   bu.ErrGCS,
+			Err:    err,
+		}
+	}
+	meter.report(true)
+
+	return nil
+}
+
+// gcsObjectWriter closes the client it owns together with the object writer
+type gcsObjectWriter struct {
+	*storage.Writer
+	client *storage.Client
+	cancel context.CancelFunc
+}
+
+// newGCSObjectWriter opens gs://bucket/object for writing with its own client, the object is only
+// committed by Close
+func newGCSObjectWriter(ctx context.Context, bucket string, object string, key []byte, origin string) (*gcsObjectWriter, error) {
+	gcsClient, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, bu.TError{
+			Msg:    fmt.Sprintf("could not instantiate a GCS client while opening gs://%v/%v", bucket, object),
+			Origin: origin,
+			Code:   bu.ErrGCS,
+			Err:    err,
+		}
+	}
+
+	// Cancelling the writer context is the only way to abort an upload without committing it
+	wctx, cancel := context.WithCancel(ctx)
+
+	return &gcsObjectWriter{
+		Writer: withKey(gcsClient.Bucket(bucket).Object(object), key).NewWriter(wctx),
+		client: gcsClient,
+		cancel: cancel,
+	}, nil
+}
+
+func (w *gcsObjectWriter) Close() error {
+	defer w.client.Close()
+	defer w.cancel()
+	return w.Writer.Close()
+}
+
+// Abort discards the upload without committing the object
+func (w *gcsObjectWriter) Abort() {
+	w.cancel()
+	w.Writer.Close()
+	w.client.Close()
+}
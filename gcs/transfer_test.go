@@ -0,0 +1,83 @@
+package gcstools
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestNewBandwidthLimiter(t *testing.T) {
+	tests := []struct {
+		rate      int64
+		burst     int
+		wantNil   bool
+		wantBurst int
+	}{
+		{0, 0, true, 0},
+		{-1, 100, true, 0},
+		{1000, 100, false, 100},
+		{1000, 0, false, 32 * 1024},
+		{4 * 1024 * 1024, 0, false, 1024 * 1024},
+	}
+
+	for _, tt := range tests {
+		l := NewBandwidthLimiter(tt.rate, tt.burst)
+		if (l == nil) != tt.wantNil {
+			t.Errorf("NewBandwidthLimiter(%v, %v) = %v, want nil %v", tt.rate, tt.burst, l, tt.wantNil)
+			continue
+		}
+		if l != nil && l.burst != tt.wantBurst {
+			t.Errorf("NewBandwidthLimiter(%v, %v) burst = %v, want %v", tt.rate, tt.burst, l.burst, tt.wantBurst)
+		}
+	}
+}
+
+func TestBandwidthLimiterReserve(t *testing.T) {
+	tests := []struct {
+		name  string
+		takes []int
+		min   time.Duration // wait expected for the last take
+		max   time.Duration
+	}{
+		{"within the burst", []int{60, 40}, 0, 0},
+		{"past the burst", []int{100, 100}, 90 * time.Millisecond, 100 * time.Millisecond},
+		{"debt accumulates", []int{100, 100, 100}, 190 * time.Millisecond, 200 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewBandwidthLimiter(1000, 100)
+			var wait time.Duration
+			for _, n := range tt.takes {
+				wait = l.reserve(n)
+			}
+			if wait < tt.min || wait > tt.max {
+				t.Errorf("wait = %v, want within [%v, %v]", wait, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestBandwidthLimiterWaitN(t *testing.T) {
+	var nilLimiter *BandwidthLimiter
+	if err := nilLimiter.WaitN(context.Background(), 1<<30); err != nil {
+		t.Errorf("nil limiter WaitN() = %v, want nil", err)
+	}
+
+	l := NewBandwidthLimiter(1000, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.WaitN(ctx, 1000); err != context.Canceled {
+		t.Errorf("WaitN() on a cancelled context = %v, want %v", err, context.Canceled)
+	}
+
+	l = NewBandwidthLimiter(1000, 100)
+	start := time.Now()
+	if err := l.WaitN(context.Background(), 150); err != nil {
+		t.Fatalf("WaitN() = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("WaitN(150) over a 100 byte burst at 1000 B/s took %v, want at least 50ms", elapsed)
+	}
+}
@@ -276,4 +276,18 @@ func FilterByDates(data interface{}, field string, dates []time.Time, toTime fun
 // Desc prints the value given and its type
 func Desc(i interface{}) {
 	fmt.Printf("%T -> %v\n", i, i)
-}
\ No newline at end of file
+}
+
+// FormatBytes renders a byte count in human readable binary units
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit && n > -unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit || m <= -unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
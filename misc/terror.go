@@ -29,6 +29,12 @@ const (
 	ErrSameDstSrc		TErrorCode = "destination and source match"
 	ErrGeneric			TErrorCode = "somthing has gone south"
 	ErrGCS				TErrorCode = "GCS related error"
+	ErrUpdateTable		TErrorCode = "error updating table"
+	ErrSchemaMismatch	TErrorCode = "schema mismatch"
+	ErrBudgetExceeded	TErrorCode = "query budget exceeded"
+	ErrQuotaExceeded	TErrorCode = "quota or rate limit exceeded"
+	ErrNotFound			TErrorCode = "resource not found"
+	ErrBadData			TErrorCode = "invalid input data"
 )
 
 // TError is a dummy type for custom error